@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Abstracts the invocation of the consul ReST API to list the services in the
+// catalog, along with their tags. Blocks until the services change from 'waitIndex',
+// if it is non-zero, and also returns the consul index of the result.
+type ConsulCatalogLookup func(
+	/* consulAddress */ string,
+	/* datacenter    */ string,
+	/* waitIndex     */ uint64) (map[string][]string, uint64, error)
+
+// Abstracts the invocation of the consul ReST API to find the service meta of
+// the instances of a service, combined so that the first instance with a key wins
+type ConsulServiceMetaLookup func(
+	/* consulAddress */ string,
+	/* serviceName   */ string,
+	/* datacenter    */ string) (map[string]string, error)
+
+// the service meta key read for the local port of a service by default
+const defaultPortMetaKey = "proxy-port"
+
+/**
+ * Watches the consul catalog, proxying every service with the configured tag or
+ * meta key. Each service is given the local port in its meta, or else a port from
+ * the configured range, which it keeps for as long as it is proxied.
+ */
+type AutoProxier struct {
+	config       *AutoProxy
+	consulServer *ConsulServerConfig
+
+	// runs the proxies of the matching services
+	manager *ProxyManager
+
+	// the ports assigned from the range, by service name
+	ports map[string]int
+
+	// the ports reserved by the other proxies, which are not assigned
+	reserved *portReservations
+
+	// the service meta last read, by service name, kept for the services whose
+	// meta cannot be read
+	metas map[string]map[string]string
+
+	dnsSrv            DnsSrvLookup
+	consulCatalog     ConsulCatalogLookup
+	consulServiceMeta ConsulServiceMetaLookup
+
+	// how long to wait before retrying a failed read of the catalog
+	retryInterval time.Duration
+
+	// held while the proxies are changed, so that none are started once stopped
+	applyMu sync.Mutex
+
+	stopping stopper
+}
+
+func NewAutoProxier(config *AutoProxy, consulServer *ConsulServerConfig) (*AutoProxier, error) {
+	if config.ServiceTag == "" && config.ServiceMetaKey == "" {
+		return nil, errors.New("auto proxies must specify a ServiceTag or ServiceMetaKey")
+	}
+	if config.LocalPortMin > config.LocalPortMax || (config.LocalPortMin == 0) != (config.LocalPortMax == 0) {
+		return nil, fmt.Errorf("invalid local port range %d-%d", config.LocalPortMin, config.LocalPortMax)
+	}
+
+	return &AutoProxier{
+		config:            config,
+		consulServer:      consulServer,
+		manager:           NewProxyManager(),
+		ports:             make(map[string]int),
+		reserved:          newPortReservations(),
+		metas:             make(map[string]map[string]string),
+		dnsSrv:            dnsSrvLookup,
+		consulCatalog:     consulCatalogLookup,
+		consulServiceMeta: consulServiceMetaLookup,
+		retryInterval:     10 * time.Second,
+	}, nil
+}
+
+/**
+ * Watches the catalog until stopped, updating the proxies whenever it changes
+ */
+func (ap *AutoProxier) start() error {
+	log.Printf("Proxying the services %s", ap)
+
+	var index uint64
+	for {
+		select {
+		case <-ap.stopping.done():
+			return nil
+		default:
+		}
+
+		next, err := ap.refresh(index)
+		if err != nil {
+			log.Printf("Unable to read the services %s from the consul catalog - %s", ap, err)
+			ap.stopping.sleep(ap.retryInterval)
+			continue
+		}
+
+		// the index going backwards means the catalog was reset
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+/**
+ * Stops watching the catalog, and stops every proxy
+ */
+func (ap *AutoProxier) stop() {
+	ap.stopping.stop()
+
+	ap.applyMu.Lock()
+	defer ap.applyMu.Unlock()
+	ap.manager.stop()
+	ap.reserved.release(ap)
+}
+
+func (ap *AutoProxier) String() string {
+	var description string
+	if ap.config.ServiceTag != "" {
+		description = "tagged " + ap.config.ServiceTag
+	}
+	if ap.config.ServiceMetaKey != "" {
+		if description != "" {
+			description += " or "
+		}
+		description += "with service meta " + ap.config.ServiceMetaKey
+	}
+	return description
+}
+
+/**
+ * Reads the catalog, blocking until it changes if 'waitIndex' is non-zero, then
+ * proxies the matching services. Returns the index of the catalog.
+ *
+ * A service whose meta cannot be read keeps the meta last read for it, or else is
+ * skipped, and an error is returned once the others are proxied so that the
+ * catalog is read again.
+ */
+func (ap *AutoProxier) refresh(waitIndex uint64) (uint64, error) {
+	server, err := findConsulServer(ap.consulServer, ap.dnsSrv)
+	if err != nil {
+		return 0, err
+	}
+
+	services, index, err := ap.consulCatalog(server, ap.config.Datacenter, waitIndex)
+	if err != nil {
+		return 0, err
+	}
+	if index == waitIndex {
+		return index, nil
+	}
+
+	var names, failed []string
+	metas := make(map[string]map[string]string)
+	for name, tags := range services {
+		tagged := ap.config.ServiceTag != "" && hasTag(tags, ap.config.ServiceTag)
+		if !tagged && ap.config.ServiceMetaKey == "" {
+			continue
+		}
+
+		meta, err := ap.consulServiceMeta(server, name, ap.config.Datacenter)
+		if err != nil {
+			log.Printf("Unable to read the service meta of %s - %s", name, err)
+			failed = append(failed, name)
+
+			var ok bool
+			if meta, ok = ap.metas[name]; !ok {
+				continue
+			}
+		}
+		if _, ok := meta[ap.config.ServiceMetaKey]; !tagged && !ok {
+			continue
+		}
+
+		names = append(names, name)
+		metas[name] = meta
+	}
+	sort.Strings(names)
+	sort.Strings(failed)
+
+	ap.applyMu.Lock()
+	defer ap.applyMu.Unlock()
+
+	select {
+	case <-ap.stopping.done():
+		return index, nil
+	default:
+	}
+
+	var proxies []*ProxiedService
+	ap.reserved.reserve(ap, func(reserved map[int]bool) []int {
+		proxies = ap.proxiedServices(names, metas, reserved)
+
+		var ports []int
+		for _, proxy := range proxies {
+			ports = append(ports, proxy.LocalPort)
+		}
+		return ports
+	})
+	ap.metas = metas
+
+	config := &ConsulProxyConfig{
+		ConsulServer: ap.consulServer,
+		Proxies:      proxies,
+	}
+	if err := ap.manager.apply(config); err != nil {
+		log.Printf("Unable to proxy some of the services %s - %s", ap, err)
+	}
+
+	if len(failed) != 0 {
+		return index, fmt.Errorf("unable to read the service meta of %s", strings.Join(failed, ", "))
+	}
+	return index, nil
+}
+
+/**
+ * The proxies of the services, using the port in the meta of each service, or else
+ * the port it was already assigned, or else the lowest free port in the range. Ports
+ * reserved by the other proxies are not used.
+ */
+func (ap *AutoProxier) proxiedServices(names []string, metas map[string]map[string]string, reserved map[int]bool) []*ProxiedService {
+	portMetaKey := ap.config.PortMetaKey
+	if portMetaKey == "" {
+		portMetaKey = defaultPortMetaKey
+	}
+
+	ports := make(map[string]int)
+	used := make(map[int]bool)
+	for port := range reserved {
+		used[port] = true
+	}
+	for _, name := range names {
+		value, ok := metas[name][portMetaKey]
+		if !ok {
+			continue
+		}
+
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 || used[port] {
+			log.Printf("Ignoring the invalid, duplicate or reserved %s '%s' of service %s", portMetaKey, value, name)
+			continue
+		}
+		ports[name] = port
+		used[port] = true
+	}
+
+	assigned := make(map[string]int)
+	for _, name := range names {
+		if port, ok := ap.ports[name]; ok && ports[name] == 0 && !used[port] {
+			ports[name] = port
+			assigned[name] = port
+			used[port] = true
+		}
+	}
+
+	var proxies []*ProxiedService
+	for _, name := range names {
+		port := ports[name]
+		if port == 0 {
+			port = ap.freePort(used)
+			if port == 0 {
+				log.Printf("Unable to proxy service %s, there are no free ports between %d and %d", name, ap.config.LocalPortMin, ap.config.LocalPortMax)
+				continue
+			}
+			assigned[name] = port
+			used[port] = true
+		}
+
+		proxies = append(proxies, &ProxiedService{
+			ServiceName: name,
+			Datacenter:  ap.config.Datacenter,
+			LocalIP:     ap.config.LocalIP,
+			LocalPort:   port,
+			Protocol:    ap.config.Protocol,
+		})
+	}
+
+	ap.ports = assigned
+	return proxies
+}
+
+/**
+ * The lowest port in the range that is not used, 0 if there is none
+ */
+func (ap *AutoProxier) freePort(used map[int]bool) int {
+	if ap.config.LocalPortMin == 0 {
+		return 0
+	}
+	for port := ap.config.LocalPortMin; port <= ap.config.LocalPortMax; port++ {
+		if !used[port] {
+			return port
+		}
+	}
+	return 0
+}
+
+func consulCatalogLookup(consulAddress string, datacenter string, waitIndex uint64) (map[string][]string, uint64, error) {
+	config := consul.DefaultConfig()
+	config.Address = consulAddress
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	options := &consul.QueryOptions{
+		Datacenter: datacenter,
+		WaitIndex:  waitIndex,
+		WaitTime:   consulKvWaitTime,
+	}
+
+	services, meta, err := client.Catalog().Services(options)
+	if err != nil {
+		return nil, 0, err
+	}
+	return services, meta.LastIndex, nil
+}
+
+func consulServiceMetaLookup(consulAddress string, serviceName string, datacenter string) (map[string]string, error) {
+	config := consul.DefaultConfig()
+	config.Address = consulAddress
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	instances, _, err := client.Catalog().Service(serviceName, "", &consul.QueryOptions{Datacenter: datacenter})
+	if err != nil {
+		return nil, err
+	}
+
+	meta := make(map[string]string)
+	for _, instance := range instances {
+		for key, value := range instance.ServiceMeta {
+			if _, ok := meta[key]; !ok {
+				meta[key] = value
+			}
+		}
+	}
+	return meta, nil
+}
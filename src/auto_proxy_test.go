@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func newTestAutoProxier(t *testing.T, config *AutoProxy, services map[string][]string, metas map[string]map[string]string) (*AutoProxier, map[string]*fakeProxy) {
+	ap, err := NewAutoProxier(config, &ConsulServerConfig{Address: "consul:8500"})
+	assertNil(t, err)
+
+	ap.consulCatalog = func(consulAddress string, datacenter string, waitIndex uint64) (map[string][]string, uint64, error) {
+		return services, waitIndex + 1, nil
+	}
+	ap.consulServiceMeta = func(consulAddress string, serviceName string, datacenter string) (map[string]string, error) {
+		return metas[serviceName], nil
+	}
+
+	var created map[string]*fakeProxy
+	ap.manager, created = newFakeProxyManager()
+	return ap, created
+}
+
+func TestNewAutoProxier_Validation(t *testing.T) {
+	_, err := NewAutoProxier(&AutoProxy{}, &ConsulServerConfig{})
+	assertNotNil(t, err)
+
+	_, err = NewAutoProxier(&AutoProxy{ServiceTag: "public", LocalPortMin: 9000}, &ConsulServerConfig{})
+	assertNotNil(t, err)
+}
+
+func TestAutoProxier_refresh(t *testing.T) {
+	services := map[string][]string{
+		"orders":   {"public"},
+		"payments": {"public", "v2"},
+		"billing":  {"internal"},
+		"search":   {},
+	}
+	metas := map[string]map[string]string{
+		"payments": {"proxy-port": "9500"},
+		"search":   {"expose": "true"},
+	}
+	ap, created := newTestAutoProxier(t, &AutoProxy{
+		ServiceTag:     "public",
+		ServiceMetaKey: "expose",
+		LocalPortMin:   9000,
+		LocalPortMax:   9001,
+	}, services, metas)
+
+	_, err := ap.refresh(0)
+	assertNil(t, err)
+	assertEqual(t, 3, ap.manager.count(), "proxies of the tagged services, and the service with the meta key")
+	assertEqual(t, 9000, ap.ports["orders"], "port from the range")
+	assertEqual(t, 9001, ap.ports["search"], "port from the range")
+	assertEqual(t, 0, ap.ports["payments"], "port from the meta is not assigned")
+	assertEqual(t, true, created["billing"] == nil, "untagged service not proxied")
+
+	// orders is deregistered, so search keeps its port
+	orders := created["orders"]
+	delete(services, "orders")
+	services["catalog"] = []string{"public"}
+
+	_, err = ap.refresh(1)
+	assertNil(t, err)
+	assertEqual(t, true, orders.stopped, "proxy of the deregistered service stopped")
+	assertEqual(t, 9001, ap.ports["search"], "port kept")
+	assertEqual(t, 9000, ap.ports["catalog"], "freed port reused")
+
+	ap.stop()
+	assertEqual(t, 0, ap.manager.count(), "proxies stopped")
+}
+
+func TestAutoProxier_refreshPortsExhausted(t *testing.T) {
+	ap, _ := newTestAutoProxier(t, &AutoProxy{
+		ServiceTag:   "public",
+		LocalPortMin: 9000,
+		LocalPortMax: 9000,
+	}, map[string][]string{
+		"orders":   {"public"},
+		"payments": {"public"},
+	}, nil)
+
+	_, err := ap.refresh(0)
+	assertNil(t, err)
+	assertEqual(t, 1, ap.manager.count(), "only one port to assign")
+}
+
+func TestAutoProxier_refreshError(t *testing.T) {
+	ap, _ := newTestAutoProxier(t, &AutoProxy{ServiceTag: "public"}, map[string][]string{"orders": {"public"}}, nil)
+	ap.consulServiceMeta = func(consulAddress string, serviceName string, datacenter string) (map[string]string, error) {
+		return nil, errors.New("consul is down")
+	}
+
+	_, err := ap.refresh(0)
+	assertNotNil(t, err)
+	assertEqual(t, 0, ap.manager.count(), "proxies unchanged")
+}
+
+func TestAutoProxier_refreshMetaErrors(t *testing.T) {
+	services := map[string][]string{
+		"orders":   {"public"},
+		"payments": {"public"},
+	}
+	metas := map[string]map[string]string{
+		"orders":   {"proxy-port": "9500"},
+		"payments": {"proxy-port": "9501"},
+	}
+	ap, created := newTestAutoProxier(t, &AutoProxy{ServiceTag: "public"}, services, metas)
+
+	_, err := ap.refresh(0)
+	assertNil(t, err)
+	assertEqual(t, 2, ap.manager.count(), "proxies of the tagged services")
+
+	// the meta of orders cannot be read, and shipping is new
+	orders := created["orders"]
+	services["shipping"] = []string{"public"}
+	metas["shipping"] = map[string]string{"proxy-port": "9502"}
+	ap.consulServiceMeta = func(consulAddress string, serviceName string, datacenter string) (map[string]string, error) {
+		if serviceName == "orders" {
+			return nil, errors.New("consul is busy")
+		}
+		return metas[serviceName], nil
+	}
+
+	_, err = ap.refresh(1)
+	assertNotNil(t, err)
+	assertEqual(t, 3, ap.manager.count(), "the other services are proxied")
+	assertEqual(t, false, orders.stopped, "the service keeps the meta last read")
+	assertEqual(t, orders, created["orders"], "the proxy of the service is unchanged")
+}
+
+func TestAutoProxier_refreshReservedPorts(t *testing.T) {
+	services := map[string][]string{
+		"orders":   {"public"},
+		"payments": {"public"},
+	}
+	metas := map[string]map[string]string{
+		"orders": {"proxy-port": "9500"},
+	}
+	ap, _ := newTestAutoProxier(t, &AutoProxy{
+		ServiceTag:   "public",
+		LocalPortMin: 9000,
+		LocalPortMax: 9002,
+	}, services, metas)
+
+	// ports used by the other proxies
+	ap.reserved.reserve("other", func(reserved map[int]bool) []int { return []int{9000, 9500} })
+
+	_, err := ap.refresh(0)
+	assertNil(t, err)
+	assertEqual(t, 2, ap.manager.count(), "proxies of the tagged services")
+	assertEqual(t, 9001, ap.ports["orders"], "reserved meta port replaced by a port from the range")
+	assertEqual(t, 9002, ap.ports["payments"], "reserved port in the range skipped")
+	assertEqual(t, true, ap.reserved.owners[9002] == ap, "assigned ports reserved")
+
+	ap.stop()
+	assertEqual(t, 2, len(ap.reserved.owners), "ports released when stopped")
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+/**
+ * Limits the rate data is copied between the clients and backends of a proxy, in each
+ * direction. Upstream is the data sent by clients to backends, and downstream the data
+ * sent back to clients.
+ */
+type bandwidthLimits struct {
+	// the bytes per second each connection may copy, 0 for no limit
+	upstream   float64
+	downstream float64
+
+	// shared by every connection of the proxy, nil for no limit
+	serviceUpstream   *tokenBucket
+	serviceDownstream *tokenBucket
+}
+
+/**
+ * The bandwidth limits of the service, nil if it has none
+ */
+func newBandwidthLimits(service *ProxiedService) (*bandwidthLimits, error) {
+	rates := []int64{service.UpstreamBytesPerSec, service.DownstreamBytesPerSec, service.ServiceUpstreamBytesPerSec, service.ServiceDownstreamBytesPerSec}
+	limited := false
+	for _, rate := range rates {
+		if rate < 0 {
+			return nil, fmt.Errorf("invalid bandwidth limit %d", rate)
+		}
+		limited = limited || rate > 0
+	}
+	if !limited {
+		return nil, nil
+	}
+
+	return &bandwidthLimits{
+		upstream:          float64(service.UpstreamBytesPerSec),
+		downstream:        float64(service.DownstreamBytesPerSec),
+		serviceUpstream:   newBandwidthBucket(service.ServiceUpstreamBytesPerSec, time.Now()),
+		serviceDownstream: newBandwidthBucket(service.ServiceDownstreamBytesPerSec, time.Now()),
+	}, nil
+}
+
+/**
+ * A bucket allowing a second of data at the rate, nil if the rate is 0
+ */
+func newBandwidthBucket(bytesPerSec int64, now time.Time) *tokenBucket {
+	if bytesPerSec == 0 {
+		return nil
+	}
+	return newTokenBucket(float64(bytesPerSec), 0, now)
+}
+
+/**
+ * Wraps the readers of the client and backend of a new connection, limiting the rate
+ * data is read from each to the limits of the connection and the proxy
+ */
+func (bl *bandwidthLimits) throttle(client io.Reader, backend io.Reader) (io.Reader, io.Reader) {
+	if bl == nil {
+		return client, backend
+	}
+
+	now := time.Now()
+	return newThrottledReader(client, newBandwidthBucket(int64(bl.upstream), now), bl.serviceUpstream),
+		newThrottledReader(backend, newBandwidthBucket(int64(bl.downstream), now), bl.serviceDownstream)
+}
+
+/**
+ * Reads no faster than every one of its buckets allows, by waiting after each read
+ * until the buckets hold the bytes read
+ */
+type throttledReader struct {
+	reader  io.Reader
+	buckets []*tokenBucket
+
+	// the most bytes read at once, so that a single read never waits for more than a
+	// burst of any bucket
+	maxRead int
+}
+
+/**
+ * Wraps the reader with the buckets that are not nil, returning the reader itself
+ * if they all are
+ */
+func newThrottledReader(reader io.Reader, buckets ...*tokenBucket) io.Reader {
+	throttled := &throttledReader{reader: reader}
+	for _, bucket := range buckets {
+		if bucket == nil {
+			continue
+		}
+		throttled.buckets = append(throttled.buckets, bucket)
+		if burst := int(bucket.burst); throttled.maxRead == 0 || burst < throttled.maxRead {
+			throttled.maxRead = burst
+		}
+	}
+
+	if len(throttled.buckets) == 0 {
+		return reader
+	}
+	return throttled
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > r.maxRead {
+		b = b[:r.maxRead]
+	}
+
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		var wait time.Duration
+		now := time.Now()
+		for _, bucket := range r.buckets {
+			if delay := bucket.reserve(float64(n), now); delay > wait {
+				wait = delay
+			}
+		}
+		time.Sleep(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+/**
+ * How long it takes to read everything from the reader
+ */
+func timeRead(t *testing.T, reader io.Reader) time.Duration {
+	start := time.Now()
+	_, err := io.Copy(ioutil.Discard, reader)
+	assertNil(t, err)
+	return time.Since(start)
+}
+
+func TestNewBandwidthLimits(t *testing.T) {
+	limits, err := newBandwidthLimits(&ProxiedService{})
+	assertNil(t, err)
+	assertEqual(t, true, limits == nil, "no limits")
+
+	limits, err = newBandwidthLimits(&ProxiedService{DownstreamBytesPerSec: 1000})
+	assertNil(t, err)
+	assertEqual(t, 1000.0, limits.downstream, "downstream limit")
+	assertEqual(t, true, limits.serviceUpstream == nil, "no service limit")
+
+	_, err = newBandwidthLimits(&ProxiedService{ServiceUpstreamBytesPerSec: -1})
+	assertNotNil(t, err)
+}
+
+func TestThrottledReader(t *testing.T) {
+	// a second's worth is read straight away, and the rest at the rate
+	bucket := newTokenBucket(100000, 0, time.Now())
+	elapsed := timeRead(t, newThrottledReader(bytes.NewReader(make([]byte, 200000)), bucket))
+	assertEqual(t, true, elapsed >= 900*time.Millisecond && elapsed < 3*time.Second, "throttled to the rate, took "+elapsed.String())
+
+	reader := bytes.NewReader(nil)
+	assertEqual(t, io.Reader(reader), newThrottledReader(reader, nil, nil), "unthrottled without buckets")
+}
+
+func TestBandwidthLimits_SharedByService(t *testing.T) {
+	limits, err := newBandwidthLimits(&ProxiedService{ServiceUpstreamBytesPerSec: 100000})
+	assertNil(t, err)
+
+	first, _ := limits.throttle(bytes.NewReader(make([]byte, 100000)), bytes.NewReader(nil))
+	elapsed := timeRead(t, first)
+	assertEqual(t, true, elapsed < 500*time.Millisecond, "first connection uses the burst, took "+elapsed.String())
+
+	second, downstream := limits.throttle(bytes.NewReader(make([]byte, 100000)), bytes.NewReader(make([]byte, 100000)))
+	elapsed = timeRead(t, downstream)
+	assertEqual(t, true, elapsed < 500*time.Millisecond, "downstream is not limited, took "+elapsed.String())
+	elapsed = timeRead(t, second)
+	assertEqual(t, true, elapsed >= 900*time.Millisecond, "second connection waits for the shared bucket, took "+elapsed.String())
+}
+
+/**
+ * Only the direction that is limited is throttled
+ */
+func TestProxyConnection_Bandwidth(t *testing.T) {
+	backend := startTcpEchoServer(t)
+	defer backend.Close()
+
+	client, done := proxyTestConnection(t, backend.Addr().String(), connectionTimeouts{}, &bandwidthLimits{downstream: 100000})
+	defer client.Close()
+
+	start := time.Now()
+	go func() {
+		client.Write(make([]byte, 200000))
+		client.CloseWrite()
+	}()
+	echoed, err := ioutil.ReadAll(client)
+	assertNil(t, err)
+	elapsed := time.Since(start)
+
+	assertEqual(t, 200000, len(echoed), "echoed")
+	assertEqual(t, true, elapsed >= 900*time.Millisecond && elapsed < 3*time.Second, "downstream throttled, took "+elapsed.String())
+	assertProxyingFinished(t, done, "connection was not closed")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Decides which clients may connect to a proxy, by the CIDR ranges their address
+ * is allowed or denied by, and how often each client address may open connections.
+ */
+type clientFilter struct {
+	// clients in a denied range are rejected, as are clients outside every allowed
+	// range, unless there are none
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	// the new connections each client may open per second, and in a burst. 0 for no limit
+	rate  float64
+	burst float64
+
+	// the bucket of each client address, must be accessed under mu
+	clients   map[string]*tokenBucket
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// the reasons a client is rejected, which are also the counters of the rejections
+const (
+	clientDenied      = "rejected_denied"
+	clientRateLimited = "rejected_rate"
+)
+
+// how often buckets that have refilled are forgotten
+const clientSweepInterval = time.Minute
+
+func newClientFilter(service *ProxiedService) (*clientFilter, error) {
+	allow, err := parseCidrs(service.AllowCidrs)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCidrs(service.DenyCidrs)
+	if err != nil {
+		return nil, err
+	}
+	if service.ClientConnectionsPerSec < 0 {
+		return nil, fmt.Errorf("invalid ClientConnectionsPerSec %v", service.ClientConnectionsPerSec)
+	}
+
+	return &clientFilter{
+		allow:     allow,
+		deny:      deny,
+		rate:      service.ClientConnectionsPerSec,
+		burst:     float64(service.ClientConnectionsBurst),
+		clients:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}, nil
+}
+
+/**
+ * Parses CIDR ranges, along with single addresses which are treated as ranges
+ * of one address
+ */
+func parseCidrs(values []string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%s'", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, cidr, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s'", value)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+func containsIp(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Whether the filter allows every client, so nothing needs to be checked
+ */
+func (cf *clientFilter) allowsAll() bool {
+	return len(cf.allow) == 0 && len(cf.deny) == 0 && cf.rate == 0
+}
+
+/**
+ * Checks whether a new connection from the address may be proxied, returning
+ * the reason it is rejected, or "" if it is admitted. Addresses that are not
+ * IP addresses, e.g. of unix sockets, are only admitted without allow lists.
+ */
+func (cf *clientFilter) admit(addr net.Addr, now time.Time) string {
+	if cf.allowsAll() {
+		return ""
+	}
+
+	var ip net.IP
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	}
+
+	if ip == nil {
+		if len(cf.allow) != 0 {
+			return clientDenied
+		}
+		return ""
+	}
+	if containsIp(cf.deny, ip) || (len(cf.allow) != 0 && !containsIp(cf.allow, ip)) {
+		return clientDenied
+	}
+
+	if cf.rate > 0 && !cf.bucket(ip.String(), now).take(now) {
+		return clientRateLimited
+	}
+	return ""
+}
+
+/**
+ * The bucket of the client, forgetting the clients whose buckets have refilled
+ * every sweep interval so that the buckets of past clients are not kept forever
+ */
+func (cf *clientFilter) bucket(client string, now time.Time) *tokenBucket {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	if now.Sub(cf.lastSweep) >= clientSweepInterval {
+		for address, bucket := range cf.clients {
+			if bucket.full(now) {
+				delete(cf.clients, address)
+			}
+		}
+		cf.lastSweep = now
+	}
+
+	bucket, ok := cf.clients[client]
+	if !ok {
+		bucket = newTokenBucket(cf.rate, cf.burst, now)
+		cf.clients[client] = bucket
+	}
+	return bucket
+}
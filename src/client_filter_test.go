@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func TestParseCidrs(t *testing.T) {
+	cidrs, err := parseCidrs([]string{"10.0.0.0/8", "192.168.1.5", "fd00::/8", "::1"})
+	assertNil(t, err)
+	assertEqual(t, "10.0.0.0/8", cidrs[0].String(), "CIDR")
+	assertEqual(t, "192.168.1.5/32", cidrs[1].String(), "single IPv4 address")
+	assertEqual(t, "fd00::/8", cidrs[2].String(), "IPv6 CIDR")
+	assertEqual(t, "::1/128", cidrs[3].String(), "single IPv6 address")
+
+	_, err = parseCidrs([]string{"10.0.0.0/33"})
+	assertNotNil(t, err)
+	_, err = parseCidrs([]string{"not-an-address"})
+	assertNotNil(t, err)
+}
+
+func TestClientFilter_AllowDeny(t *testing.T) {
+	filter, err := newClientFilter(&ProxiedService{
+		AllowCidrs: []string{"10.0.0.0/8"},
+		DenyCidrs:  []string{"10.0.1.0/24"},
+	})
+	assertNil(t, err)
+
+	now := time.Now()
+	assertEqual(t, "", filter.admit(tcpAddr("10.0.0.1"), now), "allowed range")
+	assertEqual(t, clientDenied, filter.admit(tcpAddr("10.0.1.1"), now), "denied range takes precedence")
+	assertEqual(t, clientDenied, filter.admit(tcpAddr("192.168.0.1"), now), "outside the allowed ranges")
+	assertEqual(t, "", filter.admit(tcpAddr("::ffff:10.0.0.1"), now), "IPv4-mapped address")
+	assertEqual(t, clientDenied, filter.admit(&net.UnixAddr{Name: "@", Net: "unix"}, now), "unix clients are not in an allowed range")
+}
+
+func TestClientFilter_DenyOnly(t *testing.T) {
+	filter, err := newClientFilter(&ProxiedService{DenyCidrs: []string{"192.168.0.0/16"}})
+	assertNil(t, err)
+
+	now := time.Now()
+	assertEqual(t, "", filter.admit(tcpAddr("10.0.0.1"), now), "not denied")
+	assertEqual(t, clientDenied, filter.admit(tcpAddr("192.168.3.4"), now), "denied")
+	assertEqual(t, "", filter.admit(&net.UnixAddr{Name: "@", Net: "unix"}, now), "unix clients allowed")
+}
+
+func TestClientFilter_RateLimit(t *testing.T) {
+	filter, err := newClientFilter(&ProxiedService{ClientConnectionsPerSec: 1, ClientConnectionsBurst: 2})
+	assertNil(t, err)
+
+	now := time.Now()
+	assertEqual(t, "", filter.admit(tcpAddr("10.0.0.1"), now), "first connection")
+	assertEqual(t, "", filter.admit(tcpAddr("10.0.0.1"), now), "second connection of the burst")
+	assertEqual(t, clientRateLimited, filter.admit(tcpAddr("10.0.0.1"), now), "over the rate")
+	assertEqual(t, "", filter.admit(tcpAddr("10.0.0.2"), now), "other clients have their own bucket")
+
+	assertEqual(t, "", filter.admit(tcpAddr("10.0.0.1"), now.Add(time.Second)), "token refilled")
+
+	filter.admit(tcpAddr("10.0.0.3"), now.Add(2*clientSweepInterval))
+	assertEqual(t, 1, len(filter.clients), "refilled buckets forgotten")
+}
+
+/**
+ * Connections from a denied client are closed as soon as they are accepted
+ */
+func TestConsulProxy_DenyCidrs(t *testing.T) {
+	backend := startTcpEchoServer(t)
+	defer backend.Close()
+
+	discoverer, err := NewStaticDiscoverer("denied-service", []string{backend.Addr().String()})
+	assertNil(t, err)
+
+	proxyPort := getFreePort()
+	proxy, err := NewProxy(&ProxiedService{
+		ServiceName: "denied-service",
+		LocalIP:     "127.0.0.1",
+		LocalPort:   proxyPort,
+		DenyCidrs:   []string{"127.0.0.0/8"},
+	}, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	defer proxy.stop()
+	time.Sleep(200 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(proxyPort))
+	assertNil(t, err)
+	defer conn.Close()
+	_, err = echo(t, conn, "denied")
+	assertNotNil(t, err)
+
+	assertEqual(t, "1", serviceConnectionStats("denied-service").Get(clientDenied).String(), "rejections counted")
+}
+
+func TestNewProxy_ClientFiltersValidated(t *testing.T) {
+	discoverer, err := NewStaticDiscoverer("my-service", []string{"127.0.0.1:1"})
+	assertNil(t, err)
+
+	_, err = NewProxy(&ProxiedService{ServiceName: "my-service", AllowCidrs: []string{"10.0.0.0/99"}}, discoverer, &ConsulServerConfig{})
+	assertNotNil(t, err)
+
+	_, err = NewProxy(&ProxiedService{ServiceName: "my-service", Protocol: ProtocolUdp, DenyCidrs: []string{"10.0.0.0/8"}}, discoverer, &ConsulServerConfig{})
+	assertNotNil(t, err)
+}
+
+/**
+ * Clients sending a PROXY protocol header are filtered by the address in the header,
+ * not the address of the load balancer that connected
+ */
+func TestConsulProxy_DenyCidrs_ProxyProtocol(t *testing.T) {
+	backend := startTcpEchoServer(t)
+	defer backend.Close()
+
+	discoverer, err := NewStaticDiscoverer("header-filtered-service", []string{backend.Addr().String()})
+	assertNil(t, err)
+
+	proxyPort := getFreePort()
+	proxy, err := NewProxy(&ProxiedService{
+		ServiceName:         "header-filtered-service",
+		LocalIP:             "127.0.0.1",
+		LocalPort:           proxyPort,
+		AcceptProxyProtocol: true,
+		DenyCidrs:           []string{"192.168.0.0/16"},
+	}, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	defer proxy.stop()
+	time.Sleep(200 * time.Millisecond)
+
+	connect := func(client string) (string, error) {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(proxyPort))
+		assertNil(t, err)
+		defer conn.Close()
+		writeProxyHeader(conn, ProxyProtocolV1, tcpAddr(client), conn.RemoteAddr())
+		return echo(t, conn, "filtered")
+	}
+
+	line, err := connect("10.0.0.1")
+	assertNil(t, err)
+	assertEqual(t, "filtered\n", line, "client in the header admitted")
+
+	_, err = connect("192.168.1.1")
+	assertNotNil(t, err)
+	assertEqual(t, "1", serviceConnectionStats("header-filtered-service").Get(clientDenied).String(), "rejections counted")
+}
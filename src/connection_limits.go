@@ -0,0 +1,244 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+/**
+ * This file contains the admission control of new connections, limiting how many
+ * connections are open at once across every proxy, per proxy and per backend.
+ */
+
+// the counters of the connections of every proxy, keyed by service name
+var connectionStats = expvar.NewMap("connections")
+var connectionStatsMu sync.Mutex
+
+/**
+ * The connection counters of the service, e.g. how many are active and rejected
+ */
+func serviceConnectionStats(serviceName string) *expvar.Map {
+	connectionStatsMu.Lock()
+	defer connectionStatsMu.Unlock()
+
+	if stats, ok := connectionStats.Get(serviceName).(*expvar.Map); ok {
+		return stats
+	}
+	stats := new(expvar.Map).Init()
+	connectionStats.Set(serviceName, stats)
+	return stats
+}
+
+// the counter of the connections rejected by a limit
+const connectionLimited = "rejected_limit"
+
+// the limit on the connections open at once across every proxy, set from the config
+var globalConnections = newConnectionLimiter(0)
+
+// what is done with connections over a limit
+const (
+	OverLimitReject = "reject"
+	OverLimitQueue  = "queue"
+)
+
+// the most connections that wait for each limit at once under the queue policy by default
+const defaultMaxQueuedConnections = 100
+
+/**
+ * Limits the number of connections open at once. Connections over the limit can wait
+ * for others to close
+ */
+type connectionLimiter struct {
+	// the most connections that can be open, 0 for no limit
+	// must be accessed under mu, along with the other fields
+	limit  int
+	active int
+
+	// the connections waiting for others to close
+	waiting int
+
+	// closed, and replaced, whenever a connection is released, waking anything waiting
+	released chan struct{}
+
+	mu sync.Mutex
+}
+
+func newConnectionLimiter(limit int) *connectionLimiter {
+	return &connectionLimiter{
+		limit:    limit,
+		released: make(chan struct{}),
+	}
+}
+
+/**
+ * Changes the limit. Connections already open over a lower limit are left open
+ */
+func (cl *connectionLimiter) setLimit(limit int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.limit = limit
+	cl.broadcast()
+}
+
+/**
+ * Admits a connection, waiting until the deadline for another to be released if
+ * the limit has been reached. The connection is not admitted, without waiting, if
+ * 'maxWaiting' connections are already waiting. Returns false if the connection
+ * was not admitted.
+ */
+func (cl *connectionLimiter) acquire(deadline time.Time, maxWaiting int) bool {
+	waiting := false
+	defer func() {
+		if waiting {
+			cl.mu.Lock()
+			cl.waiting--
+			cl.mu.Unlock()
+		}
+	}()
+
+	for {
+		cl.mu.Lock()
+		if cl.limit <= 0 || cl.active < cl.limit {
+			cl.active++
+			cl.mu.Unlock()
+			return true
+		}
+		if !waiting {
+			if cl.waiting >= maxWaiting {
+				cl.mu.Unlock()
+				return false
+			}
+			cl.waiting++
+			waiting = true
+		}
+		released := cl.released
+		cl.mu.Unlock()
+
+		if !waitForRelease(released, deadline) {
+			return false
+		}
+	}
+}
+
+func (cl *connectionLimiter) release() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.active--
+	cl.broadcast()
+}
+
+// must be called under mu
+func (cl *connectionLimiter) broadcast() {
+	close(cl.released)
+	cl.released = make(chan struct{})
+}
+
+/**
+ * Waits for the channel to be closed, returning false if the deadline passes first
+ */
+func waitForRelease(released <-chan struct{}, deadline time.Time) bool {
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-released:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+/**
+ * Balances connections over the endpoints that have fewer than the maximum number
+ * of connections open to them
+ */
+type endpointLimiter struct {
+	// the most connections open to each endpoint, 0 for no limit
+	limit int
+
+	// the connections open to each endpoint, by host:port, and the connections
+	// waiting for one of them to close
+	// must be accessed under mu
+	active   map[string]int
+	waiting  int
+	released chan struct{}
+	mu       sync.Mutex
+}
+
+func newEndpointLimiter(limit int) *endpointLimiter {
+	return &endpointLimiter{
+		limit:    limit,
+		active:   make(map[string]int),
+		released: make(chan struct{}),
+	}
+}
+
+/**
+ * Chooses an endpoint from those below the limit, waiting until the deadline for a
+ * connection to one of them to be released if they are all at the limit, unless
+ * 'maxWaiting' connections are already waiting. Returns nil, and whether every
+ * endpoint was at the limit, if none could be chosen.
+ */
+func (el *endpointLimiter) acquire(endpoints []*Endpoint, deadline time.Time, maxWaiting int) (*Endpoint, bool) {
+	if len(endpoints) == 0 {
+		return nil, false
+	}
+
+	waiting := false
+	defer func() {
+		if waiting {
+			el.mu.Lock()
+			el.waiting--
+			el.mu.Unlock()
+		}
+	}()
+
+	for {
+		el.mu.Lock()
+		var available []*Endpoint
+		for _, endpoint := range endpoints {
+			if el.limit <= 0 || el.active[endpoint.String()] < el.limit {
+				available = append(available, endpoint)
+			}
+		}
+
+		if endpoint := selectEndpoint(available); endpoint != nil {
+			el.active[endpoint.String()]++
+			el.mu.Unlock()
+			return endpoint, false
+		}
+		if !waiting {
+			if el.waiting >= maxWaiting {
+				el.mu.Unlock()
+				return nil, true
+			}
+			el.waiting++
+			waiting = true
+		}
+		released := el.released
+		el.mu.Unlock()
+
+		if !waitForRelease(released, deadline) {
+			return nil, true
+		}
+	}
+}
+
+func (el *endpointLimiter) release(endpoint *Endpoint) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	address := endpoint.String()
+	if el.active[address]--; el.active[address] <= 0 {
+		delete(el.active, address)
+	}
+	close(el.released)
+	el.released = make(chan struct{})
+}
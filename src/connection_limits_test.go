@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/**
+ * A TCP server echoing each line back to the client, until the client closes
+ */
+func startTcpEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNil(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+/**
+ * Sends a line through the connection, returning the line echoed back
+ */
+func echo(t *testing.T, conn net.Conn, line string) (string, error) {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(line + "\n")); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+func TestConnectionLimiter_Reject(t *testing.T) {
+	limiter := newConnectionLimiter(1)
+	assertEqual(t, true, limiter.acquire(time.Now(), 0), "first connection admitted")
+	assertEqual(t, false, limiter.acquire(time.Now(), 0), "second connection rejected")
+
+	limiter.release()
+	assertEqual(t, true, limiter.acquire(time.Now(), 0), "admitted once released")
+}
+
+func TestConnectionLimiter_Queue(t *testing.T) {
+	limiter := newConnectionLimiter(1)
+	assertEqual(t, true, limiter.acquire(time.Now(), 0), "first connection admitted")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		limiter.release()
+	}()
+	assertEqual(t, true, limiter.acquire(time.Now().Add(2*time.Second), 1), "queued connection admitted on release")
+	assertEqual(t, false, limiter.acquire(time.Now().Add(50*time.Millisecond), 1), "queued connection timed out")
+}
+
+func TestConnectionLimiter_QueueFull(t *testing.T) {
+	limiter := newConnectionLimiter(1)
+	assertEqual(t, true, limiter.acquire(time.Now(), 1), "first connection admitted")
+
+	queued := make(chan bool)
+	go func() {
+		queued <- limiter.acquire(time.Now().Add(2*time.Second), 1)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	assertEqual(t, false, limiter.acquire(time.Now().Add(2*time.Second), 1), "rejected while the queue is full")
+	assertEqual(t, true, time.Since(start) < time.Second, "rejected without waiting")
+
+	limiter.release()
+	assertEqual(t, true, <-queued, "queued connection admitted on release")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		limiter.release()
+	}()
+	assertEqual(t, true, limiter.acquire(time.Now().Add(2*time.Second), 1), "queued once the queue has room")
+}
+
+func TestConnectionLimiter_NoLimit(t *testing.T) {
+	limiter := newConnectionLimiter(0)
+	for i := 0; i < 100; i++ {
+		assertEqual(t, true, limiter.acquire(time.Now(), 0), "admitted without a limit")
+	}
+
+	limiter.setLimit(100)
+	assertEqual(t, false, limiter.acquire(time.Now(), 0), "rejected once a limit is set")
+}
+
+func TestEndpointLimiter_acquire(t *testing.T) {
+	first, _ := parseEndpoint("10.0.0.1:80")
+	second, _ := parseEndpoint("10.0.0.2:80")
+	endpoints := []*Endpoint{first, second}
+	limiter := newEndpointLimiter(1)
+
+	acquired := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		endpoint, full := limiter.acquire(endpoints, time.Now(), 0)
+		assertEqual(t, false, full, "endpoint below the limit")
+		acquired[endpoint.String()] = true
+	}
+	assertEqual(t, 2, len(acquired), "each endpoint chosen once")
+
+	endpoint, full := limiter.acquire(endpoints, time.Now(), 0)
+	assertEqual(t, true, endpoint == nil, "no endpoint chosen")
+	assertEqual(t, true, full, "every endpoint at the limit")
+
+	limiter.release(second)
+	endpoint, _ = limiter.acquire(endpoints, time.Now(), 0)
+	assertEqual(t, "10.0.0.2:80", endpoint.String(), "released endpoint chosen")
+
+	endpoint, full = limiter.acquire(nil, time.Now(), 0)
+	assertEqual(t, true, endpoint == nil, "no endpoint chosen")
+	assertEqual(t, false, full, "no endpoints")
+}
+
+/**
+ * A second connection to a proxy limited to one connection is closed, and
+ * counted as rejected, while the first stays open
+ */
+func TestConsulProxy_MaxConnections(t *testing.T) {
+	backend := startTcpEchoServer(t)
+	defer backend.Close()
+
+	discoverer, err := NewStaticDiscoverer("limited-service", []string{backend.Addr().String()})
+	assertNil(t, err)
+
+	proxyPort := getFreePort()
+	proxy, err := NewProxy(&ProxiedService{
+		ServiceName:    "limited-service",
+		LocalIP:        "127.0.0.1",
+		LocalPort:      proxyPort,
+		MaxConnections: 1,
+	}, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	defer proxy.stop()
+	time.Sleep(200 * time.Millisecond)
+
+	address := "127.0.0.1:" + strconv.Itoa(proxyPort)
+	first, err := net.Dial("tcp", address)
+	assertNil(t, err)
+	defer first.Close()
+	line, err := echo(t, first, "first")
+	assertNil(t, err)
+	assertEqual(t, "first\n", line, "first connection proxied")
+
+	second, err := net.Dial("tcp", address)
+	assertNil(t, err)
+	defer second.Close()
+	_, err = echo(t, second, "second")
+	assertNotNil(t, err)
+
+	stats := serviceConnectionStats("limited-service")
+	assertEqual(t, "1", stats.Get("rejected_limit").String(), "rejections counted")
+	assertEqual(t, "1", stats.Get("active").String(), "active connections")
+}
+
+func TestNewProxy_ConnectionLimitsValidated(t *testing.T) {
+	discoverer, err := NewStaticDiscoverer("my-service", []string{"127.0.0.1:1"})
+	assertNil(t, err)
+
+	_, err = NewProxy(&ProxiedService{ServiceName: "my-service", OverLimitPolicy: "drop"}, discoverer, &ConsulServerConfig{})
+	assertNotNil(t, err)
+
+	_, err = NewProxy(&ProxiedService{ServiceName: "my-service", Protocol: ProtocolHttp, MaxConnections: 1}, discoverer, &ConsulServerConfig{})
+	assertNotNil(t, err)
+}
+
+/**
+ * A client that has not sent its PROXY protocol header does not hold a connection
+ * under the limit
+ */
+func TestConsulProxy_MaxConnections_ProxyProtocol(t *testing.T) {
+	backend := startTcpEchoServer(t)
+	defer backend.Close()
+
+	discoverer, err := NewStaticDiscoverer("slow-header-service", []string{backend.Addr().String()})
+	assertNil(t, err)
+
+	proxyPort := getFreePort()
+	proxy, err := NewProxy(&ProxiedService{
+		ServiceName:         "slow-header-service",
+		LocalIP:             "127.0.0.1",
+		LocalPort:           proxyPort,
+		AcceptProxyProtocol: true,
+		MaxConnections:      1,
+	}, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	defer proxy.stop()
+	time.Sleep(200 * time.Millisecond)
+
+	address := "127.0.0.1:" + strconv.Itoa(proxyPort)
+	slow, err := net.Dial("tcp", address)
+	assertNil(t, err)
+	defer slow.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", address)
+	assertNil(t, err)
+	defer conn.Close()
+	writeProxyHeader(conn, ProxyProtocolV1, tcpAddr("10.0.0.1"), conn.RemoteAddr())
+	line, err := echo(t, conn, "proxied")
+	assertNil(t, err)
+	assertEqual(t, "proxied\n", line, "connection proxied while the other has not sent its header")
+}
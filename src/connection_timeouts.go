@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * How long a proxied TCP connection may stay open, and how its sockets are kept alive
+ */
+type connectionTimeouts struct {
+	// how long the connection may go without data being sent in either direction,
+	// and how long it may stay open. 0 for no limit
+	idle        time.Duration
+	maxLifetime time.Duration
+
+	// how long the connection may stay open once one side has finished sending. 0 for no limit
+	halfClose time.Duration
+
+	// the interval of TCP keepalive probes on the client and backend sockets. 0 uses
+	// the default of the net package, and a negative interval disables keepalives
+	keepAlive time.Duration
+}
+
+func newConnectionTimeouts(service *ProxiedService) connectionTimeouts {
+	return connectionTimeouts{
+		idle:        time.Duration(service.IdleTimeoutSec) * time.Second,
+		maxLifetime: time.Duration(service.MaxLifetimeSec) * time.Second,
+		halfClose:   time.Duration(service.HalfCloseTimeoutSec) * time.Second,
+		keepAlive:   time.Duration(service.KeepAliveSec) * time.Second,
+	}
+}
+
+/**
+ * Applies the keepalive settings to an accepted TCP connection. Other connections,
+ * e.g. from unix sockets, are left as they are
+ */
+func setKeepAlive(conn net.Conn, keepAlive time.Duration) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || keepAlive == 0 {
+		return
+	}
+
+	if keepAlive < 0 {
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(keepAlive)
+}
+
+/**
+ * Closes both sides of a connection once it is idle for longer than the idle timeout,
+ * or open for longer than the max lifetime, stopping once 'done' is closed.
+ * 'lastActive' holds when data was last sent, in nanoseconds since the epoch.
+ */
+func watchConnection(client net.Conn, backend net.Conn, idleTimeout time.Duration, maxLifetime time.Duration, lastActive *int64, done <-chan struct{}, kind string) {
+	if idleTimeout <= 0 && maxLifetime <= 0 {
+		return
+	}
+
+	interval := time.Second
+	for _, timeout := range []time.Duration{idleTimeout, maxLifetime} {
+		if timeout > 0 && timeout/4 < interval {
+			interval = timeout / 4
+		}
+	}
+
+	opened := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(lastActive)))
+		if idleTimeout > 0 && idle >= idleTimeout {
+			log.Printf("Closing %s from %s after being idle for %s", kind, client.RemoteAddr(), idle)
+		} else if maxLifetime > 0 && time.Since(opened) >= maxLifetime {
+			log.Printf("Closing %s from %s after reaching its max lifetime", kind, client.RemoteAddr())
+		} else {
+			continue
+		}
+
+		client.Close()
+		backend.Close()
+		return
+	}
+}
+
+/**
+ * Waits for the other direction of a connection to finish once one has, closing
+ * both sides if it does not finish within the half close timeout
+ */
+func awaitHalfClosed(other <-chan struct{}, client net.Conn, backend net.Conn, halfCloseTimeout time.Duration) {
+	if halfCloseTimeout <= 0 {
+		<-other
+		return
+	}
+
+	timer := time.NewTimer(halfCloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-other:
+		return
+	case <-timer.C:
+	}
+
+	log.Printf("Closing connection from %s, which was half closed for longer than %s", client.RemoteAddr(), halfCloseTimeout)
+	client.Close()
+	backend.Close()
+	<-other
+}
+
+/**
+ * Records when data was last read through it
+ */
+type activityReader struct {
+	reader io.Reader
+	touch  func()
+}
+
+func (r *activityReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		r.touch()
+	}
+	return n, err
+}
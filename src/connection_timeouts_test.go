@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+/**
+ * Proxies a new TCP connection to the backend address with the timeouts and bandwidth
+ * limits, returning the client side of the connection and a channel closed once
+ * proxying finishes
+ */
+func proxyTestConnection(t *testing.T, backendAddress string, timeouts connectionTimeouts, bandwidth *bandwidthLimits) (*net.TCPConn, chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNil(t, err)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	assertNil(t, err)
+	accepted, err := listener.Accept()
+	assertNil(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		proxyConnection(accepted, backendAddress, "", timeouts, bandwidth)
+		close(done)
+	}()
+	return client.(*net.TCPConn), done
+}
+
+/**
+ * Waits for the proxying of a connection to finish, failing if it takes too long
+ */
+func assertProxyingFinished(t *testing.T, done chan struct{}, message string) {
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal(message)
+	}
+}
+
+func TestProxyConnection_IdleTimeout(t *testing.T) {
+	backend := startTcpEchoServer(t)
+	defer backend.Close()
+
+	client, done := proxyTestConnection(t, backend.Addr().String(), connectionTimeouts{idle: 200 * time.Millisecond}, nil)
+	defer client.Close()
+
+	// activity keeps the connection open beyond the idle timeout
+	for i := 0; i < 4; i++ {
+		line, err := echo(t, client, "ping")
+		assertNil(t, err)
+		assertEqual(t, "ping\n", line, "echoed while active")
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assertProxyingFinished(t, done, "idle connection was not closed")
+	_, err := echo(t, client, "ping")
+	assertNotNil(t, err)
+}
+
+func TestProxyConnection_MaxLifetime(t *testing.T) {
+	backend := startTcpEchoServer(t)
+	defer backend.Close()
+
+	start := time.Now()
+	client, done := proxyTestConnection(t, backend.Addr().String(), connectionTimeouts{maxLifetime: 300 * time.Millisecond}, nil)
+	defer client.Close()
+
+	for {
+		if _, err := echo(t, client, "ping"); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assertProxyingFinished(t, done, "connection outlived its max lifetime")
+	assertEqual(t, true, time.Since(start) >= 300*time.Millisecond, "open until the max lifetime")
+}
+
+func TestProxyConnection_HalfCloseTimeout(t *testing.T) {
+	// the backend never finishes sending
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNil(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	client, done := proxyTestConnection(t, backend.Addr().String(), connectionTimeouts{halfClose: 200 * time.Millisecond}, nil)
+	defer client.Close()
+
+	client.Write([]byte("request"))
+	client.CloseWrite()
+
+	assertProxyingFinished(t, done, "half closed connection was not closed")
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assertEqual(t, io.EOF, err, "client connection closed")
+}
+
+func TestProxyConnection_HalfClosedWithoutTimeout(t *testing.T) {
+	backend := startTcpEchoServer(t)
+	defer backend.Close()
+
+	client, done := proxyTestConnection(t, backend.Addr().String(), connectionTimeouts{}, nil)
+	defer client.Close()
+
+	client.Write([]byte("request\n"))
+	client.CloseWrite()
+
+	// the backend still sends its response once the client has finished sending
+	response, err := ioutil.ReadAll(client)
+	assertNil(t, err)
+	assertEqual(t, "request\n", string(response), "response after half close")
+	assertProxyingFinished(t, done, "connection was not closed")
+}
+
+func TestNewConnectionTimeouts(t *testing.T) {
+	timeouts := newConnectionTimeouts(&ProxiedService{IdleTimeoutSec: 60, MaxLifetimeSec: 3600, HalfCloseTimeoutSec: 5, KeepAliveSec: -1})
+	assertEqual(t, time.Minute, timeouts.idle, "idle timeout")
+	assertEqual(t, time.Hour, timeouts.maxLifetime, "max lifetime")
+	assertEqual(t, 5*time.Second, timeouts.halfClose, "half close timeout")
+	assertEqual(t, true, timeouts.keepAlive < 0, "keepalives disabled")
+}
@@ -0,0 +1,904 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+/**
+ * This file contains the discovery of services through the service-router, service-splitter
+ * and service-resolver consul config entries, so that clients of the proxy are routed in the
+ * same way as service mesh clients.
+ *
+ * See https://developer.hashicorp.com/consul/docs/connect/l7-traffic/discovery-chain
+ */
+
+// Abstracts the invocation of the consul ReST API to list the config entries of a
+// kind. Blocks until the entries change from 'waitIndex', if it is non-zero, and
+// also returns the consul index of the result.
+type ConsulConfigEntryLookup func(
+	/* consulAddress */ string,
+	/* kind          */ string,
+	/* waitIndex     */ uint64) ([]consul.ConfigEntry, uint64, error)
+
+// the config entry kinds that affect the backends chosen
+var configEntryKinds = []string{consul.ServiceRouter, consul.ServiceSplitter, consul.ServiceResolver}
+
+// the most redirects, or nested splitters, followed before giving up on a chain that loops
+const maxChainDepth = 8
+
+/**
+ * Discovers the backends of a service as the service mesh would, following the
+ * redirects, subsets and failover of its service-resolver, the weights of its
+ * service-splitter and, for HTTP requests, the routes of its service-router.
+ *
+ * The config entries are watched, and the chain rebuilt whenever they change. Only
+ * the parts of the entries that choose the backends are applied, i.e. not timeouts,
+ * retries or header changes. Until the entries can be read, or if they are invalid,
+ * the last good chain is used, or the service itself if there is none.
+ */
+type ConfigEntryDiscoverer struct {
+	// the proxied service, whose settings are used to discover every target
+	service *ProxiedService
+
+	consulServer        *ConsulServerConfig
+	dnsSrv              DnsSrvLookup
+	consulConfigEntries ConsulConfigEntryLookup
+
+	// creates the discoverer of a target, replaced in tests
+	newTarget func(target *chainTarget) Discoverer
+
+	// how long to wait before retrying a failed read of the config entries
+	retryInterval time.Duration
+
+	// the config entries of each kind, by service name
+	// must be accessed under entriesMu
+	entries   map[string]map[string]consul.ConfigEntry
+	entriesMu sync.Mutex
+
+	// the current chain, and the discoverers of its targets by discovery key
+	// must be accessed under chainMu
+	chain   *discoveryChain
+	targets map[string]Discoverer
+	chainMu sync.Mutex
+
+	// the discoverers of new targets that are still starting, stopped along with the
+	// targets of the chain. Must be accessed under chainMu
+	starting map[Discoverer]bool
+
+	// serialises rebuilding the chain
+	rebuildMu sync.Mutex
+
+	// how long a rebuild waits for the new targets to start before switching to the new
+	// chain, as a target in an unreachable datacenter may never start
+	startTimeout time.Duration
+
+	stopping stopper
+}
+
+/**
+ * The service instances a chain resolves to, i.e. a subset of a service in a datacenter
+ */
+type chainTarget struct {
+	service    string
+	subset     string
+	datacenter string
+
+	// the consul filter expression of the subset
+	filter string
+
+	// the discoverer of the target, set once the chain is built
+	discoverer Discoverer
+}
+
+/**
+ * Identifies the target, in the style of consul's target ids
+ */
+func (t *chainTarget) key() string {
+	key := t.service
+	if t.subset != "" {
+		key = t.subset + "." + key
+	}
+	if t.datacenter != "" {
+		key = key + "/" + t.datacenter
+	}
+	return key
+}
+
+/**
+ * Identifies what the target discovers. Unlike the key this includes the filter, so
+ * that a target is discovered again when the filter of its subset is changed
+ */
+func (t *chainTarget) discoveryKey() string {
+	return t.key() + "?filter=" + t.filter
+}
+
+/**
+ * The compiled routes, splits and targets of a service
+ */
+type discoveryChain struct {
+	// the routes of the service-router, checked in order
+	routes []*chainRoute
+
+	// where connections, and requests not matching any route, are sent
+	destination *chainDestination
+
+	// every target of the chain by key
+	targets map[string]*chainTarget
+}
+
+/**
+ * A route of a service-router, with its regular expressions compiled
+ */
+type chainRoute struct {
+	match         *consul.ServiceRouteHTTPMatch
+	regexps       map[string]*regexp.Regexp
+	prefixRewrite string
+	destination   *chainDestination
+}
+
+/**
+ * A service, or subset of a service, that traffic is sent to. Implements Discoverer,
+ * providing the endpoints of its splits, weighted by their share of the traffic.
+ */
+type chainDestination struct {
+	serviceName string
+	splits      []*chainSplit
+}
+
+/**
+ * A share of the traffic, sent to the first target with endpoints, in failover order
+ */
+type chainSplit struct {
+	weight  float64
+	targets []*chainTarget
+}
+
+/**
+ * service - the proxied service, which must use consul discovery
+ */
+func NewConfigEntryDiscoverer(service *ProxiedService, consulServer *ConsulServerConfig) (*ConfigEntryDiscoverer, error) {
+	if service.Discovery != "" && service.Discovery != DiscoveryConsul {
+		return nil, errors.New("consul config entries can only be used with consul discovery")
+	}
+	if service.ServiceTag != "" || len(service.Splits) != 0 {
+		return nil, errors.New("consul config entries cannot be combined with ServiceTag or Splits")
+	}
+
+	ced := &ConfigEntryDiscoverer{
+		service:             service,
+		consulServer:        consulServer,
+		dnsSrv:              dnsSrvLookup,
+		consulConfigEntries: consulConfigEntryLookup,
+		retryInterval:       10 * time.Second,
+		entries:             make(map[string]map[string]consul.ConfigEntry),
+		targets:             make(map[string]Discoverer),
+		starting:            make(map[Discoverer]bool),
+		startTimeout:        10 * time.Second,
+	}
+	ced.newTarget = func(target *chainTarget) Discoverer {
+		lookup := NewConsulLookup(target.service, target.datacenter, consulServer)
+		lookup.subset = target.subset
+		lookup.filter = target.filter
+		lookup.addressFamily = service.AddressFamily
+		lookup.addressPolicy = service.AddressPolicy
+		return lookup
+	}
+	return ced, nil
+}
+
+/**
+ * Reads the config entries, then starts discovering the targets of the chain and
+ * watching the entries for changes. Blocks until the targets have started, or the
+ * start timeout has passed.
+ */
+func (ced *ConfigEntryDiscoverer) start() {
+	indexes := make(map[string]uint64)
+	for _, kind := range configEntryKinds {
+		index, err := ced.refreshEntries(kind, 0)
+		if err != nil {
+			log.Printf("Unable to read the %s config entries for service %s - %s", kind, ced.service.ServiceName, err)
+		}
+		indexes[kind] = index
+	}
+
+	ced.rebuild()
+
+	for _, kind := range configEntryKinds {
+		go ced.watchEntries(kind, indexes[kind])
+	}
+}
+
+/**
+ * Reads the config entries of the kind each time they change from the index,
+ * rebuilding the chain
+ */
+func (ced *ConfigEntryDiscoverer) watchEntries(kind string, index uint64) {
+	for {
+		select {
+		case <-ced.stopping.done():
+			return
+		default:
+		}
+
+		next, err := ced.refreshEntries(kind, index)
+		if err != nil {
+			log.Printf("Unable to read the %s config entries for service %s - %s", kind, ced.service.ServiceName, err)
+			ced.stopping.sleep(ced.retryInterval)
+			continue
+		}
+
+		if next != index {
+			ced.rebuild()
+		}
+
+		// the index going backwards means the consul state was reset
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+/**
+ * Reads the config entries of the kind, blocking until they change if 'waitIndex' is
+ * non-zero. Returns the index of the entries.
+ */
+func (ced *ConfigEntryDiscoverer) refreshEntries(kind string, waitIndex uint64) (uint64, error) {
+	server, err := findConsulServer(ced.consulServer, ced.dnsSrv)
+	if err != nil {
+		return 0, err
+	}
+
+	entries, index, err := ced.consulConfigEntries(server, kind, waitIndex)
+	if err != nil {
+		return 0, err
+	}
+
+	byName := make(map[string]consul.ConfigEntry, len(entries))
+	for _, entry := range entries {
+		byName[entry.GetName()] = entry
+	}
+
+	ced.entriesMu.Lock()
+	ced.entries[kind] = byName
+	ced.entriesMu.Unlock()
+	return index, nil
+}
+
+/**
+ * Compiles the chain from the current config entries, starts discovering any new
+ * targets, then switches to the new chain and stops discovering the targets that
+ * are no longer used. If the chain cannot be compiled the current one is kept.
+ */
+func (ced *ConfigEntryDiscoverer) rebuild() {
+	ced.rebuildMu.Lock()
+	defer ced.rebuildMu.Unlock()
+
+	ced.entriesMu.Lock()
+	compiler := &chainCompiler{
+		resolvers:  ced.entries[consul.ServiceResolver],
+		splitters:  ced.entries[consul.ServiceSplitter],
+		routers:    ced.entries[consul.ServiceRouter],
+		datacenter: ced.service.Datacenter,
+		targets:    make(map[string]*chainTarget),
+	}
+	chain, err := compiler.compile(ced.service.ServiceName)
+	ced.entriesMu.Unlock()
+
+	if err != nil {
+		log.Printf("Ignoring the invalid config entries for service %s - %s", ced.service.ServiceName, err)
+		ced.chainMu.Lock()
+		current := ced.chain
+		ced.chainMu.Unlock()
+		if current != nil {
+			return
+		}
+
+		// without a chain to fall back on, discover the service itself
+		compiler.targets = make(map[string]*chainTarget)
+		chain = compiler.plainChain(ced.service.ServiceName)
+	}
+
+	ced.chainMu.Lock()
+	existing := ced.targets
+	ced.chainMu.Unlock()
+
+	targets := make(map[string]Discoverer, len(chain.targets))
+	var started []Discoverer
+	for _, target := range chain.targets {
+		key := target.discoveryKey()
+		discoverer, ok := existing[key]
+		if !ok {
+			discoverer = ced.newTarget(target)
+			started = append(started, discoverer)
+		}
+		target.discoverer = discoverer
+		targets[key] = discoverer
+	}
+
+	ced.chainMu.Lock()
+	select {
+	case <-ced.stopping.done():
+		ced.chainMu.Unlock()
+		return
+	default:
+	}
+	for _, discoverer := range started {
+		ced.starting[discoverer] = true
+	}
+	ced.chainMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, discoverer := range started {
+		wg.Add(1)
+		go func(discoverer Discoverer) {
+			defer wg.Done()
+			discoverer.start()
+
+			ced.chainMu.Lock()
+			delete(ced.starting, discoverer)
+			ced.chainMu.Unlock()
+		}(discoverer)
+	}
+	allStarted := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allStarted)
+	}()
+
+	// the targets that have not started by the timeout carry on starting in the background,
+	// and are failed over from until they have endpoints
+	timeout := time.NewTimer(ced.startTimeout)
+	defer timeout.Stop()
+	select {
+	case <-allStarted:
+	case <-timeout.C:
+		log.Printf("Not every target of service %s has started within %s, switching to the new chain anyway", ced.service.ServiceName, ced.startTimeout)
+	case <-ced.stopping.done():
+	}
+
+	ced.chainMu.Lock()
+	ced.chain = chain
+	ced.targets = targets
+	ced.chainMu.Unlock()
+
+	// stopped while the new targets were starting
+	select {
+	case <-ced.stopping.done():
+		for _, discoverer := range targets {
+			discoverer.stop()
+		}
+		return
+	default:
+	}
+
+	for key, discoverer := range existing {
+		if _, ok := targets[key]; !ok {
+			discoverer.stop()
+		}
+	}
+
+	log.Printf("Discovering service %s through %s", ced.service.ServiceName, chain)
+}
+
+func (ced *ConfigEntryDiscoverer) currentChain() *discoveryChain {
+	ced.chainMu.Lock()
+	defer ced.chainMu.Unlock()
+	return ced.chain
+}
+
+/**
+ * The endpoints that connections, and requests not matching a route, are sent to
+ */
+func (ced *ConfigEntryDiscoverer) getEndpoints() []*Endpoint {
+	chain := ced.currentChain()
+	if chain == nil {
+		return nil
+	}
+	return chain.destination.getEndpoints()
+}
+
+/**
+ * The destination the request is routed to by the service-router, and the path
+ * it is sent with once any prefix rewrite is applied
+ */
+func (ced *ConfigEntryDiscoverer) routeRequest(request *http.Request) (Discoverer, string) {
+	chain := ced.currentChain()
+	if chain == nil {
+		return ced, request.URL.Path
+	}
+
+	for _, route := range chain.routes {
+		if route.matches(request) {
+			return route.destination, route.rewrite(request.URL.Path)
+		}
+	}
+	return chain.destination, request.URL.Path
+}
+
+func (ced *ConfigEntryDiscoverer) name() string {
+	return ced.service.ServiceName
+}
+
+/**
+ * Stops watching the config entries, and discovering the targets
+ */
+func (ced *ConfigEntryDiscoverer) stop() {
+	ced.stopping.stop()
+
+	ced.chainMu.Lock()
+	defer ced.chainMu.Unlock()
+	for _, discoverer := range ced.targets {
+		discoverer.stop()
+	}
+	for discoverer := range ced.starting {
+		discoverer.stop()
+	}
+}
+
+func (chain *discoveryChain) String() string {
+	var routes []string
+	for _, route := range chain.routes {
+		routes = append(routes, route.destination.String())
+	}
+	if len(routes) == 0 {
+		return chain.destination.String()
+	}
+	return fmt.Sprintf("%s, with routes to %s", chain.destination, strings.Join(routes, ", "))
+}
+
+/**
+ * The endpoints of every split, weighted by its share of the traffic. Each split uses
+ * its first target with endpoints, so that traffic fails over in order.
+ */
+func (cd *chainDestination) getEndpoints() []*Endpoint {
+	var weights []int
+	var splitEndpoints [][]*Endpoint
+	for _, s := range cd.splits {
+		var endpoints []*Endpoint
+		for _, target := range s.targets {
+			if endpoints = target.discoverer.getEndpoints(); len(endpoints) != 0 {
+				break
+			}
+		}
+
+		// the weights are percentages with up to two decimal places
+		weights = append(weights, int(s.weight*100+0.5))
+		splitEndpoints = append(splitEndpoints, endpoints)
+	}
+
+	if len(splitEndpoints) == 1 {
+		return splitEndpoints[0]
+	}
+	return weightEndpoints(weights, splitEndpoints)
+}
+
+func (cd *chainDestination) String() string {
+	var splits []string
+	for _, s := range cd.splits {
+		var targets []string
+		for _, target := range s.targets {
+			targets = append(targets, target.key())
+		}
+		splits = append(splits, fmt.Sprintf("%s (%g%%)", strings.Join(targets, " failing over to "), s.weight))
+	}
+	return strings.Join(splits, ", ")
+}
+
+// the targets are discovered by the ConfigEntryDiscoverer
+func (cd *chainDestination) start() {
+}
+
+func (cd *chainDestination) stop() {
+}
+
+func (cd *chainDestination) name() string {
+	return cd.serviceName
+}
+
+/**
+ * True if the request meets all of the conditions of the route's match
+ */
+func (route *chainRoute) matches(request *http.Request) bool {
+	match := route.match
+	if match == nil {
+		return true
+	}
+
+	path := request.URL.Path
+	if match.PathExact != "" && path != match.PathExact {
+		return false
+	}
+	if match.PathPrefix != "" && !strings.HasPrefix(path, match.PathPrefix) {
+		return false
+	}
+	if match.PathRegex != "" && !route.regexps[match.PathRegex].MatchString(path) {
+		return false
+	}
+
+	for _, header := range match.Header {
+		values, present := request.Header[http.CanonicalHeaderKey(header.Name)]
+		value := strings.Join(values, ",")
+
+		var matched bool
+		switch {
+		case header.Exact != "":
+			matched = present && value == header.Exact
+		case header.Prefix != "":
+			matched = present && strings.HasPrefix(value, header.Prefix)
+		case header.Suffix != "":
+			matched = present && strings.HasSuffix(value, header.Suffix)
+		case header.Regex != "":
+			matched = present && route.regexps[header.Regex].MatchString(value)
+		default:
+			matched = present
+		}
+
+		if matched == header.Invert {
+			return false
+		}
+	}
+
+	query := request.URL.Query()
+	for _, param := range match.QueryParam {
+		values, present := query[param.Name]
+		if !present {
+			return false
+		}
+		if param.Exact != "" && values[0] != param.Exact {
+			return false
+		}
+		if param.Regex != "" && !route.regexps[param.Regex].MatchString(values[0]) {
+			return false
+		}
+	}
+
+	if len(match.Methods) != 0 {
+		allowed := false
+		for _, method := range match.Methods {
+			if strings.EqualFold(method, request.Method) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * Replaces the matched path prefix with the route's prefix rewrite, if it has one
+ */
+func (route *chainRoute) rewrite(path string) string {
+	if route.prefixRewrite == "" || route.match == nil {
+		return path
+	}
+
+	prefix := route.match.PathPrefix
+	if route.match.PathExact != "" {
+		prefix = route.match.PathExact
+	}
+	if prefix == "" {
+		return path
+	}
+	return route.prefixRewrite + strings.TrimPrefix(path, prefix)
+}
+
+/**
+ * Compiles a discovery chain from the config entries
+ */
+type chainCompiler struct {
+	resolvers map[string]consul.ConfigEntry
+	splitters map[string]consul.ConfigEntry
+	routers   map[string]consul.ConfigEntry
+
+	// the datacenter of the proxied service
+	datacenter string
+
+	// the targets of the chain by key
+	targets map[string]*chainTarget
+}
+
+/**
+ * Compiles the chain of the service, i.e. its router, then the splitter, then the
+ * resolver of the services it routes and splits to
+ */
+func (c *chainCompiler) compile(serviceName string) (*discoveryChain, error) {
+	chain := &discoveryChain{targets: c.targets}
+
+	if entry, ok := c.routers[serviceName]; ok {
+		router, ok := entry.(*consul.ServiceRouterConfigEntry)
+		if !ok {
+			return nil, fmt.Errorf("unexpected service-router entry %T", entry)
+		}
+
+		for _, route := range router.Routes {
+			compiled, err := c.route(serviceName, route)
+			if err != nil {
+				return nil, err
+			}
+			chain.routes = append(chain.routes, compiled)
+		}
+	}
+
+	destination, err := c.destination(serviceName, "")
+	if err != nil {
+		return nil, err
+	}
+	chain.destination = destination
+	return chain, nil
+}
+
+/**
+ * A chain that discovers the service itself, ignoring the config entries
+ */
+func (c *chainCompiler) plainChain(serviceName string) *discoveryChain {
+	target := &chainTarget{service: serviceName, datacenter: c.datacenter}
+	c.targets[target.key()] = target
+
+	return &discoveryChain{
+		destination: &chainDestination{
+			serviceName: serviceName,
+			splits:      []*chainSplit{{weight: 100, targets: []*chainTarget{target}}},
+		},
+		targets: c.targets,
+	}
+}
+
+func (c *chainCompiler) route(serviceName string, route consul.ServiceRoute) (*chainRoute, error) {
+	compiled := &chainRoute{regexps: make(map[string]*regexp.Regexp)}
+
+	if route.Match != nil && route.Match.HTTP != nil {
+		match := route.Match.HTTP
+		compiled.match = match
+
+		expressions := []string{match.PathRegex}
+		for _, header := range match.Header {
+			expressions = append(expressions, header.Regex)
+		}
+		for _, param := range match.QueryParam {
+			expressions = append(expressions, param.Regex)
+		}
+		for _, expression := range expressions {
+			if expression == "" {
+				continue
+			}
+			// the mesh matches the whole value, not just part of it
+			compiledRegexp, err := regexp.Compile("^(?:" + expression + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex in the routes of service %s - %s", serviceName, err)
+			}
+			compiled.regexps[expression] = compiledRegexp
+		}
+	}
+
+	destinationService, subset := serviceName, ""
+	if route.Destination != nil {
+		if route.Destination.Service != "" {
+			destinationService = route.Destination.Service
+		}
+		subset = route.Destination.ServiceSubset
+		compiled.prefixRewrite = route.Destination.PrefixRewrite
+	}
+
+	destination, err := c.destination(destinationService, subset)
+	if err != nil {
+		return nil, err
+	}
+	compiled.destination = destination
+	return compiled, nil
+}
+
+/**
+ * The destination of traffic sent to the service, split by its service-splitter
+ * unless a subset is asked for
+ */
+func (c *chainCompiler) destination(serviceName string, subset string) (*chainDestination, error) {
+	splits, err := c.split(serviceName, subset, 100, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &chainDestination{serviceName: serviceName, splits: splits}, nil
+}
+
+/**
+ * Splits the share of the traffic sent to the service between the splits of its
+ * service-splitter, following the splitters of any other services it splits to
+ */
+func (c *chainCompiler) split(serviceName string, subset string, weight float64, depth int) ([]*chainSplit, error) {
+	if depth > maxChainDepth {
+		return nil, fmt.Errorf("the splitters of service %s split to each other in a loop", serviceName)
+	}
+
+	entry, ok := c.splitters[serviceName]
+	if subset != "" || !ok {
+		targets, err := c.resolve(serviceName, subset, c.datacenter, 0)
+		if err != nil {
+			return nil, err
+		}
+		return []*chainSplit{{weight: weight, targets: targets}}, nil
+	}
+
+	splitter, ok := entry.(*consul.ServiceSplitterConfigEntry)
+	if !ok {
+		return nil, fmt.Errorf("unexpected service-splitter entry %T", entry)
+	}
+
+	var splits []*chainSplit
+	for _, s := range splitter.Splits {
+		if s.Weight <= 0 {
+			continue
+		}
+
+		splitWeight := weight * float64(s.Weight) / 100
+		if s.Service == "" || s.Service == serviceName {
+			targets, err := c.resolve(serviceName, s.ServiceSubset, c.datacenter, 0)
+			if err != nil {
+				return nil, err
+			}
+			splits = append(splits, &chainSplit{weight: splitWeight, targets: targets})
+			continue
+		}
+
+		nested, err := c.split(s.Service, s.ServiceSubset, splitWeight, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		splits = append(splits, nested...)
+	}
+
+	if len(splits) == 0 {
+		return nil, fmt.Errorf("the service-splitter of service %s has no splits with a weight", serviceName)
+	}
+	return splits, nil
+}
+
+/**
+ * The targets of the subset of the service, in failover order, following the
+ * redirect of its service-resolver
+ */
+func (c *chainCompiler) resolve(serviceName string, subset string, datacenter string, depth int) ([]*chainTarget, error) {
+	if depth > maxChainDepth {
+		return nil, fmt.Errorf("the resolvers of service %s redirect to each other in a loop", serviceName)
+	}
+
+	resolver, err := c.resolver(serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if resolver != nil && resolver.Redirect != nil {
+		redirect := resolver.Redirect
+		redirectService, redirectDatacenter := serviceName, datacenter
+		if redirect.Service != "" {
+			redirectService = redirect.Service
+		}
+		if redirect.Datacenter != "" {
+			redirectDatacenter = redirect.Datacenter
+		}
+		return c.resolve(redirectService, redirect.ServiceSubset, redirectDatacenter, depth+1)
+	}
+
+	primary, err := c.target(serviceName, subset, datacenter)
+	if err != nil {
+		return nil, err
+	}
+	targets := []*chainTarget{primary}
+
+	if resolver == nil {
+		return targets, nil
+	}
+
+	failover, ok := resolver.Failover[primary.subset]
+	if !ok {
+		failover, ok = resolver.Failover["*"]
+	}
+	if !ok {
+		return targets, nil
+	}
+
+	failoverService, failoverSubset := serviceName, failover.ServiceSubset
+	if failover.Service != "" {
+		failoverService = failover.Service
+	}
+	if failoverSubset == "" && failoverService == serviceName {
+		failoverSubset = primary.subset
+	}
+
+	datacenters := failover.Datacenters
+	if len(datacenters) == 0 {
+		datacenters = []string{datacenter}
+	}
+
+	for _, failoverDatacenter := range datacenters {
+		target, err := c.target(failoverService, failoverSubset, failoverDatacenter)
+		if err != nil {
+			return nil, err
+		}
+		if target.key() != primary.key() {
+			targets = append(targets, target)
+		}
+	}
+	return targets, nil
+}
+
+/**
+ * The target for the subset of the service, defaulting to the default subset
+ * of its service-resolver
+ */
+func (c *chainCompiler) target(serviceName string, subset string, datacenter string) (*chainTarget, error) {
+	resolver, err := c.resolver(serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	target := &chainTarget{service: serviceName, datacenter: datacenter}
+	if subset == "" && resolver != nil {
+		subset = resolver.DefaultSubset
+	}
+
+	if subset != "" {
+		if resolver == nil {
+			return nil, fmt.Errorf("service %s has no service-resolver defining subset '%s'", serviceName, subset)
+		}
+		definition, ok := resolver.Subsets[subset]
+		if !ok {
+			return nil, fmt.Errorf("the service-resolver of service %s has no subset '%s'", serviceName, subset)
+		}
+		target.subset = subset
+		target.filter = definition.Filter
+	}
+
+	if existing, ok := c.targets[target.key()]; ok {
+		return existing, nil
+	}
+	c.targets[target.key()] = target
+	return target, nil
+}
+
+/**
+ * The service-resolver of the service, nil if it has none
+ */
+func (c *chainCompiler) resolver(serviceName string) (*consul.ServiceResolverConfigEntry, error) {
+	entry, ok := c.resolvers[serviceName]
+	if !ok {
+		return nil, nil
+	}
+
+	resolver, ok := entry.(*consul.ServiceResolverConfigEntry)
+	if !ok {
+		return nil, fmt.Errorf("unexpected service-resolver entry %T", entry)
+	}
+	return resolver, nil
+}
+
+func consulConfigEntryLookup(consulAddress string, kind string, waitIndex uint64) ([]consul.ConfigEntry, uint64, error) {
+	config := consul.DefaultConfig()
+	config.Address = consulAddress
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	options := &consul.QueryOptions{
+		WaitIndex: waitIndex,
+		WaitTime:  consulKvWaitTime,
+	}
+
+	entries, meta, err := client.ConfigEntries().List(kind, options)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, meta.LastIndex, nil
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+/**
+ * The endpoints of a target, which can be changed by the test
+ */
+type stubTargetDiscoverer struct {
+	key       string
+	endpoints []*Endpoint
+	stopped   bool
+	mu        sync.Mutex
+
+	// whether start blocks until stopped, as for a target that cannot be reached
+	blocking bool
+	stopping stopper
+}
+
+func (d *stubTargetDiscoverer) start() {
+	if d.blocking {
+		<-d.stopping.done()
+	}
+}
+
+func (d *stubTargetDiscoverer) getEndpoints() []*Endpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.endpoints
+}
+
+func (d *stubTargetDiscoverer) name() string {
+	return d.key
+}
+
+func (d *stubTargetDiscoverer) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = true
+	d.stopping.stop()
+}
+
+/**
+ * A discoverer of the orders service reading the given entries, whose targets have the
+ * endpoints given by target key. Targets without endpoints have none.
+ */
+func newTestConfigEntryDiscoverer(t *testing.T, entries []consul.ConfigEntry, endpoints map[string][]string) (*ConfigEntryDiscoverer, map[string]*stubTargetDiscoverer) {
+	ced, err := NewConfigEntryDiscoverer(&ProxiedService{ServiceName: "orders"}, &ConsulServerConfig{Address: "consul:8500"})
+	assertNil(t, err)
+
+	ced.consulConfigEntries = func(consulAddress string, kind string, waitIndex uint64) ([]consul.ConfigEntry, uint64, error) {
+		if waitIndex != 0 {
+			<-ced.stopping.done()
+			return nil, waitIndex, nil
+		}
+
+		var ofKind []consul.ConfigEntry
+		for _, entry := range entries {
+			if entry.GetKind() == kind {
+				ofKind = append(ofKind, entry)
+			}
+		}
+		return ofKind, 1, nil
+	}
+
+	targets := make(map[string]*stubTargetDiscoverer)
+	ced.newTarget = func(target *chainTarget) Discoverer {
+		discoverer := &stubTargetDiscoverer{key: target.key()}
+		for _, address := range endpoints[target.key()] {
+			endpoint, err := parseEndpoint(address)
+			assertNil(t, err)
+			discoverer.endpoints = append(discoverer.endpoints, endpoint)
+		}
+		targets[target.key()] = discoverer
+		return discoverer
+	}
+	return ced, targets
+}
+
+func TestConfigEntryDiscoverer_NoEntries(t *testing.T) {
+	ced, _ := newTestConfigEntryDiscoverer(t, nil, map[string][]string{
+		"orders": {"10.0.0.1:80"},
+	})
+	ced.start()
+	defer ced.stop()
+
+	endpoints := ced.getEndpoints()
+	assertEqual(t, 1, len(endpoints), "endpoints")
+	assertEqual(t, "10.0.0.1:80", endpoints[0].String(), "the service itself")
+}
+
+func TestConfigEntryDiscoverer_ResolverSubsetAndFailover(t *testing.T) {
+	ced, targets := newTestConfigEntryDiscoverer(t, []consul.ConfigEntry{
+		&consul.ServiceResolverConfigEntry{
+			Kind:          consul.ServiceResolver,
+			Name:          "orders",
+			DefaultSubset: "v1",
+			Subsets: map[string]consul.ServiceResolverSubset{
+				"v1": {Filter: "Service.Meta.version == v1"},
+				"v2": {Filter: "Service.Meta.version == v2"},
+			},
+			Failover: map[string]consul.ServiceResolverFailover{
+				"*": {Datacenters: []string{"dc2", "dc3"}},
+			},
+		},
+	}, map[string][]string{
+		"v1.orders":     {"10.0.0.1:80"},
+		"v1.orders/dc2": {"10.0.2.1:80"},
+	})
+	ced.start()
+	defer ced.stop()
+
+	chain := ced.currentChain()
+	assertEqual(t, "Service.Meta.version == v1", chain.targets["v1.orders"].filter, "subset filter")
+	assertEqual(t, 3, len(chain.targets), "primary and failover targets")
+
+	endpoints := ced.getEndpoints()
+	assertEqual(t, 1, len(endpoints), "endpoints")
+	assertEqual(t, "10.0.0.1:80", endpoints[0].String(), "default subset")
+
+	targets["v1.orders"].mu.Lock()
+	targets["v1.orders"].endpoints = nil
+	targets["v1.orders"].mu.Unlock()
+
+	endpoints = ced.getEndpoints()
+	assertEqual(t, 1, len(endpoints), "endpoints")
+	assertEqual(t, "10.0.2.1:80", endpoints[0].String(), "failed over to the next datacenter")
+}
+
+func TestConfigEntryDiscoverer_Redirect(t *testing.T) {
+	ced, _ := newTestConfigEntryDiscoverer(t, []consul.ConfigEntry{
+		&consul.ServiceResolverConfigEntry{
+			Kind:     consul.ServiceResolver,
+			Name:     "orders",
+			Redirect: &consul.ServiceResolverRedirect{Service: "orders-v2", Datacenter: "dc2"},
+		},
+	}, map[string][]string{
+		"orders":        {"10.0.0.1:80"},
+		"orders-v2/dc2": {"10.0.2.1:80"},
+	})
+	ced.start()
+	defer ced.stop()
+
+	endpoints := ced.getEndpoints()
+	assertEqual(t, 1, len(endpoints), "endpoints")
+	assertEqual(t, "10.0.2.1:80", endpoints[0].String(), "redirected service")
+}
+
+func TestConfigEntryDiscoverer_Splitter(t *testing.T) {
+	ced, _ := newTestConfigEntryDiscoverer(t, []consul.ConfigEntry{
+		&consul.ServiceSplitterConfigEntry{
+			Kind: consul.ServiceSplitter,
+			Name: "orders",
+			Splits: []consul.ServiceSplit{
+				{Weight: 90, ServiceSubset: "v1"},
+				{Weight: 10, Service: "orders-canary"},
+			},
+		},
+		&consul.ServiceResolverConfigEntry{
+			Kind:    consul.ServiceResolver,
+			Name:    "orders",
+			Subsets: map[string]consul.ServiceResolverSubset{"v1": {Filter: "Service.Meta.version == v1"}},
+		},
+	}, map[string][]string{
+		"v1.orders":     {"10.0.0.1:80", "10.0.0.2:80"},
+		"orders-canary": {"10.0.1.1:80"},
+	})
+	ced.start()
+	defer ced.stop()
+
+	weights := make(map[string]uint16)
+	for _, endpoint := range ced.getEndpoints() {
+		weights[endpoint.String()] = endpoint.weight
+	}
+	assertEqual(t, 3, len(weights), "endpoints of both splits")
+	assertEqual(t, uint16(27000), weights["10.0.0.1:80"], "weight of v1 endpoint")
+	assertEqual(t, uint16(6000), weights["10.0.1.1:80"], "weight of canary endpoint")
+}
+
+func TestConfigEntryDiscoverer_InvalidEntries(t *testing.T) {
+	ced, _ := newTestConfigEntryDiscoverer(t, []consul.ConfigEntry{
+		&consul.ServiceSplitterConfigEntry{
+			Kind:   consul.ServiceSplitter,
+			Name:   "orders",
+			Splits: []consul.ServiceSplit{{Weight: 100, ServiceSubset: "missing"}},
+		},
+	}, map[string][]string{
+		"orders": {"10.0.0.1:80"},
+	})
+	ced.start()
+	defer ced.stop()
+
+	endpoints := ced.getEndpoints()
+	assertEqual(t, 1, len(endpoints), "endpoints")
+	assertEqual(t, "10.0.0.1:80", endpoints[0].String(), "the service itself")
+}
+
+func TestChainCompiler_RedirectLoop(t *testing.T) {
+	compiler := &chainCompiler{
+		resolvers: map[string]consul.ConfigEntry{
+			"orders":   &consul.ServiceResolverConfigEntry{Name: "orders", Redirect: &consul.ServiceResolverRedirect{Service: "payments"}},
+			"payments": &consul.ServiceResolverConfigEntry{Name: "payments", Redirect: &consul.ServiceResolverRedirect{Service: "orders"}},
+		},
+		targets: make(map[string]*chainTarget),
+	}
+
+	_, err := compiler.compile("orders")
+	assertNotNil(t, err)
+}
+
+func TestConfigEntryDiscoverer_Rebuild(t *testing.T) {
+	ced, targets := newTestConfigEntryDiscoverer(t, []consul.ConfigEntry{
+		&consul.ServiceResolverConfigEntry{
+			Kind:     consul.ServiceResolver,
+			Name:     "orders",
+			Redirect: &consul.ServiceResolverRedirect{Service: "orders-v2"},
+		},
+	}, map[string][]string{
+		"orders":    {"10.0.0.1:80"},
+		"orders-v2": {"10.0.2.1:80"},
+	})
+	ced.start()
+	defer ced.stop()
+
+	// the redirect is removed
+	ced.entriesMu.Lock()
+	ced.entries[consul.ServiceResolver] = nil
+	ced.entriesMu.Unlock()
+	ced.rebuild()
+
+	endpoints := ced.getEndpoints()
+	assertEqual(t, "10.0.0.1:80", endpoints[0].String(), "the service itself")
+	assertEqual(t, true, targets["orders-v2"].stopped, "unused target stopped")
+}
+
+func TestConfigEntryDiscoverer_RebuildChangedFilter(t *testing.T) {
+	resolver := func(filter string) consul.ConfigEntry {
+		return &consul.ServiceResolverConfigEntry{
+			Kind:          consul.ServiceResolver,
+			Name:          "orders",
+			DefaultSubset: "v1",
+			Subsets:       map[string]consul.ServiceResolverSubset{"v1": {Filter: filter}},
+		}
+	}
+	ced, _ := newTestConfigEntryDiscoverer(t, []consul.ConfigEntry{resolver("Service.Meta.version == v1")}, nil)
+
+	var created []*stubTargetDiscoverer
+	ced.newTarget = func(target *chainTarget) Discoverer {
+		address := "10.0.0.1:80"
+		if target.filter == "Service.Meta.version == v1.1" {
+			address = "10.0.0.2:80"
+		}
+		endpoint, err := parseEndpoint(address)
+		assertNil(t, err)
+		discoverer := &stubTargetDiscoverer{key: target.key(), endpoints: []*Endpoint{endpoint}}
+		created = append(created, discoverer)
+		return discoverer
+	}
+	ced.start()
+	defer ced.stop()
+	assertEqual(t, "10.0.0.1:80", ced.getEndpoints()[0].String(), "the subset matching the filter")
+
+	// the filter of the subset is changed
+	ced.entriesMu.Lock()
+	ced.entries[consul.ServiceResolver] = map[string]consul.ConfigEntry{"orders": resolver("Service.Meta.version == v1.1")}
+	ced.entriesMu.Unlock()
+	ced.rebuild()
+
+	assertEqual(t, 2, len(created), "target discovered again")
+	assertEqual(t, "10.0.0.2:80", ced.getEndpoints()[0].String(), "the subset matching the new filter")
+	assertEqual(t, true, created[0].stopped, "target with the old filter stopped")
+}
+
+func TestChainRoute_matches(t *testing.T) {
+	compiler := &chainCompiler{targets: make(map[string]*chainTarget)}
+	route, err := compiler.route("orders", consul.ServiceRoute{
+		Match: &consul.ServiceRouteMatch{HTTP: &consul.ServiceRouteHTTPMatch{
+			PathPrefix: "/admin/",
+			Header: []consul.ServiceRouteHTTPMatchHeader{
+				{Name: "x-debug", Invert: true, Present: true},
+				{Name: "x-user", Regex: "^admin-[0-9]+$"},
+			},
+			QueryParam: []consul.ServiceRouteHTTPMatchQueryParam{{Name: "verbose", Exact: "true"}},
+			Methods:    []string{"GET"},
+		}},
+		Destination: &consul.ServiceRouteDestination{Service: "admin", PrefixRewrite: "/"},
+	})
+	assertNil(t, err)
+
+	request := httptest.NewRequest("GET", "/admin/users?verbose=true", nil)
+	request.Header.Set("X-User", "admin-42")
+	assertEqual(t, true, route.matches(request), "all conditions met")
+	assertEqual(t, "/users", route.rewrite(request.URL.Path), "prefix rewritten")
+
+	request.Header.Set("X-Debug", "1")
+	assertEqual(t, false, route.matches(request), "inverted header present")
+	request.Header.Del("X-Debug")
+
+	request.Method = "POST"
+	assertEqual(t, false, route.matches(request), "method not matched")
+	request.Method = "GET"
+
+	request.Header.Set("X-User", "guest")
+	assertEqual(t, false, route.matches(request), "header regex not matched")
+}
+
+func TestHttpProxy_ServiceRouter(t *testing.T) {
+	var connections int32
+	orders := startHttpBackend("orders", &connections)
+	defer orders.Close()
+	admin := startHttpBackend("admin", &connections)
+	defer admin.Close()
+
+	ced, _ := newTestConfigEntryDiscoverer(t, []consul.ConfigEntry{
+		&consul.ServiceRouterConfigEntry{
+			Kind: consul.ServiceRouter,
+			Name: "orders",
+			Routes: []consul.ServiceRoute{{
+				Match:       &consul.ServiceRouteMatch{HTTP: &consul.ServiceRouteHTTPMatch{PathPrefix: "/admin/"}},
+				Destination: &consul.ServiceRouteDestination{Service: "admin", PrefixRewrite: "/"},
+			}},
+		},
+	}, map[string][]string{
+		"orders": {orders.Listener.Addr().String()},
+		"admin":  {admin.Listener.Addr().String()},
+	})
+
+	proxyPort := getFreePort()
+	service := &ProxiedService{
+		ServiceName:   "orders",
+		LocalIP:       "127.0.0.1",
+		LocalPort:     proxyPort,
+		Protocol:      ProtocolHttp,
+		ConfigEntries: true,
+	}
+	proxy, err := NewProxy(service, ced, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	defer proxy.stop()
+	time.Sleep(200 * time.Millisecond)
+
+	proxyUrl := "http://127.0.0.1:" + strconv.Itoa(proxyPort)
+	response, body := get(t, http.DefaultClient, proxyUrl+"/admin/users", nil)
+	assertEqual(t, http.StatusOK, response.StatusCode, "status")
+	assertEqual(t, "admin:/users", body, "routed by the service-router with the prefix rewritten")
+
+	response, body = get(t, http.DefaultClient, proxyUrl+"/orders/1", nil)
+	assertEqual(t, http.StatusOK, response.StatusCode, "status")
+	assertEqual(t, "orders:/orders/1", body, "unmatched requests go to the service")
+}
+
+/**
+ * A failover target that never starts does not stop the proxy from starting, and is
+ * stopped along with the discoverer
+ */
+func TestConfigEntryDiscoverer_TargetNeverStarts(t *testing.T) {
+	ced, targets := newTestConfigEntryDiscoverer(t, []consul.ConfigEntry{
+		&consul.ServiceResolverConfigEntry{
+			Kind:     consul.ServiceResolver,
+			Name:     "orders",
+			Failover: map[string]consul.ServiceResolverFailover{"*": {Datacenters: []string{"unreachable"}}},
+		},
+	}, map[string][]string{
+		"orders": {"10.0.0.1:80"},
+	})
+	newTarget := ced.newTarget
+	ced.newTarget = func(target *chainTarget) Discoverer {
+		discoverer := newTarget(target).(*stubTargetDiscoverer)
+		discoverer.blocking = target.datacenter == "unreachable"
+		return discoverer
+	}
+	ced.startTimeout = 100 * time.Millisecond
+
+	started := make(chan struct{})
+	go func() {
+		ced.start()
+		close(started)
+	}()
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("start blocked on the unreachable target")
+	}
+	assertEqual(t, "10.0.0.1:80", ced.getEndpoints()[0].String(), "primary target used")
+
+	ced.stop()
+	unreachable := targets["orders/unreachable"]
+	unreachable.mu.Lock()
+	defer unreachable.mu.Unlock()
+	assertEqual(t, true, unreachable.stopped, "starting target stopped")
+}
+
+func TestConfigEntryDiscoverer_StoppedWhileStarting(t *testing.T) {
+	ced, targets := newTestConfigEntryDiscoverer(t, nil, nil)
+	newTarget := ced.newTarget
+	ced.newTarget = func(target *chainTarget) Discoverer {
+		discoverer := newTarget(target).(*stubTargetDiscoverer)
+		discoverer.blocking = true
+		return discoverer
+	}
+
+	started := make(chan struct{})
+	go func() {
+		ced.start()
+		close(started)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ced.stop()
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("start did not return once stopped")
+	}
+	targets["orders"].mu.Lock()
+	defer targets["orders"].mu.Unlock()
+	assertEqual(t, true, targets["orders"].stopped, "starting target stopped")
+}
+
+func TestChainRoute_matches_WholeValue(t *testing.T) {
+	compiler := &chainCompiler{targets: make(map[string]*chainTarget)}
+	route, err := compiler.route("orders", consul.ServiceRoute{
+		Match: &consul.ServiceRouteMatch{HTTP: &consul.ServiceRouteHTTPMatch{
+			PathRegex: "/api/v[0-9]+",
+			Header:    []consul.ServiceRouteHTTPMatchHeader{{Name: "x-version", Regex: "v1|v2"}},
+		}},
+	})
+	assertNil(t, err)
+
+	request := httptest.NewRequest("GET", "/api/v1", nil)
+	request.Header.Set("X-Version", "v2")
+	assertEqual(t, true, route.matches(request), "whole path and header matched")
+
+	request.URL.Path = "/x/api/v1/y"
+	assertEqual(t, false, route.matches(request), "path regex matches the whole path")
+
+	request.URL.Path = "/api/v1"
+	request.Header.Set("X-Version", "v22")
+	assertEqual(t, false, route.matches(request), "header regex matches the whole value")
+}
+
+func TestNewDiscoverer_ConfigEntriesAddressChecks(t *testing.T) {
+	_, err := NewDiscoverer(&ProxiedService{ServiceName: "orders", ConfigEntries: true, AddressFamily: "ipv5"}, &ConsulServerConfig{})
+	assertNotNil(t, err)
+
+	_, err = NewDiscoverer(&ProxiedService{ServiceName: "orders", ConfigEntries: true, AddressPolicy: "nearest"}, &ConsulServerConfig{})
+	assertNotNil(t, err)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/**
+ * This file contains the logic for persisting the last known endpoints of a service
+ * to disk, so that they can be served if the proxy restarts while consul is unreachable.
+ */
+
+/**
+ * The on-disk representation of a cached endpoint
+ */
+type cachedEndpoint struct {
+	Host string
+	Port int
+
+	// the SRV priority and weight, when discovered using DNS
+	Priority uint16
+	Weight   uint16
+}
+
+/**
+ * The on-disk representation of the last successful lookup of a service
+ */
+type cachedEndpoints struct {
+	ServiceName string
+	Datacenter  string
+
+	// the consul index the endpoints were discovered at
+	Index uint64
+
+	// when the endpoints were discovered
+	Updated time.Time
+
+	Endpoints []*cachedEndpoint
+}
+
+func (ce *cachedEndpoints) endpoints() []*Endpoint {
+	endpoints := make([]*Endpoint, len(ce.Endpoints))
+	for i, ep := range ce.Endpoints {
+		endpoints[i] = &Endpoint{
+			host:     ep.Host,
+			port:     ep.Port,
+			priority: ep.Priority,
+			weight:   ep.Weight,
+		}
+	}
+	return endpoints
+}
+
+/**
+ * Reads and writes the cache file for a single service
+ */
+type EndpointCache struct {
+	serviceName string
+	datacenter  string
+
+	// the cache file
+	path string
+}
+
+/**
+ * dir - the directory cache files are stored in
+ * serviceName, datacenter - the service being cached, used to derive the file name
+ * settings - the other settings of the lookup, e.g. its filter, so that lookups of the
+ *   same service with different settings have their own files. Hashed into the file name
+ */
+func NewEndpointCache(dir string, serviceName string, datacenter string, settings string) *EndpointCache {
+	name := serviceName
+	if datacenter != "" {
+		name = name + "." + datacenter
+	}
+	if settings != "" {
+		hash := fnv.New32a()
+		hash.Write([]byte(settings))
+		name = fmt.Sprintf("%s.%08x", name, hash.Sum32())
+	}
+	name = strings.Replace(name, string(os.PathSeparator), "_", -1)
+
+	return &EndpointCache{
+		serviceName: serviceName,
+		datacenter:  datacenter,
+		path:        filepath.Join(dir, name+".json"),
+	}
+}
+
+/**
+ * Persists the endpoints. The file is written to a temporary file then renamed
+ * so that a crash mid-write never leaves a truncated cache behind.
+ */
+func (c *EndpointCache) write(endpoints []*Endpoint, index uint64, updated time.Time) error {
+	cached := &cachedEndpoints{
+		ServiceName: c.serviceName,
+		Datacenter:  c.datacenter,
+		Index:       index,
+		Updated:     updated,
+		Endpoints:   make([]*cachedEndpoint, len(endpoints)),
+	}
+	for i, ep := range endpoints {
+		cached.Endpoints[i] = &cachedEndpoint{
+			Host:     ep.host,
+			Port:     ep.port,
+			Priority: ep.priority,
+			Weight:   ep.weight,
+		}
+	}
+
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path)
+}
+
+/**
+ * Reads the persisted endpoints. Returns an error satisfying os.IsNotExist
+ * if nothing has been cached yet.
+ */
+func (c *EndpointCache) read() (*cachedEndpoints, error) {
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cached cachedEndpoints
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, err
+	}
+	return &cached, nil
+}
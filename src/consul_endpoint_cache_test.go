@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEndpointCache_WriteRead(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-cache")
+	defer os.RemoveAll(dir)
+
+	cache := NewEndpointCache(dir, "my-service", "dc1", "")
+	updated := time.Now().Round(time.Second)
+
+	err := cache.write([]*Endpoint{{host: "1.2.3.4", port: 1234}, {host: "5.6.7.8", port: 5678}}, 99, updated)
+	assertNil(t, err)
+
+	cached, err := cache.read()
+	assertNil(t, err)
+	assertEqual(t, filepath.Join(dir, "my-service.dc1.json"), cache.path, "path")
+	assertEqual(t, "my-service", cached.ServiceName, "ServiceName")
+	assertEqual(t, "dc1", cached.Datacenter, "Datacenter")
+	assertEqual(t, uint64(99), cached.Index, "Index")
+	assertEqual(t, true, updated.Equal(cached.Updated), "Updated")
+
+	endpoints := cached.endpoints()
+	assertEqual(t, 2, len(endpoints), "len(endpoints)")
+	assertEqual(t, "1.2.3.4:1234", endpoints[0].String(), "endpoints[0]")
+	assertEqual(t, "5.6.7.8:5678", endpoints[1].String(), "endpoints[1]")
+}
+
+func TestEndpointCache_PriorityAndWeight(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-cache")
+	defer os.RemoveAll(dir)
+
+	cache := NewEndpointCache(dir, "my-service", "", "")
+	err := cache.write([]*Endpoint{{host: "1.2.3.4", port: 1234, priority: 10, weight: 60}}, 1, time.Now())
+	assertNil(t, err)
+
+	cached, err := cache.read()
+	assertNil(t, err)
+	endpoints := cached.endpoints()
+	assertEqual(t, uint16(10), endpoints[0].priority, "priority")
+	assertEqual(t, uint16(60), endpoints[0].weight, "weight")
+}
+
+func TestEndpointCache_Settings(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-cache")
+	defer os.RemoveAll(dir)
+
+	plain := NewEndpointCache(dir, "my-service", "dc1", "")
+	node := NewEndpointCache(dir, "my-service", "dc1", "address-policy=node")
+	wan := NewEndpointCache(dir, "my-service", "dc1", "address-policy=wan")
+
+	assertEqual(t, false, plain.path == node.path, "settings change the file")
+	assertEqual(t, false, node.path == wan.path, "each settings have their own file")
+	assertEqual(t, node.path, NewEndpointCache(dir, "my-service", "dc1", "address-policy=node").path, "same settings share the file")
+}
+
+func TestEndpointCache_ReadMissing(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-cache")
+	defer os.RemoveAll(dir)
+
+	_, err := NewEndpointCache(dir, "my-service", "", "").read()
+	assertEqual(t, true, os.IsNotExist(err), "IsNotExist")
+}
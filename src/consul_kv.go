@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+/**
+ * This file contains the access to the consul KV store
+ */
+
+// Abstracts reading a key from the consul KV store. When 'waitIndex' is non-zero
+// this is a blocking query, which returns once the key changes from that index or
+// the wait time elapses. Returns a nil value if the key does not exist, along with
+// the consul index of the result.
+type ConsulKvLookup func(
+	/* consulAddress */ string,
+	/* key           */ string,
+	/* waitIndex     */ uint64) ([]byte, uint64, error)
+
+// how long a blocking KV query waits for the key to change
+const consulKvWaitTime = 5 * time.Minute
+
+func consulKvLookup(consulAddress string, key string, waitIndex uint64) ([]byte, uint64, error) {
+	config := consul.DefaultConfig()
+	config.Address = consulAddress
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	options := &consul.QueryOptions{
+		WaitIndex: waitIndex,
+		WaitTime:  consulKvWaitTime,
+	}
+
+	pair, meta, err := client.KV().Get(key, options)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if pair == nil {
+		return nil, meta.LastIndex, nil
+	}
+	return pair.Value, meta.LastIndex, nil
+}
+
+// Abstracts listing the keys under a prefix in the consul KV store, which is a
+// blocking query when 'waitIndex' is non-zero. Returns the keys in order, along
+// with the consul index of the result.
+type ConsulKvListLookup func(
+	/* consulAddress */ string,
+	/* prefix        */ string,
+	/* waitIndex     */ uint64) (consul.KVPairs, uint64, error)
+
+func consulKvListLookup(consulAddress string, prefix string, waitIndex uint64) (consul.KVPairs, uint64, error) {
+	config := consul.DefaultConfig()
+	config.Address = consulAddress
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	options := &consul.QueryOptions{
+		WaitIndex: waitIndex,
+		WaitTime:  consulKvWaitTime,
+	}
+
+	pairs, meta, err := client.KV().List(prefix, options)
+	if err != nil {
+		return nil, 0, err
+	}
+	return pairs, meta.LastIndex, nil
+}
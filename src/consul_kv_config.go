@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+/**
+ * Reads the configuration from a consul KV key, so that a fleet of proxies can be
+ * configured centrally, and watches the key for changes using blocking queries.
+ *
+ * A key ending in '/' is a prefix, and the configuration in every key under it is
+ * combined: the proxies and SNI listeners of every key are used, and the other settings
+ * are taken from the first key, in key order, that specifies them.
+ *
+ * The consul server the configuration is read from is specified on the command line,
+ * and the command line args are applied over every version of the configuration read.
+ */
+type KvConfigSource struct {
+	// the key or prefix the configuration is read from
+	key string
+
+	// the command line args applied over the configuration
+	args *CliArgs
+
+	// the consul server the configuration is read from
+	consulServer *ConsulServerConfig
+
+	// the consul index of the configuration last read
+	index uint64
+
+	dnsSrv       DnsSrvLookup
+	consulKv     ConsulKvLookup
+	consulKvList ConsulKvListLookup
+
+	// how long to wait before retrying a failed read of the configuration
+	retryInterval time.Duration
+}
+
+func NewKvConfigSource(args *CliArgs) (*KvConfigSource, error) {
+	bootstrap, err := applyCommandLine(new(ConsulProxyConfig), args)
+	if err != nil {
+		return nil, err
+	}
+
+	if bootstrap.ConsulServer.DnsName == "" && bootstrap.ConsulServer.Address == "" {
+		return nil, errors.New("Unable to find the consul server to read the configuration from. Please either specify -consul-server-override or -consul-dns-name")
+	}
+
+	return &KvConfigSource{
+		key:           args.configKvKey,
+		args:          args,
+		consulServer:  bootstrap.ConsulServer,
+		dnsSrv:        dnsSrvLookup,
+		consulKv:      consulKvLookup,
+		consulKvList:  consulKvListLookup,
+		retryInterval: 10 * time.Second,
+	}, nil
+}
+
+/**
+ * Reads the configuration, blocking until it changes from 'waitIndex' if that is non-zero.
+ * Returns the configuration as stored, before the command line args are applied, and
+ * the consul index it was read at.
+ */
+func (src *KvConfigSource) read(waitIndex uint64) (*ConsulProxyConfig, uint64, error) {
+	server, err := findConsulServer(src.consulServer, src.dnsSrv)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !strings.HasSuffix(src.key, "/") {
+		value, index, err := src.consulKv(server, src.key, waitIndex)
+		if err != nil {
+			return nil, 0, err
+		}
+		if value == nil {
+			return nil, index, fmt.Errorf("the key %s does not exist", src.key)
+		}
+
+		config, err := unmarshalConfig(value)
+		if err != nil {
+			return nil, index, fmt.Errorf("invalid configuration in key %s - %s", src.key, err)
+		}
+		return config, index, nil
+	}
+
+	pairs, index, err := src.consulKvList(server, src.key, waitIndex)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	combined := new(ConsulProxyConfig)
+	found := false
+	for _, pair := range pairs {
+		if strings.HasSuffix(pair.Key, "/") || len(pair.Value) == 0 {
+			continue
+		}
+
+		config, err := unmarshalConfig(pair.Value)
+		if err != nil {
+			return nil, index, fmt.Errorf("invalid configuration in key %s - %s", pair.Key, err)
+		}
+		found = true
+
+		if combined.ConsulServer == nil {
+			combined.ConsulServer = config.ConsulServer
+		}
+		if combined.StatusAddress == "" {
+			combined.StatusAddress = config.StatusAddress
+		}
+		if combined.MaxConnections == 0 {
+			combined.MaxConnections = config.MaxConnections
+		}
+		combined.Proxies = append(combined.Proxies, config.Proxies...)
+		combined.SniListeners = append(combined.SniListeners, config.SniListeners...)
+		combined.AutoProxies = append(combined.AutoProxies, config.AutoProxies...)
+	}
+
+	if !found {
+		return nil, index, fmt.Errorf("there are no keys under %s", src.key)
+	}
+	return combined, index, nil
+}
+
+/**
+ * Reads the configuration each time it changes, applying the command line args over
+ * it and passing the result to 'apply'. Invalid configurations are logged and ignored.
+ * Loops indefinately.
+ */
+func (src *KvConfigSource) watch(apply func(*ConsulProxyConfig) error) {
+	for {
+		config, index, err := src.read(src.index)
+
+		// the index going backwards means the KV store was reset
+		if index < src.index {
+			index = 0
+		}
+
+		if err != nil {
+			log.Printf("Unable to read the configuration from consul key %s - %s", src.key, err)
+
+			// unless the configuration was read but is invalid, in which case it is
+			// not read again until it changes
+			if index == 0 || index == src.index {
+				time.Sleep(src.retryInterval)
+			}
+			if index != 0 {
+				src.index = index
+			}
+			continue
+		}
+
+		if index == src.index {
+			// the blocking query timed out without any change
+			continue
+		}
+		src.index = index
+
+		config, err = applyCommandLine(config, src.args)
+		if err != nil {
+			log.Printf("Ignoring the configuration in consul key %s - %s", src.key, err)
+			continue
+		}
+
+		log.Println("The configuration in consul key", src.key, "changed", config)
+		if err := apply(config); err != nil {
+			log.Println("Unable to apply the configuration -", err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func newTestKvConfigSource(t *testing.T, key string) *KvConfigSource {
+	source, err := NewKvConfigSource(&CliArgs{
+		configKvKey:          key,
+		consulServerOverride: "consul:8500",
+		cacheDir:             "/var/cache/consul-proxy",
+	})
+	assertNil(t, err)
+	return source
+}
+
+func TestNewKvConfigSource_RequiresConsulServer(t *testing.T) {
+	_, err := NewKvConfigSource(&CliArgs{configKvKey: "consul-proxy/config"})
+	assertNotNil(t, err)
+}
+
+func TestKvConfigSource_readKey(t *testing.T) {
+	source := newTestKvConfigSource(t, "consul-proxy/config")
+	source.consulKv = func(consulAddress string, key string, waitIndex uint64) ([]byte, uint64, error) {
+		assertEqual(t, "consul:8500", consulAddress, "consul address from the command line")
+		assertEqual(t, "consul-proxy/config", key, "key")
+		return []byte(`{"Proxies": [{"ServiceName": "orders", "LocalPort": 9090}]}`), 7, nil
+	}
+
+	config, index, err := source.read(0)
+	assertNil(t, err)
+	assertEqual(t, uint64(7), index, "index")
+	assertEqual(t, "orders", config.Proxies[0].ServiceName, "proxy")
+
+	source.consulKv = func(consulAddress string, key string, waitIndex uint64) ([]byte, uint64, error) {
+		return nil, 8, nil
+	}
+	_, _, err = source.read(0)
+	assertNotNil(t, err)
+}
+
+func TestKvConfigSource_readPrefix(t *testing.T) {
+	source := newTestKvConfigSource(t, "consul-proxy/")
+	source.consulKvList = func(consulAddress string, prefix string, waitIndex uint64) (consul.KVPairs, uint64, error) {
+		assertEqual(t, "consul-proxy/", prefix, "prefix")
+		return consul.KVPairs{
+			{Key: "consul-proxy/"},
+			{Key: "consul-proxy/orders", Value: []byte(`{"ConsulServer": {"Address": "a:8500"}, "Proxies": [{"ServiceName": "orders"}]}`)},
+			{Key: "consul-proxy/payments", Value: []byte(`{"ConsulServer": {"Address": "b:8500"}, "StatusAddress": ":8080", "Proxies": [{"ServiceName": "payments"}]}`)},
+			{Key: "consul-proxy/sni", Value: []byte(`{"SniListeners": [{"LocalPort": 8443}]}`)},
+		}, 3, nil
+	}
+
+	config, _, err := source.read(0)
+	assertNil(t, err)
+	assertEqual(t, 2, len(config.Proxies), "proxies combined")
+	assertEqual(t, 1, len(config.SniListeners), "listeners combined")
+	assertEqual(t, "a:8500", config.ConsulServer.Address, "first consul server")
+	assertEqual(t, ":8080", config.StatusAddress, "first status address")
+}
+
+func TestKvConfigSource_watch(t *testing.T) {
+	source := newTestKvConfigSource(t, "consul-proxy/config")
+	source.index = 1
+	source.retryInterval = time.Millisecond
+
+	values := make(chan string)
+	source.consulKv = func(consulAddress string, key string, waitIndex uint64) ([]byte, uint64, error) {
+		value := <-values
+		if value == "error" {
+			return nil, 0, errors.New("consul is down")
+		}
+		return []byte(value), waitIndex + 1, nil
+	}
+
+	applied := make(chan *ConsulProxyConfig, 10)
+	go source.watch(func(config *ConsulProxyConfig) error {
+		applied <- config
+		return nil
+	})
+
+	values <- "error"
+	values <- "not json"
+	values <- `{"ConsulServer": {"Address": "a:8500"}, "Proxies": [{"ServiceName": "orders"}]}`
+
+	config := <-applied
+	assertEqual(t, "orders", config.Proxies[0].ServiceName, "proxy")
+	assertEqual(t, "consul:8500", config.ConsulServer.Address, "command line overrides the config")
+	assertEqual(t, "/var/cache/consul-proxy", config.ConsulServer.CacheDir, "command line overrides the config")
+	assertEqual(t, 0, len(applied), "invalid configurations are not applied")
+}
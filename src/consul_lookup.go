@@ -8,8 +8,17 @@ import (
 	"log"
 	"time"
 	"sync"
+	"os"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"errors"
+	"strings"
 )
 
+// the status of every lookup, keyed by service name, datacenter and settings
+var lookupStatus = expvar.NewMap("lookups")
+
 /**
  * This file contains the data types and logic involved in discovering a consul service
  */
@@ -20,24 +29,91 @@ import (
 type Endpoint struct {
 	host string
 	port int
+
+	// the SRV priority and weight of the endpoint, when discovered
+	// using DNS. Zero otherwise.
+	priority uint16
+	weight   uint16
 }
 
 func (ep *Endpoint) String() string {
-	return (ep.host + ":" + strconv.Itoa(ep.port))
+	return net.JoinHostPort(ep.host, strconv.Itoa(ep.port))
+}
+
+/**
+ * Chooses an endpoint as described by RFC 2782, i.e. from the endpoints with
+ * the lowest priority, randomly in proportion to their weights. When none of those
+ * endpoints have a weight, they are chosen between uniformly.
+ *
+ * Returns nil if there are no endpoints.
+ */
+func selectEndpoint(endpoints []*Endpoint) *Endpoint {
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	var candidates []*Endpoint
+	totalWeight := 0
+	for _, ep := range endpoints {
+		if len(candidates) == 0 || ep.priority < candidates[0].priority {
+			candidates = []*Endpoint{ep}
+			totalWeight = int(ep.weight)
+		} else if ep.priority == candidates[0].priority {
+			candidates = append(candidates, ep)
+			totalWeight += int(ep.weight)
+		}
+	}
+
+	if totalWeight == 0 {
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	n := rand.Intn(totalWeight)
+	for _, ep := range candidates {
+		n -= int(ep.weight)
+		if n < 0 {
+			return ep
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+/**
+ * Parses an endpoint in the host:port format
+ */
+func parseEndpoint(address string) (*Endpoint, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in endpoint %s", address)
+	}
+
+	return &Endpoint{host: host, port: port}, nil
 }
 
 // Abstracts the dns srv lookup used to discover the consul server
 type DnsSrvLookup func(
-	/* dnsSever */ string,
-	/* dnsPort  */ string,
-	/* name     */ string) (string, error)
+	/* dnsConfig */ *DnsClientConfig,
+	/* name      */ string) (string, error)
 
 // Abstracts the invocation of the consul ReST API
-// to lookup a service by its name
+// to find the datacenter of the consul agent
+type ConsulDatacenterLookup func(
+	/* consulAddress */ string) (string, error)
+
+// Abstracts the invocation of the consul ReST API
+// to lookup a service by its name, optionally filtering the instances
+// with a consul filter expression. Also returns the consul index
+// of the result.
 type ConsulRestLookup func(
 	/* consulAddress */ string,
 	/* serviceName   */ string,
-    /* datacenter    */ string) ([]*consul.ServiceEntry, error)
+    /* datacenter    */ string,
+	/* filter        */ string) ([]*consul.ServiceEntry, uint64, error)
 
 /**
  * Contains the dynamically updating endpoints associated with the provides
@@ -47,22 +123,56 @@ type ConsulLookup struct {
 	// the name of the service associated with this lookup instance
 	serviceName  string
 
+	// only instances of the service with this tag are discovered, if not empty
+	tag          string
+
+	// only instances matching this consul filter expression are discovered, if not empty
+	filter       string
+
+	// the service-resolver subset the filter belongs to, used to name the lookup
+	subset       string
+
 	// the datacenter the service should be looked up in
 	datacenter string
 
 	// the consul server that ReST API calls are made against
 	consulServer *ConsulServerConfig
 
-	// the current set of endpoints associated with the service
+	// the current set of endpoints associated with the service, when
+	// they were last successfully discovered, the consul index they were
+	// discovered at, and whether they are stale (i.e. the latest lookup failed)
 	// must be accessed under endpointsMu
 	endpoints    []*Endpoint
+	updated      time.Time
+	index        uint64
+	stale        bool
 	endpointsMu  sync.Mutex
 
+	// persists the last known endpoints, nil if caching is disabled
+	cache        *EndpointCache
+
+	// the maximum age of endpoints that will be served when consul
+	// is unreachable, zero means no limit
+	maxStale     time.Duration
+
 	dnsSrv       DnsSrvLookup
 	consulRest   ConsulRestLookup
+	consulDc     ConsulDatacenterLookup
 
 	// How often to poll consul for the service addresses
 	pollIntervalSec time.Duration
+
+	// the preferred address family, 'ipv4' or 'ipv6', when a service advertises
+	// both using tagged addresses. Empty to use the service address.
+	addressFamily string
+
+	// which of the addresses of a service instance is used, see AddressPolicy
+	addressPolicy string
+
+	// the datacenter of the consul agent, found when the 'auto' address policy is used
+	localDatacenter string
+
+	stopping stopper
 }
 
 /**
@@ -70,46 +180,242 @@ type ConsulLookup struct {
  * consulServer - the config used to lookup the consul server to make ReST requests to
  */
 func NewConsulLookup(serviceName string, datacenter string, consulServer *ConsulServerConfig) *ConsulLookup {
-	return &ConsulLookup{
+	return NewConsulTagLookup(serviceName, "", datacenter, consulServer)
+}
+
+/**
+ * Discovers only the instances of the service that have the tag, e.g. a canary subset
+ */
+func NewConsulTagLookup(serviceName string, tag string, datacenter string, consulServer *ConsulServerConfig) *ConsulLookup {
+	lookup := &ConsulLookup{
 		serviceName: serviceName,
+		tag: tag,
 		datacenter: datacenter,
 		consulServer: consulServer,
 		pollIntervalSec: 30,
 		dnsSrv: dnsSrvLookup,
 		consulRest: consulRestLookup,
+		consulDc: consulDatacenterLookup,
+		maxStale: time.Duration(consulServer.CacheMaxStaleSec) * time.Second,
 	}
+
+	return lookup
 }
 
 /**
  * Starts the lookup process that periodically discovers the configured
  * services in consul, so that new TCP connections can be established
  * using an up to data backend.
+ *
+ * The service is looked up straight away, rather than after the first poll
+ * interval, and then every poll interval until stopped. Blocks until the first
+ * successful lookup, cached endpoints are loaded, or the lookup is stopped.
  */
 func (cl *ConsulLookup) start() {
+	// the settings of the lookup are final once it is started
+	if cl.consulServer.CacheDir != "" {
+		cl.cache = NewEndpointCache(cl.consulServer.CacheDir, cl.qualifiedName(), cl.datacenter, cl.settings())
+	}
+	lookupStatus.Set(cl.statusKey(), expvar.Func(cl.status))
+
 	var closed = false
 	done := make(chan struct{})
-	go func() {
-		for range time.NewTicker(cl.pollIntervalSec * time.Second).C {
-			endpoints, err := cl.lookup()
-			if err != nil {
-				log.Printf("Error discovering service %s - %s", cl.serviceName, err)
-				continue
-			}
 
-			log.Printf("Discovered services %s", endpoints)
+	// serve the cached endpoints until consul can be reached
+	if cl.loadCache() {
+		close(done)
+		closed = true
+	}
 
-			if !closed {
+	go func() {
+		ticker := time.NewTicker(cl.pollIntervalSec * time.Second)
+		defer ticker.Stop()
+		for {
+			if cl.refresh() && !closed {
 				close(done)
 				closed = true
 			}
 
-			cl.endpointsMu.Lock()
-			cl.endpoints = endpoints
-			cl.endpointsMu.Unlock()
+			select {
+			case <-ticker.C:
+			case <-cl.stopping.done():
+				return
+			}
 		}
 	}()
 
-	<-done
+	select {
+	case <-done:
+	case <-cl.stopping.done():
+	}
+}
+
+/**
+ * Stops polling consul, and removes the lookup from the status output
+ */
+func (cl *ConsulLookup) stop() {
+	cl.stopping.stop()
+	lookupStatus.Delete(cl.statusKey())
+}
+
+/**
+ * Looks up the service, and updates the endpoints. Returns true if the lookup succeeded.
+ */
+func (cl *ConsulLookup) refresh() bool {
+	endpoints, index, err := cl.lookup()
+	if err != nil {
+		log.Printf("Error discovering service %s - %s", cl.serviceName, err)
+		cl.markStale()
+		return false
+	}
+
+	log.Printf("Discovered services %s", endpoints)
+
+	now := time.Now()
+	cl.endpointsMu.Lock()
+	cl.endpoints = endpoints
+	cl.updated = now
+	cl.index = index
+	cl.stale = false
+	cl.endpointsMu.Unlock()
+
+	if cl.cache != nil {
+		if err := cl.cache.write(endpoints, index, now); err != nil {
+			log.Printf("Failed to write endpoint cache for service %s - %s", cl.serviceName, err)
+		}
+	}
+	return true
+}
+
+/**
+ * Seeds the endpoints from the cache file, provided they are within the
+ * staleness limit. Returns true if endpoints were loaded.
+ */
+func (cl *ConsulLookup) loadCache() bool {
+	if cl.cache == nil {
+		return false
+	}
+
+	cached, err := cl.cache.read()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read endpoint cache for service %s - %s", cl.serviceName, err)
+		}
+		return false
+	}
+
+	age := time.Since(cached.Updated)
+	if cl.maxStale > 0 && age > cl.maxStale {
+		log.Printf("Ignoring cached endpoints for service %s, they are %s old", cl.serviceName, age)
+		return false
+	}
+
+	log.Printf("Serving stale cached endpoints for service %s from %s (%s old) %s", cl.serviceName, cl.cache.path, age, cached.endpoints())
+
+	cl.endpointsMu.Lock()
+	cl.endpoints = cached.endpoints()
+	cl.updated = cached.Updated
+	cl.index = cached.Index
+	cl.stale = true
+	cl.endpointsMu.Unlock()
+	return true
+}
+
+/**
+ * Called when consul cannot be reached. The last known endpoints continue to be
+ * served until they exceed the staleness limit, after which they are discarded.
+ */
+func (cl *ConsulLookup) markStale() {
+	cl.endpointsMu.Lock()
+	defer cl.endpointsMu.Unlock()
+
+	if len(cl.endpoints) == 0 {
+		return
+	}
+
+	cl.stale = true
+	age := time.Since(cl.updated)
+	if cl.maxStale > 0 && age > cl.maxStale {
+		log.Printf("Discarding endpoints for service %s, they are %s old which exceeds the limit of %s", cl.serviceName, age, cl.maxStale)
+		cl.endpoints = nil
+		return
+	}
+
+	log.Printf("Serving stale endpoints for service %s (%s old)", cl.serviceName, age)
+}
+
+/**
+ * The service name, prefixed with the tag or subset in the style of consul DNS names when
+ * only some instances are discovered, e.g. canary.orders
+ */
+func (cl *ConsulLookup) qualifiedName() string {
+	if cl.tag != "" {
+		return cl.tag + "." + cl.serviceName
+	}
+	if cl.subset != "" {
+		return cl.subset + "." + cl.serviceName
+	}
+	return cl.serviceName
+}
+
+/**
+ * The settings of the lookup, other than the service, tag and datacenter, that change
+ * which endpoints it discovers. Empty when they are the defaults.
+ */
+func (cl *ConsulLookup) settings() string {
+	var settings []string
+	if cl.filter != "" {
+		settings = append(settings, "filter="+cl.filter)
+	}
+	if cl.addressPolicy != "" {
+		settings = append(settings, "address-policy="+cl.addressPolicy)
+	}
+	if cl.addressFamily != "" {
+		settings = append(settings, "address-family="+cl.addressFamily)
+	}
+	return strings.Join(settings, "&")
+}
+
+/**
+ * The key this lookup is published under in the status output, which differs between
+ * lookups of the same service with different settings
+ */
+func (cl *ConsulLookup) statusKey() string {
+	key := cl.qualifiedName()
+	if cl.datacenter != "" {
+		key = key + "/" + cl.datacenter
+	}
+	if settings := cl.settings(); settings != "" {
+		key = key + "?" + settings
+	}
+	return key
+}
+
+/**
+ * Reports the state of the discovered endpoints, published via expvar
+ */
+func (cl *ConsulLookup) status() interface{} {
+	cl.endpointsMu.Lock()
+	defer cl.endpointsMu.Unlock()
+
+	endpoints := make([]string, len(cl.endpoints))
+	for i, ep := range cl.endpoints {
+		endpoints[i] = ep.String()
+	}
+
+	return map[string]interface{}{
+		"endpoints": endpoints,
+		"updated":   cl.updated,
+		"index":     cl.index,
+		"stale":     cl.stale,
+	}
+}
+
+/**
+ * The name of the consul service being looked up, qualified by its tag or subset
+ */
+func (cl *ConsulLookup) name() string {
+	return cl.qualifiedName()
 }
 
 /**
@@ -127,49 +433,170 @@ func (cl *ConsulLookup) getEndpoints() []*Endpoint {
  * Performs a consul lookup based on the provided config, which is used to find the consul server,
  * then finds all healthy instances of the named service using the consul ReST API.
  */
-func (cl *ConsulLookup) lookup() ([]*Endpoint, error) {
+func (cl *ConsulLookup) lookup() ([]*Endpoint, uint64, error) {
 
 	server, err := cl.getConsulServer()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	services, err := cl.consulRest(server, cl.serviceName, cl.datacenter)
+	services, index, err := cl.consulRest(server, cl.serviceName, cl.datacenter, cl.filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if cl.tag != "" {
+		services = servicesWithTag(services, cl.tag)
+	}
+
+	tag, err := cl.addressTag(server)
+	if err != nil {
+		return nil, 0, err
+	}
 
 	endpoints := make([]*Endpoint, len(services))
 	for i, s := range services {
-		endpoints[i] = &Endpoint {
-			host: s.Service.Address,
-			port: s.Service.Port,
+		endpoints[i] = serviceEndpoint(s, tag)
+	}
+	return endpoints, index, nil
+}
+
+/**
+ * The service instances that have the tag
+ */
+func servicesWithTag(services []*consul.ServiceEntry, tag string) []*consul.ServiceEntry {
+	var tagged []*consul.ServiceEntry
+	for _, s := range services {
+		if hasTag(s.Service.Tags, tag) {
+			tagged = append(tagged, s)
+		}
+	}
+	return tagged
+}
+
+/**
+ * True if the tag is one of the tags
+ */
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * The tagged address used for the service instances, based on the address policy
+ * and preferred address family. Empty if the service address should be used.
+ */
+func (cl *ConsulLookup) addressTag(server string) (string, error) {
+	tag := cl.addressPolicy
+	switch tag {
+	case "", AddressPolicyService:
+		if cl.addressFamily == "" {
+			return "", nil
 		}
+		tag = AddressPolicyLan
+	case AddressPolicyNode:
+		return AddressPolicyNode, nil
+	case AddressPolicyAuto:
+		wan, err := cl.isRemoteDatacenter(server)
+		if err != nil {
+			return "", err
+		}
+
+		tag = AddressPolicyLan
+		if wan {
+			tag = AddressPolicyWan
+		}
+	}
+
+	if (tag == AddressPolicyLan || tag == AddressPolicyWan) && cl.addressFamily != "" {
+		tag = tag + "_" + cl.addressFamily
+	}
+	return tag, nil
+}
+
+/**
+ * True if the service is being looked up in a datacenter other than the one
+ * the consul agent is in.
+ */
+func (cl *ConsulLookup) isRemoteDatacenter(server string) (bool, error) {
+	if cl.datacenter == "" {
+		return false, nil
+	}
+
+	if cl.localDatacenter == "" {
+		dc, err := cl.consulDc(server)
+		if err != nil {
+			return false, err
+		}
+		log.Printf("Consul server %s is in datacenter %s", server, dc)
+		cl.localDatacenter = dc
 	}
-	return endpoints, nil
+
+	return cl.localDatacenter != cl.datacenter, nil
+}
+
+/**
+ * The endpoint of a service instance.
+ *
+ * tag - the tagged address to use, checking the tagged addresses of the service then,
+ *       if the service registered without an address, the node. If empty, or the instance
+ *       has no such tagged address, the service address is used. 'node' uses the node address.
+ *
+ * The node address is used whenever the selected address is empty, as it is when a
+ * service registers without an address.
+ */
+func serviceEndpoint(s *consul.ServiceEntry, tag string) *Endpoint {
+	endpoint := &Endpoint {
+		host: s.Service.Address,
+		port: s.Service.Port,
+	}
+
+	if tagged, ok := s.Service.TaggedAddresses[tag]; ok && tagged.Address != "" {
+		endpoint.host = tagged.Address
+		if tagged.Port != 0 {
+			endpoint.port = tagged.Port
+		}
+	} else if s.Service.Address == "" && s.Node != nil && s.Node.TaggedAddresses[tag] != "" {
+		endpoint.host = s.Node.TaggedAddresses[tag]
+	}
+
+	if (endpoint.host == "" || tag == AddressPolicyNode) && s.Node != nil {
+		endpoint.host = s.Node.Address
+	}
+	return endpoint
+}
+
+/**
+ * Finds the consul servers hostname/port, see findConsulServer
+ */
+func (cl *ConsulLookup) getConsulServer() (string, error) {
+	return findConsulServer(cl.consulServer, cl.dnsSrv)
 }
 
 /**
  * Finds the consul servers hostname/port.
  *
  * 1. If the 'Address' config is provided, it is simply used as is.
- * 2. Otherwise an SRV record is looked up using the DNS server defined by DnsServer  and DnsPort
- *    configurations. The default DnsServer=localhost default DnsPort=53
+ * 2. Otherwise an SRV record is looked up using the DNS servers defined by the DnsServer(s), DnsPort
+ *    and ResolvConf configurations. The default DnsServer=localhost default DnsPort=53
  */
-func (cl *ConsulLookup) getConsulServer() (string, error) {
-	if cl.consulServer.Address != "" {
-		return cl.consulServer.Address, nil
+func findConsulServer(consulServer *ConsulServerConfig, dnsSrv DnsSrvLookup) (string, error) {
+	if consulServer.Address != "" {
+		return consulServer.Address, nil
 	} else {
-		dnsServer := cl.consulServer.DnsServer
-		if dnsServer == "" {
-			dnsServer = "localhost"
-		}
-
-		dnsPort := cl.consulServer.DnsPort
-		if dnsPort == "" {
-			dnsPort = "53"
+		dnsConfig, err := dnsClientConfig(consulServer)
+		if err != nil {
+			log.Printf("Failed to read the DNS configuration: %s", err)
+			return "", err
 		}
 
-		log.Printf("Looking SRV record for %s using %s", cl.consulServer.DnsName, dnsServer + ":" + dnsPort)
+		log.Printf("Looking SRV record for %s using %s (port %s)", consulServer.DnsName, dnsConfig.Servers, dnsConfig.Port)
 
-		address, err := cl.dnsSrv(dnsServer, dnsPort, cl.consulServer.DnsName)
+		address, err := dnsSrv(dnsConfig, consulServer.DnsName)
 		if err != nil {
 			log.Printf("Failed to execute DNS SRV lookup: %s", err)
 			return "", err
@@ -180,7 +607,82 @@ func (cl *ConsulLookup) getConsulServer() (string, error) {
 	}
 }
 
-func consulRestLookup(consulAddress string, serviceName string, datacenter string) ([]*consul.ServiceEntry, error) {
+/**
+ * The client config used to query the DNS servers specified in the consul server config.
+ *
+ * If 'ResolvConf' is specified the servers, search domains, timeout and attempts are read
+ * from it, otherwise the default DnsServer=localhost default DnsPort=53. Any of the other
+ * settings that are specified override those read from the file.
+ */
+func dnsClientConfig(consulServer *ConsulServerConfig) (*DnsClientConfig, error) {
+	config := &dns.ClientConfig {
+		Servers: []string { "localhost" },
+		Port: "53",
+		Ndots: 1,
+		Timeout: 5,
+		Attempts: 2,
+	}
+
+	recursionDesired := false
+	if consulServer.ResolvConf != "" {
+		resolvConf, err := dns.ClientConfigFromFile(consulServer.ResolvConf)
+		if err != nil {
+			return nil, err
+		}
+		config = resolvConf
+		recursionDesired = true
+	}
+
+	// servers that are given explicitly are consul's DNS interface
+	if len(consulServer.DnsServers) != 0 {
+		config.Servers = consulServer.DnsServers
+		recursionDesired = false
+	} else if consulServer.DnsServer != "" {
+		config.Servers = []string { consulServer.DnsServer }
+		recursionDesired = false
+	}
+
+	if consulServer.DnsPort != "" {
+		config.Port = consulServer.DnsPort
+	}
+
+	if consulServer.DnsTimeoutSec != 0 {
+		config.Timeout = consulServer.DnsTimeoutSec
+	}
+
+	if consulServer.DnsAttempts != 0 {
+		config.Attempts = consulServer.DnsAttempts
+	}
+
+	if len(config.Servers) == 0 {
+		return nil, errors.New("no DNS servers are configured")
+	}
+
+	return &DnsClientConfig{ClientConfig: config, recursionDesired: recursionDesired}, nil
+}
+
+func consulDatacenterLookup(consulAddress string) (string, error) {
+	config := consul.DefaultConfig()
+	config.Address = consulAddress
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return "", err
+	}
+
+	self, err := client.Agent().Self()
+	if err != nil {
+		return "", err
+	}
+
+	dc, _ := self["Config"]["Datacenter"].(string)
+	if dc == "" {
+		return "", errors.New("the consul agent did not report its datacenter")
+	}
+	return dc, nil
+}
+
+func consulRestLookup(consulAddress string, serviceName string, datacenter string, filter string) ([]*consul.ServiceEntry, uint64, error) {
 	config := consul.DefaultConfig()
 	config.Address = consulAddress
 
@@ -188,61 +690,31 @@ func consulRestLookup(consulAddress string, serviceName string, datacenter strin
 
 	client, err := consul.NewClient(config)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	options := &consul.QueryOptions{
 		Datacenter: datacenter,
+		Filter: filter,
 	}
 
-	services, _, err := client.Health().Service(serviceName, "", true, options)
+	services, meta, err := client.Health().Service(serviceName, "", true, options)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	return services, nil
+	return services, meta.LastIndex, nil
 }
 
-func dnsSrvLookup(dnsServer string, dnsPort string, name string) (string, error) {
-
-	clientConfig := &dns.ClientConfig {
-		Servers: []string { dnsServer },
-		Port: dnsPort,
-	}
+func dnsSrvLookup(clientConfig *DnsClientConfig, name string) (string, error) {
 	results, err := lookupSrv(name, clientConfig)
 	if err != nil {
 		return "", err
 	}
 
+	if len(results) == 0 {
+		return "", fmt.Errorf("no SRV records found for %s", name)
+	}
+
 	return results[0], nil
 }
-
-/**
- * Looks up the specified domain name using an SRV DNS query to the server(s) specified
- * in the client config.
- *
- * Returns all DNS answers in a host:port format
- */
-func lookupSrv(address string, config *dns.ClientConfig) ([]string, error) {
-	query := new(dns.Msg)
-	query.SetQuestion(dns.Fqdn(address), dns.TypeSRV)
-	query.RecursionDesired = false
-	client := new(dns.Client)
-	resp, _, err := client.Exchange(query, net.JoinHostPort(config.Servers[0], config.Port))
-	if err != nil {
-		return nil, err
-	}
-	if len(resp.Answer) == 0 {
-		return []string{}, nil
-	}
-	var addrs []string
-	for i, record := range resp.Answer {
-		port := strconv.Itoa(int(record.(*dns.SRV).Port))
-		ip := record.(*dns.SRV).Target
-		if len(resp.Extra) >= i + 1 {
-			ip = resp.Extra[i].(*dns.A).A.String()
-		}
-		addrs = append(addrs, net.JoinHostPort(ip, port))
-	}
-	return addrs, nil
-}
\ No newline at end of file
@@ -6,6 +6,9 @@ import (
 	consul "github.com/hashicorp/consul/api"
 	"time"
 	"strconv"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
 )
 
 func TestConsulLookup_getConsulServer_OverrideAddress(t *testing.T) {
@@ -50,7 +53,7 @@ func TestConsulLookup_getConsulServer_UsingMockDnsServerForServerLookup(t *testi
 	result, err := lookup.getConsulServer()
 
 	assertNil(t, err)
-	assertEqual(t, "1.1.1.1.:8899", result, "ConsulServer")
+	assertEqual(t, "1.1.1.1:8899", result, "ConsulServer")
 }
 
 func TestConsulLookup_getConsulServer_SrvLookup_Error(t *testing.T) {
@@ -77,7 +80,7 @@ func TestConsulLookup_lookup(t *testing.T) {
 	}
 	lookup.consulRest = stubConsulRestLookup([]*consul.ServiceEntry{entry}, nil)
 
-	endpoints, err := lookup.lookup()
+	endpoints, _, err := lookup.lookup()
 
 	assertNil(t, err)
 	assertEqual(t, len(endpoints), 1, "len(endpoints)")
@@ -85,6 +88,156 @@ func TestConsulLookup_lookup(t *testing.T) {
 	assertEqual(t, endpoints[0].port, 1234, "endpoint port")
 }
 
+func TestConsulLookup_lookup_Tag(t *testing.T) {
+	config := &ConsulServerConfig {
+		Address: "this.is.an.override.address",
+	}
+	lookup := NewConsulTagLookup("test-service-name", "canary", "dc1", config)
+
+	stable := &consul.ServiceEntry{Service: &consul.AgentService{Address: "10.0.0.1", Port: 80, Tags: []string{"v1"}}}
+	canary := &consul.ServiceEntry{Service: &consul.AgentService{Address: "10.0.0.2", Port: 80, Tags: []string{"v2", "canary"}}}
+	lookup.consulRest = stubConsulRestLookup([]*consul.ServiceEntry{stable, canary}, nil)
+
+	endpoints, _, err := lookup.lookup()
+	assertNil(t, err)
+	assertEqual(t, 1, len(endpoints), "only tagged instances")
+	assertEqual(t, "10.0.0.2:80", endpoints[0].String(), "tagged instance")
+	assertEqual(t, "canary.test-service-name/dc1", lookup.statusKey(), "status key")
+}
+
+func TestConsulLookup_statusKey_Settings(t *testing.T) {
+	config := &ConsulServerConfig{Address: "this.is.an.override.address"}
+
+	lookup := NewConsulLookup("test-service-name", "dc1", config)
+	lookup.subset = "v1"
+	lookup.filter = "Service.Meta.version == v1"
+	lookup.addressPolicy = AddressPolicyNode
+	lookup.addressFamily = AddressFamilyIPv6
+	assertEqual(t, "v1.test-service-name/dc1?filter=Service.Meta.version == v1&address-policy=node&address-family=ipv6", lookup.statusKey(), "status key")
+
+	other := NewConsulLookup("test-service-name", "dc1", config)
+	assertEqual(t, "test-service-name/dc1", other.statusKey(), "default settings")
+}
+
+func TestConsulLookup_lookup_Filter(t *testing.T) {
+	config := &ConsulServerConfig {
+		Address: "this.is.an.override.address",
+	}
+	lookup := NewConsulLookup("test-service-name", "dc1", config)
+	lookup.subset = "v2"
+	lookup.filter = "Service.Meta.version == v2"
+
+	var requestedFilter string
+	lookup.consulRest = func(consulAddress string, serviceName string, datacenter string, filter string) ([]*consul.ServiceEntry, uint64, error) {
+		requestedFilter = filter
+		return []*consul.ServiceEntry{{Service: &consul.AgentService{Address: "10.0.0.2", Port: 80}}}, 0, nil
+	}
+
+	endpoints, _, err := lookup.lookup()
+	assertNil(t, err)
+	assertEqual(t, 1, len(endpoints), "filtered instances")
+	assertEqual(t, "Service.Meta.version == v2", requestedFilter, "filter sent to consul")
+	assertEqual(t, "v2.test-service-name", lookup.name(), "name")
+}
+
+func TestConsulLookup_lookup_PreferredAddressFamily(t *testing.T) {
+	config := &ConsulServerConfig {
+		Address: "this.is.an.override.address",
+	}
+
+	entry := &consul.ServiceEntry{
+		Service: &consul.AgentService {
+			Address: "10.0.0.1",
+			Port: 1234,
+			TaggedAddresses: map[string]consul.ServiceAddress{
+				"lan_ipv4": {Address: "10.0.0.1", Port: 1234},
+				"lan_ipv6": {Address: "2001:db8::1", Port: 5678},
+			},
+		},
+	}
+
+	lookup := NewConsulLookup("test-service-name", "", config)
+	lookup.consulRest = stubConsulRestLookup([]*consul.ServiceEntry{entry}, nil)
+
+	endpoints, _, err := lookup.lookup()
+	assertNil(t, err)
+	assertEqual(t, "10.0.0.1:1234", endpoints[0].String(), "no preference")
+
+	lookup.addressFamily = AddressFamilyIPv6
+	endpoints, _, err = lookup.lookup()
+	assertNil(t, err)
+	assertEqual(t, "[2001:db8::1]:5678", endpoints[0].String(), "ipv6 preferred")
+}
+
+func TestServiceEndpoint_AddressPolicies(t *testing.T) {
+	entry := &consul.ServiceEntry{
+		Node: &consul.Node {
+			Address: "10.0.0.1",
+			TaggedAddresses: map[string]string{
+				"lan": "10.0.0.3",
+				"wan": "198.51.100.1",
+			},
+		},
+		Service: &consul.AgentService {
+			Address: "10.0.0.2",
+			Port: 1234,
+			TaggedAddresses: map[string]consul.ServiceAddress{
+				"wan": {Address: "198.51.100.2", Port: 4321},
+			},
+		},
+	}
+
+	assertEqual(t, "10.0.0.2:1234", serviceEndpoint(entry, "").String(), "service address")
+	assertEqual(t, "10.0.0.1:1234", serviceEndpoint(entry, AddressPolicyNode).String(), "node address")
+	assertEqual(t, "10.0.0.2:1234", serviceEndpoint(entry, AddressPolicyLan).String(), "service address preferred to the node lan address")
+	assertEqual(t, "198.51.100.2:4321", serviceEndpoint(entry, AddressPolicyWan).String(), "service wan address")
+	assertEqual(t, "10.0.0.2:1234", serviceEndpoint(entry, "wan_ipv6").String(), "missing tagged address")
+
+	entry.Service.Address = ""
+	assertEqual(t, "10.0.0.1:1234", serviceEndpoint(entry, "").String(), "node address fallback")
+	assertEqual(t, "10.0.0.3:1234", serviceEndpoint(entry, AddressPolicyLan).String(), "node lan address of a service without an address")
+}
+
+func TestConsulLookup_lookup_AutoAddressPolicy(t *testing.T) {
+	config := &ConsulServerConfig {
+		Address: "this.is.an.override.address",
+	}
+
+	entry := &consul.ServiceEntry{
+		Node: &consul.Node {
+			Address: "10.0.0.1",
+			TaggedAddresses: map[string]string{
+				"lan": "10.0.0.1",
+				"wan": "198.51.100.1",
+			},
+		},
+		Service: &consul.AgentService {
+			Port: 1234,
+		},
+	}
+
+	lookup := NewConsulLookup("test-service-name", "dc2", config)
+	lookup.addressPolicy = AddressPolicyAuto
+	lookup.consulRest = stubConsulRestLookup([]*consul.ServiceEntry{entry}, nil)
+	lookup.consulDc = func(consulAddress string) (string, error) {
+		return "dc1", nil
+	}
+
+	endpoints, _, err := lookup.lookup()
+	assertNil(t, err)
+	assertEqual(t, "198.51.100.1:1234", endpoints[0].String(), "remote datacenter")
+
+	lookup.datacenter = "dc1"
+	endpoints, _, err = lookup.lookup()
+	assertNil(t, err)
+	assertEqual(t, "10.0.0.1:1234", endpoints[0].String(), "local datacenter")
+}
+
+func TestEndpoint_String_IPv6(t *testing.T) {
+	endpoint := &Endpoint{host: "::1", port: 8080}
+	assertEqual(t, "[::1]:8080", endpoint.String(), "String")
+}
+
 func TestConsulLookup_start(t *testing.T) {
 	config := &ConsulServerConfig {
 		Address: "this.is.an.override.address",
@@ -120,14 +273,154 @@ func TestConsulLookup_start(t *testing.T) {
 
 }
 
+func TestDnsClientConfig_Defaults(t *testing.T) {
+	config, err := dnsClientConfig(&ConsulServerConfig{})
+
+	assertNil(t, err)
+	assertEqual(t, 1, len(config.Servers), "len(Servers)")
+	assertEqual(t, "localhost", config.Servers[0], "Servers[0]")
+	assertEqual(t, "53", config.Port, "Port")
+	assertEqual(t, false, config.recursionDesired, "recursion not requested from consul")
+}
+
+func TestDnsClientConfig_ResolvConf(t *testing.T) {
+	file, _ := ioutil.TempFile("", "resolv.conf")
+	defer os.Remove(file.Name())
+	file.WriteString("nameserver 10.0.0.1\nnameserver 10.0.0.2\nsearch service.consul\noptions timeout:3 attempts:4\n")
+	file.Close()
+
+	config, err := dnsClientConfig(&ConsulServerConfig{ResolvConf: file.Name()})
+
+	assertNil(t, err)
+	assertEqual(t, 2, len(config.Servers), "len(Servers)")
+	assertEqual(t, "10.0.0.2", config.Servers[1], "Servers[1]")
+	assertEqual(t, "service.consul", config.Search[0], "Search[0]")
+	assertEqual(t, 3, config.Timeout, "Timeout")
+	assertEqual(t, 4, config.Attempts, "Attempts")
+	assertEqual(t, true, config.recursionDesired, "recursion requested from resolv.conf servers")
+
+	config, err = dnsClientConfig(&ConsulServerConfig{ResolvConf: file.Name(), DnsServers: []string{"10.0.0.3"}, DnsPort: "8600", DnsAttempts: 1})
+
+	assertNil(t, err)
+	assertEqual(t, 1, len(config.Servers), "len(Servers) overridden")
+	assertEqual(t, "10.0.0.3", config.Servers[0], "Servers[0] overridden")
+	assertEqual(t, "8600", config.Port, "Port overridden")
+	assertEqual(t, 1, config.Attempts, "Attempts overridden")
+	assertEqual(t, "service.consul", config.Search[0], "Search[0] retained")
+	assertEqual(t, false, config.recursionDesired, "recursion not requested from the overriding servers")
+}
+
 func stubSrvLookup(result string, err error) DnsSrvLookup {
-	return func(dnsServer string, dnsPort string, name string) (string, error) {
+	return func(dnsConfig *DnsClientConfig, name string) (string, error) {
 		return result, err
 	}
 }
 
+func TestConsulLookup_start_ServesCacheWhenConsulUnavailable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-cache")
+	defer os.RemoveAll(dir)
+
+	config := &ConsulServerConfig {
+		Address: "this.is.an.override.address",
+		CacheDir: dir,
+	}
+
+	cache := NewEndpointCache(dir, "test-service-name", "", "")
+	assertNil(t, cache.write([]*Endpoint{{host: "cached-address", port: 1234}}, 42, time.Now()))
+
+	lookup := NewConsulLookup("test-service-name", "", config)
+	lookup.consulRest = stubConsulRestLookup(nil, errors.New("consul is down"))
+	lookup.start()
+
+	endpoints := lookup.getEndpoints()
+	assertEqual(t, 1, len(endpoints), "len(endpoints)")
+	assertEqual(t, "cached-address", endpoints[0].host, "cached endpoint")
+	assertEqual(t, true, lookup.stale, "stale")
+	assertEqual(t, uint64(42), lookup.index, "index")
+}
+
+func TestConsulLookup_start_IgnoresCacheExceedingMaxStale(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-cache")
+	defer os.RemoveAll(dir)
+
+	config := &ConsulServerConfig {
+		Address: "this.is.an.override.address",
+		CacheDir: dir,
+		CacheMaxStaleSec: 60,
+	}
+
+	cache := NewEndpointCache(dir, "test-service-name", "", "")
+	assertNil(t, cache.write([]*Endpoint{{host: "cached-address", port: 1234}}, 42, time.Now().Add(-time.Hour)))
+
+	lookup := NewConsulLookup("test-service-name", "", config)
+	assertEqual(t, false, lookup.loadCache(), "loadCache")
+}
+
+func TestConsulLookup_markStale_DiscardsExpiredEndpoints(t *testing.T) {
+	config := &ConsulServerConfig {
+		Address: "this.is.an.override.address",
+		CacheMaxStaleSec: 60,
+	}
+	lookup := NewConsulLookup("test-service-name", "", config)
+	lookup.endpoints = []*Endpoint{{host: "an-address", port: 1234}}
+
+	lookup.updated = time.Now()
+	lookup.markStale()
+	assertEqual(t, 1, len(lookup.getEndpoints()), "endpoints within limit")
+	assertEqual(t, true, lookup.stale, "stale")
+
+	lookup.updated = time.Now().Add(-time.Hour)
+	lookup.markStale()
+	assertEqual(t, 0, len(lookup.getEndpoints()), "endpoints exceeding limit")
+}
+
 func stubConsulRestLookup(services []*consul.ServiceEntry, err error) ConsulRestLookup {
-	return func(consulAddress string, serviceName string, datacenter string) ([]*consul.ServiceEntry, error) {
-		return services, err
+	return func(consulAddress string, serviceName string, datacenter string, filter string) ([]*consul.ServiceEntry, uint64, error) {
+		return services, 0, err
+	}
+}
+
+/**
+ * The service is looked up as soon as the lookup is started, rather than after the
+ * first poll interval, and polling stops once the lookup is stopped
+ */
+func TestConsulLookup_start_LooksUpImmediately(t *testing.T) {
+	lookup := NewConsulLookup("immediate-service", "", &ConsulServerConfig{Address: "this.is.an.override.address"})
+	lookup.pollIntervalSec = 30
+
+	var lookups int32
+	lookup.consulRest = func(consulAddress string, serviceName string, datacenter string, filter string) ([]*consul.ServiceEntry, uint64, error) {
+		atomic.AddInt32(&lookups, 1)
+		return []*consul.ServiceEntry{{Service: &consul.AgentService{Address: "an-address-1", Port: 1234}}}, 1, nil
+	}
+
+	started := time.Now()
+	lookup.start()
+	assertEqual(t, true, time.Since(started) < time.Second, "started without waiting for the poll interval")
+	assertEqual(t, "an-address-1:1234", lookup.getEndpoints()[0].String(), "first lookup")
+
+	lookup.stop()
+	assertEqual(t, int32(1), atomic.LoadInt32(&lookups), "looked up once")
+}
+
+/**
+ * A lookup that is stopped before it succeeds returns from start
+ */
+func TestConsulLookup_start_Stopped(t *testing.T) {
+	lookup := NewConsulLookup("unreachable-service", "", &ConsulServerConfig{Address: "this.is.an.override.address"})
+	lookup.consulRest = stubConsulRestLookup(nil, errors.New("consul is unreachable"))
+
+	started := make(chan struct{})
+	go func() {
+		lookup.start()
+		close(started)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	lookup.stop()
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("start did not return once stopped")
 	}
 }
@@ -5,7 +5,12 @@ import (
 	"net"
 	"log"
 	"io"
-	"os"
+	"fmt"
+	"errors"
+	"sync"
+	"time"
+	"expvar"
+	"sync/atomic"
 )
 
 /**
@@ -19,9 +24,195 @@ type ConsulProxy struct {
 	// the port on local host to attach the proxy to
 	localPort int
 
+	// the unix socket to listen on instead of localIp/localPort, along with
+	// the file mode and ownership of the socket
+	localSocket string
+	socketMode  string
+	socketUser  string
+	socketGroup string
+
+	// the PROXY protocol version, 'v1' or 'v2', sent to backends before any
+	// client data. Empty to not send a header
+	sendProxyProtocol string
+
+	// whether clients send a PROXY protocol header, carrying the address of
+	// the original client, before any other data
+	acceptProxyProtocol bool
+
 	// handles looking up the currently active set of backend
 	// associated with this proxy instance
-	lookup    *ConsulLookup
+	discoverer Discoverer
+
+	// limit the connections open through the proxy, and to each backend
+	connections *connectionLimiter
+	endpoints   *endpointLimiter
+
+	// how long a connection over a limit waits for another to close, and how many
+	// connections may wait for each limit, zero to reject them
+	queueTimeout time.Duration
+	maxQueued    int
+
+	// the clients that may connect, and how often
+	clients *clientFilter
+
+	// how long connections may stay open
+	timeouts connectionTimeouts
+
+	// how quickly data is copied, nil for no limit
+	bandwidth *bandwidthLimits
+
+	// the connection counters of the service
+	stats *expvar.Map
+
+	// the goroutines accepting connections, each with its own listener where
+	// SO_REUSEPORT is supported, and the backlog of each listener (0 for the default)
+	acceptors int
+	backlog   int
+
+	listening proxyListener
+}
+
+/**
+ * A proxy for a single service, listening using the protocol of the service
+ */
+type Proxy interface {
+	// listens for new connections. Loops indefinately, until the proxy is stopped,
+	// or returns the error if it is unable to listen
+	start() error
+
+	// stops listening for new connections, and stops discovering the backends.
+	// Connections that are already open are left to finish
+	stop()
+}
+
+/**
+ * The listeners of a proxy, which are closed when the proxy is stopped
+ */
+type proxyListener struct {
+	listeners []io.Closer
+	stopped   bool
+	mu        sync.Mutex
+}
+
+/**
+ * Records a listener once it is open. Returns false, closing the listener,
+ * if the proxy has already been stopped
+ */
+func (pl *proxyListener) set(listener io.Closer) bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if pl.stopped {
+		listener.Close()
+		return false
+	}
+	pl.listeners = append(pl.listeners, listener)
+	return true
+}
+
+func (pl *proxyListener) stop() {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if pl.stopped {
+		return
+	}
+	pl.stopped = true
+	for _, listener := range pl.listeners {
+		listener.Close()
+	}
+}
+
+func (pl *proxyListener) isStopped() bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.stopped
+}
+
+/**
+ * Creates the proxy for the 'Protocol' of the service, defaulting to TCP.
+ * 'consulServer' is used to discover the services that HTTP requests are routed to
+ */
+func NewProxy(service *ProxiedService, discoverer Discoverer, consulServer *ConsulServerConfig) (Proxy, error) {
+	switch service.SendProxyProtocol {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		return nil, fmt.Errorf("unknown PROXY protocol version '%s'", service.SendProxyProtocol)
+	}
+
+	if len(service.HttpRoutes) != 0 && service.Protocol != ProtocolHttp && service.Protocol != ProtocolHttp2 && service.Protocol != ProtocolGrpc {
+		return nil, errors.New("HttpRoutes can only be used with the http, http2 and grpc protocols")
+	}
+
+	switch service.OverLimitPolicy {
+	case "", OverLimitReject, OverLimitQueue:
+	default:
+		return nil, fmt.Errorf("unknown over limit policy '%s'", service.OverLimitPolicy)
+	}
+
+	if (service.MaxConnections != 0 || service.MaxConnectionsPerEndpoint != 0) && service.Protocol != "" && service.Protocol != ProtocolTcp {
+		return nil, errors.New("connection limits can only be used with the tcp protocol")
+	}
+
+	hasTimeouts := service.MaxLifetimeSec != 0 || service.HalfCloseTimeoutSec != 0 || service.KeepAliveSec != 0
+	if hasTimeouts && service.Protocol != "" && service.Protocol != ProtocolTcp {
+		return nil, errors.New("connection timeouts can only be used with the tcp protocol")
+	}
+	if service.IdleTimeoutSec != 0 && service.Protocol == ProtocolUdp {
+		return nil, errors.New("the idle timeout of UDP services is set by UdpIdleTimeoutSec")
+	}
+	if (service.ReadHeaderTimeoutSec != 0 || service.ReadTimeoutSec != 0) && service.Protocol != ProtocolHttp && service.Protocol != ProtocolHttp2 && service.Protocol != ProtocolGrpc {
+		return nil, errors.New("read timeouts can only be used with the http, http2 and grpc protocols")
+	}
+
+	if _, err := newClientFilter(service); err != nil {
+		return nil, err
+	}
+
+	bandwidth, err := newBandwidthLimits(service)
+	if err != nil {
+		return nil, err
+	}
+	if bandwidth != nil && service.Protocol != "" && service.Protocol != ProtocolTcp {
+		return nil, errors.New("bandwidth limits can only be used with the tcp protocol")
+	}
+
+	if service.Acceptors < 0 || service.ListenBacklog < 0 {
+		return nil, fmt.Errorf("invalid Acceptors %d or ListenBacklog %d", service.Acceptors, service.ListenBacklog)
+	}
+	if (service.Acceptors != 0 || service.ListenBacklog != 0) && service.Protocol != "" && service.Protocol != ProtocolTcp {
+		return nil, errors.New("acceptors and the listen backlog can only be configured with the tcp protocol")
+	}
+	if (len(service.AllowCidrs) != 0 || len(service.DenyCidrs) != 0 || service.ClientConnectionsPerSec != 0) && service.Protocol != "" && service.Protocol != ProtocolTcp {
+		return nil, errors.New("client filters can only be used with the tcp protocol")
+	}
+
+	switch service.Protocol {
+	case "", ProtocolTcp:
+		return NewConsulProxy(service, discoverer), nil
+	case ProtocolUdp:
+		if service.LocalSocket != "" {
+			return nil, errors.New("UDP services cannot be proxied from a unix socket")
+		}
+		if service.SendProxyProtocol != "" || service.AcceptProxyProtocol {
+			return nil, errors.New("the PROXY protocol is not supported for UDP services")
+		}
+		return NewUdpProxy(service, discoverer), nil
+	case ProtocolHttp, ProtocolHttp2, ProtocolGrpc:
+		if service.SendProxyProtocol != "" || service.AcceptProxyProtocol {
+			return nil, errors.New("the PROXY protocol is not supported for HTTP services")
+		}
+		return NewHttpProxy(service, discoverer, consulServer)
+	default:
+		return nil, fmt.Errorf("unknown protocol '%s'", service.Protocol)
+	}
+}
+
+/**
+ * The error used when a backend is needed, but none have been discovered
+ */
+func errNoEndpoints(discoverer Discoverer) error {
+	return fmt.Errorf("no endpoints available for service %s", discoverer.name())
 }
 
 /**
@@ -30,87 +221,328 @@ type ConsulProxy struct {
  *
  * The proxy must be started once created
  */
-func NewConsulProxy(service *ProxiedService, lookup *ConsulLookup) *ConsulProxy {
-	lookup.start()
+func NewConsulProxy(service *ProxiedService, discoverer Discoverer) *ConsulProxy {
+	var queueTimeout time.Duration
+	var maxQueued int
+	if service.OverLimitPolicy == OverLimitQueue {
+		queueTimeout = 10 * time.Second
+		if service.QueueTimeoutSec > 0 {
+			queueTimeout = time.Duration(service.QueueTimeoutSec) * time.Second
+		}
+		maxQueued = defaultMaxQueuedConnections
+		if service.MaxQueuedConnections > 0 {
+			maxQueued = service.MaxQueuedConnections
+		}
+	}
+
+	// validated by NewProxy
+	clients, err := newClientFilter(service)
+	if err != nil {
+		panic(err)
+	}
+	bandwidth, err := newBandwidthLimits(service)
+	if err != nil {
+		panic(err)
+	}
+
+	acceptors := 1
+	if service.Acceptors > 1 {
+		acceptors = service.Acceptors
+	}
 
 	return &ConsulProxy {
 		localIp: service.LocalIP,
 		localPort: service.LocalPort,
-		lookup: lookup,
+		localSocket: service.LocalSocket,
+		socketMode: service.SocketMode,
+		socketUser: service.SocketUser,
+		socketGroup: service.SocketGroup,
+		sendProxyProtocol: service.SendProxyProtocol,
+		acceptProxyProtocol: service.AcceptProxyProtocol,
+		discoverer: discoverer,
+		connections: newConnectionLimiter(service.MaxConnections),
+		endpoints: newEndpointLimiter(service.MaxConnectionsPerEndpoint),
+		queueTimeout: queueTimeout,
+		maxQueued: maxQueued,
+		clients: clients,
+		timeouts: newConnectionTimeouts(service),
+		bandwidth: bandwidth,
+		stats: serviceConnectionStats(service.ServiceName),
+		acceptors: acceptors,
+		backlog: service.ListenBacklog,
 	}
 }
 
 /**
  * Resolves the local TCP address that the proxy will bind to
  */
-func (proxy *ConsulProxy) local() *net.TCPAddr {
-	var local = proxy.localIp + ":" + strconv.Itoa(proxy.localPort)
-	localAddress, err := net.ResolveTCPAddr("tcp", local)
-	if err != nil {
-		panic(err)
+func (proxy *ConsulProxy) local() (*net.TCPAddr, error) {
+	var local = net.JoinHostPort(proxy.localIp, strconv.Itoa(proxy.localPort))
+	return net.ResolveTCPAddr("tcp", local)
+}
+
+/**
+ * Listens on the unix socket if one is configured, otherwise on the local TCP address.
+ * Where SO_REUSEPORT is supported, a listener is opened on the address for each acceptor
+ */
+func (proxy *ConsulProxy) listen() ([]net.Listener, error) {
+	if proxy.localSocket != "" {
+		listener, err := listenUnixSocket(proxy.localSocket, proxy.socketMode, proxy.socketUser, proxy.socketGroup)
+		if err == nil {
+			err = setListenBacklog(listener, proxy.backlog)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
 	}
 
-	return localAddress
-}
+	count := 1
+	if reusePortSupported {
+		count = proxy.acceptors
+	}
+
+	address, err := proxy.local()
+	if err != nil {
+		return nil, err
+	}
+	var listeners []net.Listener
+	for i := 0; i < count; i++ {
+		listener, err := listenTcp(address, count > 1, proxy.backlog)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
 
-func (proxy *ConsulProxy) remote() string {
-	remote := proxy.lookup.getEndpoints()[0].String()
-	return remote
+		// the others bind the port of the first, in case it was given any free port
+		address = listener.Addr().(*net.TCPAddr)
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
 }
 
 /**
- * Starts up the proxy by listening for TCP connections on the specified local port.
+ * Starts up the proxy by discovering the backends of the service, then listening for
+ * TCP connections on the specified local port, or unix socket.
  *
  * Will loop indefinately as new connections are opened
  */
-func (proxy *ConsulProxy) start() {
-	localAddress := proxy.local()
+func (proxy *ConsulProxy) start() error {
+	proxy.discoverer.start()
 
-	listener, err := net.ListenTCP("tcp", localAddress)
+	listeners, err := proxy.listen()
 	if err != nil {
-		log.Fatal("Unable to bind to the local interface", err.Error())
-		os.Exit(1)
+		return fmt.Errorf("unable to bind to the local interface - %s", err)
+	}
+	for i, listener := range listeners {
+		if !proxy.listening.set(listener) {
+			// stopped while binding - the listener is closed, and so must be the rest
+			for _, unused := range listeners[i+1:] {
+				unused.Close()
+			}
+			return nil
+		}
+	}
+
+	localAddress := listeners[0].Addr()
+	log.Println("Now listening on", localAddress, "for service", proxy.discoverer.name())
+
+	var accepting sync.WaitGroup
+	errs := make(chan error, proxy.acceptors)
+	for i := 0; i < proxy.acceptors; i++ {
+		accepting.Add(1)
+		go func(listener net.Listener) {
+			defer accepting.Done()
+			if err := acceptConnections(listener, &proxy.listening, proxy.accept); err != nil {
+				errs <- err
+			}
+		}(listeners[i%len(listeners)])
+	}
+	accepting.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return fmt.Errorf("unable to accept connections on %s - %s", localAddress, err)
+	}
+
+	log.Println("Stopped listening on", localAddress, "for service", proxy.discoverer.name())
+	return nil
+}
+
+/**
+ * Handles a newly accepted connection in the background, unless the client is rejected.
+ * Clients sending a PROXY protocol header are only admitted once it is read, as their
+ * address is in the header.
+ */
+func (proxy *ConsulProxy) accept(conn net.Conn) {
+	if !proxy.acceptProxyProtocol && !proxy.admit(conn) {
+		return
+	}
+
+	go proxy.handle(conn)
+}
+
+/**
+ * Checks the remote address of the connection against the client filters, closing
+ * the connection if the client is rejected
+ */
+func (proxy *ConsulProxy) admit(conn net.Conn) bool {
+	rejected := proxy.clients.admit(conn.RemoteAddr(), time.Now())
+	if rejected == "" {
+		return true
 	}
 
-	for {
-		// AcceptTCP will block until a new connection is opened
-		log.Println("Now listening on", localAddress, " for service ", proxy.lookup.serviceName)
-		localConnection, err := listener.AcceptTCP()
+	reason := "the client is not allowed to connect"
+	if rejected == clientRateLimited {
+		reason = "the client is opening connections too quickly"
+	}
+	proxy.reject(conn, rejected, reason)
+	return false
+}
+
+func (proxy *ConsulProxy) stop() {
+	proxy.listening.stop()
+	proxy.discoverer.stop()
+}
+
+/**
+ * Proxies a newly accepted connection to a backend, once it is admitted by the
+ * connection limits. Any PROXY protocol header is read first, so that clients slow
+ * to send it do not hold connections under the limits.
+ */
+func (proxy *ConsulProxy) handle(conn net.Conn) {
+	setKeepAlive(conn, proxy.timeouts.keepAlive)
+
+	if proxy.acceptProxyProtocol {
+		wrapped, err := readProxyHeader(conn)
 		if err != nil {
-			panic(err)
+			log.Println("Closing connection from", conn.RemoteAddr(), "-", err)
+			conn.Close()
+			return
 		}
+		conn = wrapped
+
+		if !proxy.admit(conn) {
+			return
+		}
+	}
+
+	deadline := time.Now().Add(proxy.queueTimeout)
+	if !proxy.connections.acquire(deadline, proxy.maxQueued) {
+		proxy.reject(conn, connectionLimited, "the proxy has reached its connection limit")
+		return
+	}
+	defer proxy.connections.release()
+
+	if !globalConnections.acquire(deadline, proxy.maxQueued) {
+		proxy.reject(conn, connectionLimited, "the global connection limit has been reached")
+		return
+	}
+	defer globalConnections.release()
+
+	proxy.stats.Add("active", 1)
+	defer proxy.stats.Add("active", -1)
 
-		go proxyConnection(localConnection, proxy.remote())
+	endpoint, full := proxy.endpoints.acquire(proxy.discoverer.getEndpoints(), deadline, proxy.maxQueued)
+	if full {
+		proxy.reject(conn, connectionLimited, "every backend has reached its connection limit")
+		return
+	}
+	if endpoint == nil {
+		log.Println("Closing connection from", conn.RemoteAddr(), "-", errNoEndpoints(proxy.discoverer))
+		conn.Close()
+		return
 	}
+	defer proxy.endpoints.release(endpoint)
+
+	proxyConnection(conn, endpoint.String(), proxy.sendProxyProtocol, proxy.timeouts, proxy.bandwidth)
+}
 
+/**
+ * Closes a connection that was not admitted, counting the rejection under 'counter'
+ */
+func (proxy *ConsulProxy) reject(conn net.Conn, counter string, reason string) {
+	log.Println("Rejecting connection from", conn.RemoteAddr(), "for service", proxy.discoverer.name(), "-", reason)
+	proxy.stats.Add(counter, 1)
+	conn.Close()
 }
 
 /**
  * Dials the remote address, and proxies any data that is transferred
- * over the connection.
+ * over the connection. If 'proxyProtocol' is specified, a PROXY protocol header
+ * of that version carrying the client address is sent to the backend first.
+ *
+ * Data is copied no faster than the 'bandwidth' limits allow, if there are any.
  *
- * Blocks until the connection is closed
+ * Blocks until the connection is closed, or is closed by one of the 'timeouts'
  */
-func proxyConnection(conn net.Conn, remoteAddress string) {
-	backend, err := net.Dial("tcp", remoteAddress)
+func proxyConnection(conn net.Conn, remoteAddress string, proxyProtocol string, timeouts connectionTimeouts, bandwidth *bandwidthLimits) {
+	dialer := &net.Dialer{KeepAlive: timeouts.keepAlive}
+	backend, err := dialer.Dial("tcp", remoteAddress)
 	defer conn.Close()
 	if err != nil {
-		log.Fatal("proxy", err.Error())
+		log.Printf("Unable to connect to %s - %s", remoteAddress, err)
 		return
 	}
 	defer backend.Close()
 
 	log.Printf("ConsulProxy is proxying to %s", remoteAddress)
 
+	if proxyProtocol != "" {
+		if err := writeProxyHeader(backend, proxyProtocol, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			log.Printf("Failed to send PROXY protocol header to %s - %s", remoteAddress, err)
+			return
+		}
+	}
+
+	// the activity is only tracked with an idle timeout, so that copyData can otherwise
+	// splice between the connections
+	var clientReader, backendReader io.Reader = conn, backend
+	var lastActive int64
+	if timeouts.idle > 0 {
+		touch := func() { atomic.StoreInt64(&lastActive, time.Now().UnixNano()) }
+		touch()
+		clientReader = &activityReader{reader: conn, touch: touch}
+		backendReader = &activityReader{reader: backend, touch: touch}
+	}
+
+	clientReader, backendReader = bandwidth.throttle(clientReader, backendReader)
+
 	done := make(chan struct{})
+	defer close(done)
+	go watchConnection(conn, backend, timeouts.idle, timeouts.maxLifetime, &lastActive, done, "connection")
+
+	upstream := make(chan struct{})
 	go func() {
-		io.Copy(backend, conn)
-		backend.(*net.TCPConn).CloseWrite()
+		copyData(backend, clientReader)
+		closeWrite(backend)
 
 		log.Printf("Connection to %s was closed", remoteAddress)
-		close(done)
+		close(upstream)
 	}()
-	io.Copy(conn, backend)
-	conn.(*net.TCPConn).CloseWrite()
-	<-done
+
+	downstream := make(chan struct{})
+	go func() {
+		copyData(conn, backendReader)
+		closeWrite(conn)
+		close(downstream)
+	}()
+
+	select {
+	case <-upstream:
+		awaitHalfClosed(downstream, conn, backend, timeouts.halfClose)
+	case <-downstream:
+		awaitHalfClosed(upstream, conn, backend, timeouts.halfClose)
+	}
+}
+
+/**
+ * Shuts down the writing side of TCP and unix socket connections
+ */
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
 }
\ No newline at end of file
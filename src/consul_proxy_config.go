@@ -10,6 +10,7 @@ import (
 	"flag"
 	"strings"
 	"errors"
+	"net"
 )
 
 /**
@@ -22,15 +23,352 @@ type ProxiedService struct {
 	// the datacenter which the service should be looked up in
 	Datacenter string
 
-	// the ip for the frontend to bind to - defaults to localhost
+	// only proxy to the instances of the service with this tag, if specified
+	ServiceTag string
+
+	// splits the connections (or requests, for HTTP proxies) between several services, or
+	// tagged subsets of services, in proportion to their weights, e.g. for canary releases.
+	// Each split is discovered in the same way as this proxy, and ServiceName is only used
+	// in logs
+	Splits []*ServiceSplit
+
+	// the consul KV key holding the weights of the splits, as a JSON object mapping split
+	// names to weights. The key is watched, and its weights override the configured ones
+	SplitWeightsKey string
+
+	// apply the service-router, service-splitter and service-resolver consul config entries
+	// of the service, as the service mesh does, when choosing the backends. The entries are
+	// watched for changes. Routers only apply when the protocol is 'http', 'http2' or 'grpc'
+	ConfigEntries bool
+
+	// the ip for the frontend to bind to - defaults to localhost.
+	// Use '::' to listen on all interfaces for both IPv4 and IPv6
 	LocalIP     string
 
 	// the port for the frontend to bind to
 	LocalPort   int
+
+	// the unix socket for the frontend to listen on, instead of LocalIP/LocalPort.
+	// A stale socket left at the path by a previous process is replaced
+	LocalSocket string
+
+	// the octal file mode of the unix socket e.g. '0660', and the user and group
+	// (names or ids) that should own it
+	SocketMode  string
+	SocketUser  string
+	SocketGroup string
+
+	// how the backends are discovered, one of 'consul' (the default), 'dns', 'static' or 'file'
+	Discovery   string
+
+	// the SRV name queried when using 'dns' discovery.
+	// Defaults to {ServiceName}.service.{Datacenter}.consul
+	DnsName     string
+
+	// the backends in the host:port format, when using 'static' discovery
+	Endpoints   []string
+
+	// the JSON or YAML file listing the backends in the host:port format,
+	// when using 'file' discovery. The file is watched for changes.
+	EndpointsFile string
+
+	// the preferred address family of the backends, 'ipv4' or 'ipv6', used to choose
+	// between the ipv4 and ipv6 tagged addresses of services that advertise both
+	AddressFamily string
+
+	// which address of each service instance is proxied to. One of
+	//   'service' (the default) - the service address
+	//   'node' - the address of the node the service is registered on
+	//   'lan', 'wan', 'lan_ipv4', 'wan_ipv4', 'lan_ipv6', 'wan_ipv6' - the tagged address
+	//         of the service, or of the node if the service does not have one
+	//   'auto' - 'wan' when 'Datacenter' differs from the datacenter of the consul agent, otherwise 'lan'
+	// The node address is used when the service has no address.
+	AddressPolicy string
+
+	// the protocol proxied, 'tcp' (the default), 'udp', 'http', 'http2' or 'grpc'.
+	// 'http2' and 'grpc' accept HTTP/2 without TLS (h2c) from clients and use it
+	// to talk to the backends, so that each stream is balanced independently
+	Protocol    string
+
+	// when the protocol is 'http', 'http2' or 'grpc', routes requests to other services by host, path
+	// or header. The first matching route is used, and requests that do not match
+	// any route are proxied to this service
+	HttpRoutes  []*HttpRoute
+
+	// the HAProxy PROXY protocol version, 'v1' or 'v2', used to send the address of
+	// the original client to the backends. Empty to not send it
+	SendProxyProtocol string
+
+	// whether clients send a v1 or v2 PROXY protocol header, e.g. when the proxy sits
+	// behind another load balancer. Connections without a valid header are closed
+	AcceptProxyProtocol bool
+
+	// for HTTP proxies, how long in seconds an upgraded connection, e.g. a WebSocket,
+	// may go without any data being sent in either direction before it is closed,
+	// and how long it may stay open. 0 for no limit
+	UpgradeIdleTimeoutSec int
+	UpgradeMaxLifetimeSec int
+
+	// for HTTP proxies, how long in seconds a client may take to send the headers of a
+	// request, defaulting to 10, and the whole request, defaulting to no limit. How long
+	// a connection may wait for its next request is set by IdleTimeoutSec
+	ReadHeaderTimeoutSec int
+	ReadTimeoutSec       int
+
+	// how often in seconds the backends are checked using the gRPC health checking protocol,
+	// when the protocol is 'grpc'. Backends failing the check are not proxied to. 0 disables
+	// health checking
+	GrpcHealthCheckIntervalSec int
+
+	// the service name sent in gRPC health checks. Defaults to the overall health of the server
+	GrpcHealthService string
+
+	// how long in seconds a UDP client may go without sending or receiving
+	// a datagram before its session is closed. Defaults to 60
+	UdpIdleTimeoutSec int
+
+	// the most UDP clients with an open session at once. Datagrams from new clients
+	// are dropped while there are this many. Defaults to 1000
+	MaxUdpSessions int
+
+	// registers the listener as a service with the local consul agent while the
+	// proxy is running, if specified
+	Register *ServiceRegistration
+
+	// the most connections open through the proxy at once, and to each backend, when
+	// the protocol is 'tcp'. Backends at their limit are not chosen for new connections.
+	// 0 for no limit
+	MaxConnections            int
+	MaxConnectionsPerEndpoint int
+
+	// what is done with connections over a limit, 'reject' (the default) to close them
+	// or 'queue' to wait up to QueueTimeoutSec (defaults to 10) for a connection to close.
+	// At most MaxQueuedConnections (defaults to 100) wait for each limit, and the
+	// connections beyond them are rejected
+	OverLimitPolicy      string
+	QueueTimeoutSec      int
+	MaxQueuedConnections int
+
+	// when the protocol is 'tcp', the CIDR ranges (or single addresses) of the clients
+	// that may connect, and that may not. Denied ranges take precedence, and every
+	// client is allowed if AllowCidrs is empty
+	AllowCidrs []string
+	DenyCidrs  []string
+
+	// when the protocol is 'tcp', the new connections each client address may open per
+	// second, and in a burst (defaults to the rate). 0 for no limit
+	ClientConnectionsPerSec float64
+	ClientConnectionsBurst  int
+
+	// when the protocol is 'tcp', how long in seconds a connection may go without any
+	// data being sent in either direction before it is closed, how long it may stay
+	// open, and how long it may stay open once one side has finished sending. 0 for no limit.
+	// For HTTP proxies IdleTimeoutSec is how long a connection may wait for its next
+	// request, defaulting to 120
+	IdleTimeoutSec      int
+	MaxLifetimeSec      int
+	HalfCloseTimeoutSec int
+
+	// when the protocol is 'tcp', the interval in seconds of TCP keepalive probes on
+	// the client and backend connections. 0 uses the default of 15 seconds, and -1
+	// disables keepalives
+	KeepAliveSec int
+
+	// when the protocol is 'tcp', the most bytes per second each connection may send
+	// upstream to its backend, and downstream to its client. 0 for no limit
+	UpstreamBytesPerSec   int64
+	DownstreamBytesPerSec int64
+
+	// when the protocol is 'tcp', the most bytes per second sent upstream and downstream
+	// by all the connections of the proxy together. 0 for no limit
+	ServiceUpstreamBytesPerSec   int64
+	ServiceDownstreamBytesPerSec int64
+
+	// when the protocol is 'tcp', the number of goroutines accepting connections, defaulting
+	// to 1. On Linux each has its own listener on the port, using SO_REUSEPORT
+	Acceptors int
+
+	// when the protocol is 'tcp', the length of the queue of connections waiting to be
+	// accepted, on Linux. 0 uses the default of the system
+	ListenBacklog int
 }
 
+const (
+	ProtocolTcp = "tcp"
+	ProtocolUdp = "udp"
+	ProtocolHttp = "http"
+	ProtocolHttp2 = "http2"
+	ProtocolGrpc = "grpc"
+
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+
+	AddressPolicyService = "service"
+	AddressPolicyNode    = "node"
+	AddressPolicyLan     = "lan"
+	AddressPolicyWan     = "wan"
+	AddressPolicyAuto    = "auto"
+)
+
 func (ps *ProxiedService) String() string {
-	return "localhost:" + strconv.Itoa(ps.LocalPort) + " -> Consul(" + ps.ServiceName + " in datacenter " + ps.Datacenter + ")"
+	if ps.LocalSocket != "" {
+		return "unix:" + ps.LocalSocket + " -> Consul(" + ps.ServiceName + " in datacenter " + ps.Datacenter + ")"
+	}
+
+	localIP := ps.LocalIP
+	if localIP == "" {
+		localIP = "localhost"
+	}
+	return net.JoinHostPort(localIP, strconv.Itoa(ps.LocalPort)) + " -> Consul(" + ps.ServiceName + " in datacenter " + ps.Datacenter + ")"
+}
+
+/**
+ * A service, or tagged subset of a service, that a share of the traffic is sent to
+ */
+type ServiceSplit struct {
+	// the name the weight of the split is given under in the SplitWeightsKey.
+	// Defaults to {ServiceTag}.{ServiceName}, or {ServiceName} without a tag
+	Name string
+
+	// the service, and optionally the tag of the instances, the split is sent to
+	ServiceName string
+	ServiceTag  string
+
+	// the datacenter of the service. Defaults to the datacenter of the proxy
+	Datacenter string
+
+	// the relative weight of the split, e.g. 95 and 5 to send 5% of traffic to a canary
+	Weight int
+
+	// the backends of the split, when using 'static' or 'file' discovery
+	Endpoints     []string
+	EndpointsFile string
+}
+
+/**
+ * How the listener of a proxy is registered as a service with the local consul agent
+ */
+type ServiceRegistration struct {
+	// the name of the registered service. Defaults to {ServiceName}-proxy
+	Name string
+
+	// the id of the registered service. Defaults to {Name}-{LocalPort}
+	ID string
+
+	// the address registered. Defaults to LocalIP, unless it listens on all interfaces,
+	// in which case the address of the agent's node is used
+	Address string
+
+	Tags []string
+	Meta map[string]string
+
+	// the health check of the service, one of
+	//   'ttl' (the default) - passing while the proxy is running and has backends to proxy to
+	//   'tcp' - the agent connects to the listener
+	//   'none' - no check
+	Check string
+
+	// how often in seconds the check is run or its TTL renewed. Defaults to 10
+	CheckIntervalSec int
+
+	// how long in seconds the check may be critical before the agent deregisters the
+	// service, e.g. if the proxy is killed. 0 to never deregister
+	DeregisterCriticalAfterSec int
+
+	// the host:port of the HTTP API of the local consul agent the service is registered
+	// with. Defaults to 127.0.0.1:8500
+	AgentAddress string
+}
+
+const (
+	CheckTtl  = "ttl"
+	CheckTcp  = "tcp"
+	CheckNone = "none"
+)
+
+/**
+ * Routes the HTTP requests that match all of the conditions given to a service.
+ * The service is discovered in the same way as the proxy the route belongs to.
+ */
+type HttpRoute struct {
+	// the Host of the request, ignoring any port. A leading '*.' matches any subdomain
+	Host string
+
+	// the prefix the path of the request must start with
+	PathPrefix string
+
+	// headers that must have the given values
+	Headers map[string]string
+
+	// the service the matching requests are proxied to
+	ServiceName string
+
+	// the datacenter of the service. Defaults to the datacenter of the proxy
+	Datacenter string
+
+	// the backends of the service, when using 'static' or 'file' discovery
+	Endpoints     []string
+	EndpointsFile string
+}
+
+/**
+ * A single listener shared by many services, where TLS connections are routed to
+ * a service based on the server name (SNI) requested by the client
+ */
+type SniListener struct {
+	// the ip and port to bind to - the ip defaults to localhost
+	LocalIP   string
+	LocalPort int
+
+	// maps server names to service names, where '{service}' matches a single label
+	// which is the service name, and '*' matches anything. Defaults to '{service}.*'
+	// e.g. '{service}.internal' routes 'orders.internal' to the 'orders' service
+	HostPattern string
+
+	// server names mapped directly to service names, checked before the pattern
+	Routes map[string]string
+
+	// the service used for connections whose server name does not map to a service.
+	// If empty, those connections are closed
+	DefaultService string
+
+	// the services that server names matched by the host pattern may be routed to.
+	// If empty any service may be, but at most MaxServices (defaults to 100) of them
+	// are discovered at once, and those not requested for 10 minutes stop being discovered
+	Services    []string
+	MaxServices int
+
+	// the datacenter, discovery mechanism and address policy used for the services,
+	// as for a ProxiedService
+	Datacenter    string
+	Discovery     string
+	AddressPolicy string
+}
+
+/**
+ * Proxies every service in the consul catalog that has a tag or service meta key,
+ * creating and removing the proxies as services are registered and deregistered
+ */
+type AutoProxy struct {
+	// proxy the services with this tag, and/or the services with this service meta key
+	ServiceTag     string
+	ServiceMetaKey string
+
+	// the datacenter whose catalog is watched, and the services are discovered in
+	Datacenter string
+
+	// the ip the proxies bind to - defaults to localhost
+	LocalIP string
+
+	// the service meta key holding the local port of each service. Defaults to 'proxy-port'
+	PortMetaKey string
+
+	// the range of local ports assigned to services without a port in their meta
+	LocalPortMin int
+	LocalPortMax int
+
+	// the protocol proxied, as for a ProxiedService
+	Protocol string
 }
 
 /**
@@ -39,20 +377,41 @@ func (ps *ProxiedService) String() string {
  * If the 'Address' is specified, this will simply be used as the ReST endpoint.
  *
  * Otherwise, 'DnsName' is used to lookup an SRV record against the DNS servers
- * specified in 'DnsServers'
+ * specified in 'DnsServers', or read from the 'ResolvConf' file.
  *
- * If 'DnsServers' is not specified 'localhost:53' is used.
+ * If neither is specified 'localhost:53' is used.
  */
 type ConsulServerConfig struct {
 	// the DNS servers used to lookup the consul server
 	DnsServer string
 	DnsPort   string
 
+	// a list of DNS servers, tried in turn until one responds. Each may be
+	// a host, or a host:port to override 'DnsPort'. Takes precedence over 'DnsServer'
+	DnsServers []string
+
+	// the resolver configuration file, e.g. /etc/resolv.conf, that the DNS servers,
+	// search domains, timeout and attempts are read from
+	ResolvConf string
+
+	// the timeout in seconds of each DNS query, and how many times each server is tried.
+	// Override the values read from 'ResolvConf'
+	DnsTimeoutSec int
+	DnsAttempts   int
+
 	// the DNS name used to lookup the consul server
 	DnsName   string
 
 	// the override address for the consul server
 	Address   string
+
+	// the directory the last known endpoints of each service are persisted to,
+	// so they can be served when consul is unreachable. Disabled if empty.
+	CacheDir  string
+
+	// the maximum age in seconds of endpoints that will be served while consul
+	// is unreachable. Zero means there is no limit.
+	CacheMaxStaleSec int
 }
 
 /**
@@ -65,10 +424,44 @@ type ConsulProxyConfig struct {
 
 	// The list of services that should be proxied and what local port should be bound.
 	Proxies      []*ProxiedService
+
+	// Listeners that route TLS connections to many services by SNI server name.
+	SniListeners []*SniListener
+
+	// Proxies created for every service in the consul catalog with a tag or meta key.
+	AutoProxies  []*AutoProxy
+
+	// The most connections open at once across every TCP proxy. 0 for no limit.
+	MaxConnections int
+
+	// The host:port to serve the status of the proxy on (via expvar at /debug/vars).
+	// Disabled if empty.
+	StatusAddress string
+
+	// where the config was read from when it is read from the consul KV store,
+	// so that it can be watched for changes. nil otherwise
+	kvSource *KvConfigSource
+}
+
+/**
+ * Whether any of the proxies discover their backends using consul
+ */
+func (cpc *ConsulProxyConfig) usesConsul() bool {
+	for _, proxy := range cpc.Proxies {
+		if proxy.Discovery == "" || proxy.Discovery == DiscoveryConsul || proxy.SplitWeightsKey != "" {
+			return true
+		}
+	}
+	for _, listener := range cpc.SniListeners {
+		if listener.Discovery == "" || listener.Discovery == DiscoveryConsul {
+			return true
+		}
+	}
+	return len(cpc.AutoProxies) != 0
 }
 
 func (cpc *ConsulProxyConfig) String() string {
-	return fmt.Sprint("DnsServers: ", cpc.ConsulServer.DnsServer, ", Consul Server: ", cpc.ConsulServer.Address, ", Proxies: ", cpc.Proxies)
+	return fmt.Sprint("DnsServers: ", cpc.ConsulServer.DnsServer, ", Consul Server: ", cpc.ConsulServer.Address, ", Proxies: ", cpc.Proxies, ", SNI Listeners: ", len(cpc.SniListeners), ", Auto Proxies: ", len(cpc.AutoProxies))
 }
 
 
@@ -85,13 +478,20 @@ func readJson(file string) (*ConsulProxyConfig, error) {
 }
 
 func parseConfig(data []byte) *ConsulProxyConfig {
-	var config ConsulProxyConfig
-	marshalErr := json.Unmarshal(data, &config)
+	config, marshalErr := unmarshalConfig(data)
 	if marshalErr != nil {
 		log.Fatal("Error reading config file", marshalErr)
 		os.Exit(1)
 	}
-	return &config
+	return config
+}
+
+func unmarshalConfig(data []byte) (*ConsulProxyConfig, error) {
+	var config ConsulProxyConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
 }
 
 /**
@@ -107,17 +507,24 @@ type ProxiedServiceList struct {
  *
  * Note: The format is '0.0.0.0:1234/my-service/dc1'
  *     where
- *       '0.0.0.0' is optional and specifies the interface to bind to
+ *       '0.0.0.0' is optional and specifies the interface to bind to. IPv6 addresses
+ *             must be enclosed in brackets, e.g. '[::1]:1234/my-service'
  *       '1234' is the port to bind on
  *       'my-service' is the service name
  *       'dc1' is optional, and is the datacenter to lookup the service in. If not specified the default is used
  *             which is the datacenter where the consul server being used is running.
+ *
+ * Or 'unix:/run/my-service.sock/my-service/dc1' to listen on a unix socket, where the
+ * socket path must end in '.sock' so it can be distinguished from the service name.
  */
 func (v *ProxiedServiceList) Set(value string) error {
+	if strings.HasPrefix(value, "unix:") {
+		return v.setUnixSocket(value)
+	}
+
 	proxied := strings.Split(value, "/")
 	if len(proxied) < 2 || len(proxied) > 3 {
-		log.Println("Proxied service", proxied, "has an invalid format")
-		os.Exit(1)
+		return fmt.Errorf("proxied service %s has an invalid format", value)
 	}
 
 	serviceName := proxied[1]
@@ -126,27 +533,18 @@ func (v *ProxiedServiceList) Set(value string) error {
 		datacenter = proxied[2];
 	}
 
-	var localIP string
-	var localPort string
-	local := strings.Split(proxied[0], ":")
-
-	if len(local) != 2 {
-		log.Println("Proxied service", proxied, "has an invalid format")
-		os.Exit(1)
+	localIP, localPort, err := net.SplitHostPort(proxied[0])
+	if err != nil {
+		return fmt.Errorf("proxied service %s has an invalid format - %s", value, err)
 	}
 
-	if local[0] == "" {
+	if localIP == "" {
 		localIP = "localhost"
-		localPort = local[1]
-	} else {
-		localIP = local[0]
-		localPort = local[1]
 	}
 
 	port, err := strconv.Atoi(localPort)
 	if err != nil {
-		log.Println(proxied[1], "could not be parsed as a number")
-		os.Exit(1)
+		return fmt.Errorf("%s could not be parsed as a number", localPort)
 	}
 
 	values := v.values
@@ -161,6 +559,33 @@ func (v *ProxiedServiceList) Set(value string) error {
 	return nil
 }
 
+func (v *ProxiedServiceList) setUnixSocket(value string) error {
+	path := strings.TrimPrefix(value, "unix:")
+	end := strings.Index(path, ".sock/")
+	if end == -1 {
+		return fmt.Errorf("proxied service %s has an invalid format, the socket path must end in .sock", value)
+	}
+
+	socket := path[:end + len(".sock")]
+	proxied := strings.Split(path[end + len(".sock/"):], "/")
+	if len(proxied) > 2 || proxied[0] == "" {
+		return fmt.Errorf("proxied service %s has an invalid format", value)
+	}
+
+	var datacenter string
+	if len(proxied) == 2 {
+		datacenter = proxied[1]
+	}
+
+	v.values = append(v.values, &ProxiedService{
+		ServiceName: proxied[0],
+		Datacenter: datacenter,
+		LocalSocket: socket,
+	})
+
+	return nil
+}
+
 func (v *ProxiedServiceList) String() string {
 	return fmt.Sprintf("%v", *v)
 }
@@ -183,10 +608,16 @@ func configuration() *ConsulProxyConfig {
 type CliArgs struct {
 	services ProxiedServiceList
 	configFile string
+	configKvKey string
 	consulServerOverride string
 	consulDnsName string
 	dnsServer string
 	dnsPort string
+	resolvConf string
+	cacheDir string
+	cacheMaxStaleSec int
+	statusAddress string
+	maxConnections int
 }
 
 /**
@@ -196,13 +627,19 @@ type CliArgs struct {
 func parseCommandLine() *CliArgs {
 	var args CliArgs
 
-	flag.Var(&args.services, "service", "The consul services to proxy in the format :{port-on-localhost}/{service-name}/{datacenter}. This flag can be specified multiple times to proxy multiple services.")
+	flag.Var(&args.services, "service", "The consul services to proxy in the format :{port-on-localhost}/{service-name}/{datacenter}, or unix:{socket-path}.sock/{service-name}/{datacenter}. This flag can be specified multiple times to proxy multiple services.")
 
 	flag.StringVar(&args.configFile, "config-file", "", "The fully qualified path the json configuration file specifying the services to proxy")
+	flag.StringVar(&args.configKvKey, "config-kv-key", "", "The consul KV key holding the json configuration, which is watched for changes. A prefix ending in '/' combines the configuration in every key under it")
 	flag.StringVar(&args.consulServerOverride, "consul-server-override", "", "The host:port where the consul ReST API that should be used for discovery is running")
 	flag.StringVar(&args.consulDnsName, "consul-dns-name", "", "The DNS name used to lookup the consul server")
-	flag.StringVar(&args.dnsServer, "dns-server", "", "The DNS server that is used to discover consul")
+	flag.StringVar(&args.dnsServer, "dns-server", "", "The DNS server that is used to discover consul. A comma separated list of servers may be given, which are tried in turn")
+	flag.StringVar(&args.resolvConf, "resolv-conf", "", "The resolver configuration file, e.g. /etc/resolv.conf, used to discover consul")
 	flag.StringVar(&args.dnsPort, "dns-port", "", "The port used when making a DNS query to the specified DNS server")
+	flag.StringVar(&args.cacheDir, "cache-dir", "", "The directory the last known endpoints are persisted to, so they can be served when consul is unreachable")
+	flag.IntVar(&args.cacheMaxStaleSec, "cache-max-stale", 0, "The maximum age in seconds of endpoints served while consul is unreachable. 0 means no limit")
+	flag.StringVar(&args.statusAddress, "status-address", "", "The host:port to serve the proxy status on, at /debug/vars")
+	flag.IntVar(&args.maxConnections, "max-connections", 0, "The most connections open at once across every TCP proxy. 0 means no limit")
 
 	flag.Parse()
 
@@ -217,16 +654,16 @@ func interpretCommandLine(args *CliArgs) (*ConsulProxyConfig, error) {
 		return nil, errors.New("-config-file and -proxy-services cannot both be specified. Please use one or the other.")
 	}
 
-	if args.consulServerOverride != "" {
-		log.Println("Consul server has been overriden using configuration", args.consulServerOverride)
+	if args.configKvKey != "" && (args.configFile != "" || len(args.services.values) != 0) {
+		return nil, errors.New("-config-kv-key cannot be specified with -config-file or -proxy-services. Please use one or the other.")
 	}
 
-	if len(args.services.values) == 0 && args.configFile == "" {
-		return nil, errors.New("No proxied services specified. Please either specify -proxy-services or -config-file")
+	if args.consulServerOverride != "" {
+		log.Println("Consul server has been overriden using configuration", args.consulServerOverride)
 	}
 
-	if args.consulDnsName == "" && args.consulServerOverride == "" {
-		return nil, errors.New("Unable to find the consul server. Please either specify -consul-server-override or -consul-dns-name")
+	if len(args.services.values) == 0 && args.configFile == "" && args.configKvKey == "" {
+		return nil, errors.New("No proxied services specified. Please either specify -proxy-services, -config-file or -config-kv-key")
 	}
 
 	config := new(ConsulProxyConfig)
@@ -240,8 +677,43 @@ func interpretCommandLine(args *CliArgs) (*ConsulProxyConfig, error) {
 		}
 	}
 
+	if args.configKvKey != "" {
+		source, err := NewKvConfigSource(args)
+		if err != nil {
+			return nil, err
+		}
+
+		conf, index, err := source.read(0)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the configuration from consul key %s - %s", args.configKvKey, err)
+		}
+		source.index = index
+		config = conf
+		config.kvSource = source
+	}
+
+	return applyCommandLine(config, args)
+}
+
+/**
+ * Applies the command line args over the configuration read from the config file or
+ * consul KV store, and checks the result is complete
+ */
+func applyCommandLine(config *ConsulProxyConfig, args *CliArgs) (*ConsulProxyConfig, error) {
+	if config.ConsulServer == nil {
+		config.ConsulServer = new(ConsulServerConfig)
+	}
+
+	// the servers of the flag replace any in the configuration, including a list
+	// in 'DnsServers' which would otherwise take precedence
 	if args.dnsServer != "" {
-		config.ConsulServer.DnsServer = args.dnsServer
+		servers := strings.Split(args.dnsServer, ",")
+		config.ConsulServer.DnsServer = servers[0]
+		config.ConsulServer.DnsServers = servers
+	}
+
+	if args.resolvConf != "" {
+		config.ConsulServer.ResolvConf = args.resolvConf
 	}
 
 	if args.dnsPort != "" {
@@ -256,9 +728,29 @@ func interpretCommandLine(args *CliArgs) (*ConsulProxyConfig, error) {
 		config.ConsulServer.Address = args.consulServerOverride
 	}
 
+	if args.cacheDir != "" {
+		config.ConsulServer.CacheDir = args.cacheDir
+	}
+
+	if args.cacheMaxStaleSec != 0 {
+		config.ConsulServer.CacheMaxStaleSec = args.cacheMaxStaleSec
+	}
+
+	if args.statusAddress != "" {
+		config.StatusAddress = args.statusAddress
+	}
+
+	if args.maxConnections != 0 {
+		config.MaxConnections = args.maxConnections
+	}
+
 	if len(args.services.values) != 0 {
 		config.Proxies = args.services.values
 	}
 
+	if config.usesConsul() && config.ConsulServer.DnsName == "" && config.ConsulServer.Address == "" {
+		return nil, errors.New("Unable to find the consul server. Please either specify -consul-server-override or -consul-dns-name")
+	}
+
 	return config, nil
 }
\ No newline at end of file
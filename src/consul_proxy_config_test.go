@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -53,6 +54,22 @@ func TestInterpretCommandLine_Simple(t *testing.T) {
 	assertEqual(t, "prod-infra-rtp-consul-external.query.ibm", config.ConsulServer.DnsName, "DnsName")
 }
 
+func TestApplyCommandLine_DnsServerReplacesConfiguredServers(t *testing.T) {
+	config := &ConsulProxyConfig{
+		ConsulServer: &ConsulServerConfig{DnsServers: []string{"10.0.0.1", "10.0.0.2"}},
+		Proxies:      []*ProxiedService{{ServiceName: "foo", Discovery: "static", Endpoints: []string{"127.0.0.1:80"}}},
+	}
+
+	config, err := applyCommandLine(config, &CliArgs{dnsServer: "1.2.3.4"})
+	assertNil(t, err)
+	assertEqual(t, "1.2.3.4", config.ConsulServer.DnsServer, "DnsServer")
+	assertEqual(t, "1.2.3.4", strings.Join(config.ConsulServer.DnsServers, ","), "DnsServers")
+
+	config, err = applyCommandLine(config, &CliArgs{dnsServer: "1.2.3.4,5.6.7.8"})
+	assertNil(t, err)
+	assertEqual(t, "1.2.3.4,5.6.7.8", strings.Join(config.ConsulServer.DnsServers, ","), "DnsServers")
+}
+
 func TestInterpretCommandLine_NoServices(t *testing.T) {
 	args := CliArgs{
 		consulDnsName: "prod-infra-rtp-consul-external.query.ibm",
@@ -86,6 +103,30 @@ func TestInterpretCommandLine_CliServicesAndConfigFile(t *testing.T) {
 	}
 }
 
+func TestInterpretCommandLine_StaticDiscoveryDoesNotRequireConsul(t *testing.T) {
+	args := CliArgs{
+		services: ProxiedServiceList{
+			values: []*ProxiedService{
+				{
+					ServiceName: "foo",
+					Discovery: DiscoveryStatic,
+					Endpoints: []string{"1.2.3.4:1234"},
+				},
+			},
+		},
+	}
+
+	_, err := interpretCommandLine(&args)
+	assertNil(t, err)
+
+	args.services.values[0].Discovery = ""
+	_, err = interpretCommandLine(&args)
+
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
 func TestProxiedServiceList_Set_NoDatacenter(t *testing.T) {
 	// common format :{port}/{service-name}
 	list := &ProxiedServiceList{}
@@ -119,6 +160,41 @@ func TestProxiedServiceList_Set_WithBindPort(t *testing.T) {
 	assertEqual(t, 9092, list.values[0].LocalPort, "ServiceName")
 }
 
+func TestProxiedServiceList_Set_WithIPv6BindAddress(t *testing.T) {
+	list := &ProxiedServiceList{}
+	err := list.Set("[::1]:9090/my-service-name/dc1")
+	assertNil(t, err)
+	assertEqual(t, "::1", list.values[0].LocalIP, "LocalIP")
+	assertEqual(t, 9090, list.values[0].LocalPort, "LocalPort")
+	assertEqual(t, "my-service-name", list.values[0].ServiceName, "ServiceName")
+	assertEqual(t, "dc1", list.values[0].Datacenter, "Datacenter")
+	assertEqual(t, "[::1]:9090 -> Consul(my-service-name in datacenter dc1)", list.values[0].String(), "String")
+}
+
+func TestProxiedServiceList_Set_UnixSocket(t *testing.T) {
+	list := &ProxiedServiceList{}
+	assertNil(t, list.Set("unix:/run/svc.sock/my-service-name/dc1"))
+	assertNil(t, list.Set("unix:relative/other.sock/other-service"))
+
+	assertEqual(t, "/run/svc.sock", list.values[0].LocalSocket, "LocalSocket")
+	assertEqual(t, "my-service-name", list.values[0].ServiceName, "ServiceName")
+	assertEqual(t, "dc1", list.values[0].Datacenter, "Datacenter")
+	assertEqual(t, "relative/other.sock", list.values[1].LocalSocket, "relative LocalSocket")
+	assertEqual(t, "other-service", list.values[1].ServiceName, "ServiceName")
+	assertEqual(t, "", list.values[1].Datacenter, "Datacenter")
+
+	assertNotNil(t, list.Set("unix:/run/svc/my-service-name"))
+	assertNotNil(t, list.Set("unix:/run/svc.sock/"))
+	assertNotNil(t, list.Set("unix:/run/svc.sock/a/b/c"))
+}
+
+func TestProxiedServiceList_Set_InvalidFormat(t *testing.T) {
+	list := &ProxiedServiceList{}
+	assertNotNil(t, list.Set("9090/my-service-name"))
+	assertNotNil(t, list.Set(":not-a-port/my-service-name"))
+	assertNotNil(t, list.Set("::1:9090/my-service-name"))
+	assertNotNil(t, list.Set(":9090"))
+}
 
 func assertEqual(t *testing.T, expected interface{}, actual interface{}, message string) {
 	if expected != actual {
@@ -9,6 +9,9 @@ import (
 	"fmt"
 	consul "github.com/hashicorp/consul/api"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 )
 
 type TestHandler struct {}
@@ -71,6 +74,81 @@ func TestConsulProxy(t *testing.T) {
 	assertEqual(t, "Hello World! You have proxied to TestHandler at /", string(bodyBytes), "Proxied response")
 }
 
+/**
+ * Proxies from an IPv6 loopback listener to an IPv6 loopback backend
+ */
+func TestConsulProxy_IPv6(t *testing.T) {
+	backend, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available", err)
+	}
+	defer backend.Close()
+
+	go http.Serve(backend, TestHandler{})
+
+	proxyPort := getFreePort()
+	proxied := &ProxiedService{
+		ServiceName: "my-test-service",
+		LocalIP: "::1",
+		LocalPort: proxyPort,
+	}
+
+	discoverer, err := NewStaticDiscoverer("my-test-service", []string{backend.Addr().String()})
+	assertNil(t, err)
+
+	proxy := NewConsulProxy(proxied, discoverer)
+	go proxy.start()
+	time.Sleep(500 * time.Millisecond)
+
+	response, err := http.Get(fmt.Sprintf("http://[::1]:%v/ipv6", proxyPort))
+	assertNil(t, err)
+
+	bodyBytes, err := ioutil.ReadAll(response.Body)
+	assertNil(t, err)
+	assertEqual(t, "Hello World! You have proxied to TestHandler at /ipv6", string(bodyBytes), "Proxied response")
+}
+
+/**
+ * Proxies from a unix socket to an HTTP server
+ */
+func TestConsulProxy_UnixSocket(t *testing.T) {
+	listener, err := ListenAndServeWithClose(TestHandler{})
+	assertNil(t, err)
+	defer listener.Close()
+
+	dir, _ := ioutil.TempDir("", "consul-proxy-socket")
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "svc.sock")
+
+	proxied := &ProxiedService{
+		ServiceName: "my-test-service",
+		LocalSocket: socket,
+		SocketMode: "0600",
+	}
+
+	discoverer, err := NewStaticDiscoverer("my-test-service", []string{listener.Addr().String()})
+	assertNil(t, err)
+
+	proxy := NewConsulProxy(proxied, discoverer)
+	go proxy.start()
+	time.Sleep(500 * time.Millisecond)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+
+	response, err := client.Get("http://unix/socket")
+	assertNil(t, err)
+
+	bodyBytes, err := ioutil.ReadAll(response.Body)
+	assertNil(t, err)
+	assertEqual(t, "Hello World! You have proxied to TestHandler at /socket", string(bodyBytes), "Proxied response")
+}
+
 func ListenAndServeWithClose(handler http.Handler) (net.Listener, error) {
 
 	var listener net.Listener
@@ -125,3 +203,65 @@ func getFreePort() int {
 	l.Close()
 	return port
 }
+
+func TestConsulProxy_stop(t *testing.T) {
+	proxyPort := getFreePort()
+	proxied := &ProxiedService{
+		ServiceName: "my-service",
+		LocalIP:     "127.0.0.1",
+		LocalPort:   proxyPort,
+	}
+
+	discoverer, err := NewStaticDiscoverer("my-service", []string{"127.0.0.1:1"})
+	assertNil(t, err)
+	proxy := NewConsulProxy(proxied, discoverer)
+
+	stopped := make(chan bool)
+	go func() {
+		proxy.start()
+		stopped <- true
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	proxy.stop()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the proxy to stop")
+	}
+
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(proxyPort)))
+	assertNotNil(t, err)
+}
+
+func TestConsulProxy_start_PortInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNil(t, err)
+	defer listener.Close()
+
+	proxied := &ProxiedService{
+		ServiceName: "my-service",
+		LocalIP:     "127.0.0.1",
+		LocalPort:   listener.Addr().(*net.TCPAddr).Port,
+	}
+	discoverer, err := NewStaticDiscoverer("my-service", []string{"127.0.0.1:1"})
+	assertNil(t, err)
+	proxy := NewConsulProxy(proxied, discoverer)
+
+	assertNotNil(t, proxy.start())
+	proxy.stop()
+}
+
+func TestConsulProxy_start_UnresolvableAddress(t *testing.T) {
+	proxied := &ProxiedService{
+		ServiceName: "my-service",
+		LocalIP:     "127.0.0.1",
+		LocalPort:   70000,
+	}
+	discoverer, err := NewStaticDiscoverer("my-service", []string{"127.0.0.1:1"})
+	assertNil(t, err)
+	proxy := NewConsulProxy(proxied, discoverer)
+
+	assertNotNil(t, proxy.start())
+	proxy.stop()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+/**
+ * This file contains the copy engine of the data path, which moves data between
+ * connections without copying it through user space where the platform allows,
+ * and through pooled buffers otherwise.
+ */
+
+// the size of the pooled buffers, the same as the buffers io.Copy allocates
+const copyBufferSize = 32 * 1024
+
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, copyBufferSize)
+		return &buffer
+	},
+}
+
+/**
+ * Copies from src to dst until src reaches EOF or either fails, returning the number
+ * of bytes copied. Plain TCP connections are copied between with zero-copy where the
+ * platform supports it, e.g. splice(2) on Linux, and anything else through a pooled buffer
+ */
+func copyData(dst io.Writer, src io.Reader) (int64, error) {
+	if written, handled, err := zeroCopy(dst, src); handled {
+		return written, err
+	}
+	return bufferedCopy(dst, src)
+}
+
+/**
+ * Copies through a buffer from the pool, rather than letting io.Copy allocate one
+ */
+func bufferedCopy(dst io.Writer, src io.Reader) (int64, error) {
+	buffer := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buffer)
+
+	// hides any ReadFrom and WriteTo methods, which would allocate their own buffers
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *buffer)
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
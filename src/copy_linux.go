@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"net"
+	"syscall"
+)
+
+// the most bytes moved by each splice, the default capacity of a pipe
+const maxSpliceSize = 64 * 1024
+
+// SPLICE_F_MOVE | SPLICE_F_NONBLOCK, which the syscall package does not define
+const spliceFlags = 0x1 | 0x2
+
+/**
+ * Copies between TCP connections with splice(2), moving the data from the source
+ * socket into a pipe, and from the pipe into the destination socket, without it
+ * passing through user space. Returns false, having copied nothing, if either is
+ * not a TCP connection or the kernel does not support splicing them.
+ */
+func zeroCopy(dst io.Writer, src io.Reader) (int64, bool, error) {
+	dstConn, ok := dst.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+	srcConn, ok := src.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+
+	dstRaw, err := dstConn.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	srcRaw, err := srcConn.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+
+	var written int64
+	for {
+		// the pipe is always empty here, so blocking means the source has no data yet
+		var n int
+		var spliceErr error
+		err := srcRaw.Read(func(fd uintptr) bool {
+			n, spliceErr = splice(int(fd), pipe[1], maxSpliceSize)
+			return spliceErr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = spliceErr
+		}
+		if err != nil {
+			if written == 0 && (err == syscall.EINVAL || err == syscall.ENOSYS) {
+				return 0, false, nil
+			}
+			return written, true, err
+		}
+		if n == 0 {
+			return written, true, nil
+		}
+
+		// the pipe holds data here, so blocking means the destination is full
+		for pending := n; pending > 0; {
+			var m int
+			err := dstRaw.Write(func(fd uintptr) bool {
+				m, spliceErr = splice(pipe[0], int(fd), pending)
+				return spliceErr != syscall.EAGAIN
+			})
+			if err == nil {
+				err = spliceErr
+			}
+			if err != nil {
+				return written, true, err
+			}
+			pending -= m
+			written += int64(m)
+		}
+	}
+}
+
+/**
+ * Splices up to 'size' bytes, retrying if interrupted
+ */
+func splice(in int, out int, size int) (int, error) {
+	for {
+		n, err := syscall.Splice(in, nil, out, nil, size, spliceFlags)
+		if err != syscall.EINTR {
+			return int(n), err
+		}
+	}
+}
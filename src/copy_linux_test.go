@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestZeroCopy_Tcp(t *testing.T) {
+	data := randomData(3*maxSpliceSize + 7)
+	received := copyThroughTcp(t, data, func(dst io.Writer, src io.Reader) (int64, error) {
+		written, handled, err := zeroCopy(dst, src)
+		assertEqual(t, true, handled, "TCP connections spliced")
+		return written, err
+	})
+	assertEqual(t, true, bytes.Equal(data, received), "data spliced intact")
+}
+
+func TestZeroCopy_NotTcp(t *testing.T) {
+	var out bytes.Buffer
+	_, handled, _ := zeroCopy(&out, bytes.NewReader([]byte("hello")))
+	assertEqual(t, false, handled, "only TCP connections are spliced")
+}
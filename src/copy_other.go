@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "io"
+
+/**
+ * Zero-copy is only supported on Linux, so everything is copied through buffers
+ */
+func zeroCopy(dst io.Writer, src io.Reader) (int64, bool, error) {
+	return 0, false, nil
+}
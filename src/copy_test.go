@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/**
+ * Both ends of a new TCP connection over the loopback interface
+ */
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+/**
+ * Sends the data through two TCP connections, copying it between them with 'copy',
+ * and returns what arrived at the other end
+ */
+func copyThroughTcp(t *testing.T, data []byte, copy func(dst io.Writer, src io.Reader) (int64, error)) []byte {
+	in, srcConn := tcpPair(t)
+	defer in.Close()
+	defer srcConn.Close()
+	dstConn, out := tcpPair(t)
+	defer dstConn.Close()
+	defer out.Close()
+
+	go func() {
+		in.Write(data)
+		in.CloseWrite()
+	}()
+
+	copied := make(chan int64)
+	go func() {
+		written, err := copy(dstConn, srcConn)
+		assertNil(t, err)
+		dstConn.CloseWrite()
+		copied <- written
+	}()
+
+	out.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, err := ioutil.ReadAll(out)
+	assertNil(t, err)
+	assertEqual(t, int64(len(data)), <-copied, "bytes copied")
+	return received
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestCopyData_Tcp(t *testing.T) {
+	data := randomData(5*copyBufferSize + 123)
+	received := copyThroughTcp(t, data, copyData)
+	assertEqual(t, true, bytes.Equal(data, received), "data copied intact")
+}
+
+func TestCopyData_Buffered(t *testing.T) {
+	data := randomData(5*copyBufferSize + 123)
+	received := copyThroughTcp(t, data, func(dst io.Writer, src io.Reader) (int64, error) {
+		// the activity reader prevents zero-copy
+		return copyData(dst, &activityReader{reader: src, touch: func() {}})
+	})
+	assertEqual(t, true, bytes.Equal(data, received), "data copied intact")
+}
+
+func TestCopyData_NotConnections(t *testing.T) {
+	var out bytes.Buffer
+	written, err := copyData(&out, bytes.NewReader([]byte("hello")))
+	assertNil(t, err)
+	assertEqual(t, int64(5), written, "bytes copied")
+	assertEqual(t, "hello", out.String(), "copied")
+}
+
+/**
+ * Copies b.N chunks of data between two TCP connections with 'copy', reporting the
+ * throughput and allocations
+ */
+func benchmarkCopy(b *testing.B, chunkSize int, copy func(dst io.Writer, src io.Reader) (int64, error)) {
+	in, srcConn := tcpPair(b)
+	defer in.Close()
+	defer srcConn.Close()
+	dstConn, out := tcpPair(b)
+	defer dstConn.Close()
+	defer out.Close()
+
+	chunk := randomData(chunkSize)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			in.Write(chunk)
+		}
+		in.CloseWrite()
+	}()
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, out)
+		close(drained)
+	}()
+
+	b.SetBytes(int64(chunkSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	copy(dstConn, srcConn)
+	dstConn.CloseWrite()
+	<-drained
+}
+
+func BenchmarkCopy(b *testing.B) {
+	copies := []struct {
+		name string
+		copy func(dst io.Writer, src io.Reader) (int64, error)
+	}{
+		{"io.Copy", func(dst io.Writer, src io.Reader) (int64, error) {
+			return io.Copy(writerOnly{dst}, readerOnly{src})
+		}},
+		{"buffered", bufferedCopy},
+		{"copyData", copyData},
+	}
+
+	for _, c := range copies {
+		for _, size := range []int{1024, 64 * 1024} {
+			b.Run(c.name+"/"+strconv.Itoa(size), func(b *testing.B) {
+				benchmarkCopy(b, size, c.copy)
+			})
+		}
+	}
+}
+
+/**
+ * Proxies a new connection to an echo server each iteration, sending a request and
+ * reading back the response, to measure the allocations of each connection
+ */
+func benchmarkProxyConnection(b *testing.B, timeouts connectionTimeouts) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	request := randomData(16 * 1024)
+	response := make([]byte, len(request))
+
+	// each connection is logged
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	b.SetBytes(int64(len(request)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, accepted := tcpPair(b)
+		done := make(chan struct{})
+		go func() {
+			proxyConnection(accepted, backend.Addr().String(), "", timeouts, nil)
+			close(done)
+		}()
+
+		client.Write(request)
+		client.CloseWrite()
+		if _, err := io.ReadFull(client, response); err != nil {
+			b.Fatal(err)
+		}
+		<-done
+		client.Close()
+	}
+}
+
+func BenchmarkProxyConnection(b *testing.B) {
+	b.Run("zero-copy", func(b *testing.B) {
+		benchmarkProxyConnection(b, connectionTimeouts{})
+	})
+	b.Run("buffered", func(b *testing.B) {
+		// tracking the activity for the idle timeout prevents zero-copy
+		benchmarkProxyConnection(b, connectionTimeouts{idle: time.Minute})
+	})
+}
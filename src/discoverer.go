@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/**
+ * This file contains the abstraction over how the backends of a proxy are discovered,
+ * along with the implementations that do not depend on consul.
+ */
+
+/**
+ * Provides the dynamically updating set of backend endpoints for a proxy.
+ */
+type Discoverer interface {
+	// performs the initial discovery, and starts updating the endpoints
+	// in the background. Blocks until endpoints are available.
+	start()
+
+	// the current set of endpoints
+	getEndpoints() []*Endpoint
+
+	// the name of the service being discovered, used for logging
+	name() string
+
+	// stops updating the endpoints, e.g. when the proxy is removed from the config
+	stop()
+}
+
+/**
+ * Signals background work to stop. The zero value is ready to use
+ */
+type stopper struct {
+	ch   chan struct{}
+	once sync.Once
+	mu   sync.Mutex
+}
+
+/**
+ * Closed once stop has been called
+ */
+func (s *stopper) done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	return s.ch
+}
+
+func (s *stopper) stop() {
+	s.done()
+	s.once.Do(func() { close(s.ch) })
+}
+
+/**
+ * Waits for the duration, returning false if stop is called first
+ */
+func (s *stopper) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-s.done():
+		return false
+	}
+}
+
+const (
+	DiscoveryConsul = "consul"
+	DiscoveryStatic = "static"
+	DiscoveryFile   = "file"
+	DiscoveryDns    = "dns"
+)
+
+/**
+ * Creates the discoverer specified by the 'Discovery' setting of the proxied service,
+ * defaulting to the consul ReST API.
+ */
+func NewDiscoverer(service *ProxiedService, consulServer *ConsulServerConfig) (Discoverer, error) {
+	switch service.AddressFamily {
+	case "", AddressFamilyIPv4, AddressFamilyIPv6:
+	default:
+		return nil, fmt.Errorf("unknown address family '%s'", service.AddressFamily)
+	}
+
+	switch service.AddressPolicy {
+	case "", AddressPolicyService, AddressPolicyNode, AddressPolicyAuto,
+		AddressPolicyLan, AddressPolicyWan, "lan_ipv4", "wan_ipv4", "lan_ipv6", "wan_ipv6":
+	default:
+		return nil, fmt.Errorf("unknown address policy '%s'", service.AddressPolicy)
+	}
+
+	if service.ConfigEntries {
+		return NewConfigEntryDiscoverer(service, consulServer)
+	}
+	if len(service.Splits) != 0 {
+		return NewSplitDiscoverer(service, consulServer)
+	}
+
+	switch service.Discovery {
+	case "", DiscoveryConsul:
+		lookup := NewConsulTagLookup(service.ServiceName, service.ServiceTag, service.Datacenter, consulServer)
+		lookup.addressFamily = service.AddressFamily
+		lookup.addressPolicy = service.AddressPolicy
+		return lookup, nil
+	case DiscoveryDns:
+		dnsName := service.DnsName
+		if dnsName == "" && service.ServiceTag != "" {
+			dnsName = service.ServiceTag + "." + consulServiceDnsName(service.ServiceName, service.Datacenter)
+		}
+		return NewDnsDiscoverer(service.ServiceName, service.Datacenter, dnsName, consulServer)
+	case DiscoveryStatic:
+		return NewStaticDiscoverer(service.ServiceName, service.Endpoints)
+	case DiscoveryFile:
+		if service.EndpointsFile == "" {
+			return nil, errors.New("EndpointsFile must be specified for file discovery")
+		}
+		return NewFileDiscoverer(service.ServiceName, service.EndpointsFile), nil
+	default:
+		return nil, fmt.Errorf("unknown discovery type '%s'", service.Discovery)
+	}
+}
+
+/**
+ * Parses a list of endpoints in the host:port format
+ */
+func parseEndpoints(addresses []string) ([]*Endpoint, error) {
+	endpoints := make([]*Endpoint, len(addresses))
+	for i, address := range addresses {
+		endpoint, err := parseEndpoint(address)
+		if err != nil {
+			return nil, err
+		}
+		endpoints[i] = endpoint
+	}
+	return endpoints, nil
+}
+
+/**
+ * A fixed list of endpoints
+ */
+type StaticDiscoverer struct {
+	serviceName string
+	endpoints   []*Endpoint
+}
+
+/**
+ * serviceName - the name used to identify the service in logs
+ * addresses - the endpoints in the host:port format
+ */
+func NewStaticDiscoverer(serviceName string, addresses []string) (*StaticDiscoverer, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("Endpoints must be specified for static discovery")
+	}
+
+	endpoints, err := parseEndpoints(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StaticDiscoverer{
+		serviceName: serviceName,
+		endpoints:   endpoints,
+	}, nil
+}
+
+func (sd *StaticDiscoverer) start() {
+	log.Printf("Using static endpoints %s for service %s", sd.endpoints, sd.serviceName)
+}
+
+func (sd *StaticDiscoverer) getEndpoints() []*Endpoint {
+	return sd.endpoints
+}
+
+func (sd *StaticDiscoverer) name() string {
+	return sd.serviceName
+}
+
+func (sd *StaticDiscoverer) stop() {
+}
+
+/**
+ * Reads the endpoints from a JSON or YAML file containing a list of host:port strings,
+ * e.g. ["10.0.0.1:8080", "10.0.0.2:8080"]. The file is watched for changes.
+ *
+ * Files with a .yaml or .yml extension are parsed as YAML, anything else as JSON.
+ */
+type FileDiscoverer struct {
+	serviceName string
+	path        string
+
+	// the current set of endpoints, and the modification time of the file
+	// they were read from. Must be accessed under endpointsMu
+	endpoints   []*Endpoint
+	modified    time.Time
+	endpointsMu sync.Mutex
+
+	// How often to check the file for changes
+	pollIntervalSec time.Duration
+
+	stopping stopper
+}
+
+func NewFileDiscoverer(serviceName string, path string) *FileDiscoverer {
+	return &FileDiscoverer{
+		serviceName:     serviceName,
+		path:            path,
+		pollIntervalSec: 5,
+	}
+}
+
+/**
+ * Reads the file, then polls it for changes in the background. Blocks until the file
+ * has been read successfully.
+ */
+func (fd *FileDiscoverer) start() {
+	for !fd.reload() {
+		if !fd.stopping.sleep(fd.pollIntervalSec * time.Second) {
+			return
+		}
+	}
+
+	go func() {
+		for fd.stopping.sleep(fd.pollIntervalSec * time.Second) {
+			fd.reload()
+		}
+	}()
+}
+
+/**
+ * Re-reads the file if it has been modified since it was last read.
+ * Returns true if endpoints are available.
+ */
+func (fd *FileDiscoverer) reload() bool {
+	info, err := os.Stat(fd.path)
+	if err != nil {
+		log.Printf("Unable to read endpoints file %s - %s", fd.path, err)
+		return fd.loaded()
+	}
+
+	fd.endpointsMu.Lock()
+	unchanged := info.ModTime().Equal(fd.modified)
+	fd.endpointsMu.Unlock()
+	if unchanged {
+		return true
+	}
+
+	endpoints, err := readEndpointsFile(fd.path)
+	if err != nil {
+		log.Printf("Unable to read endpoints file %s - %s", fd.path, err)
+		return fd.loaded()
+	}
+
+	log.Printf("Read endpoints %s for service %s from %s", endpoints, fd.serviceName, fd.path)
+
+	fd.endpointsMu.Lock()
+	fd.endpoints = endpoints
+	fd.modified = info.ModTime()
+	fd.endpointsMu.Unlock()
+	return true
+}
+
+func (fd *FileDiscoverer) loaded() bool {
+	fd.endpointsMu.Lock()
+	defer fd.endpointsMu.Unlock()
+	return fd.endpoints != nil
+}
+
+func (fd *FileDiscoverer) getEndpoints() []*Endpoint {
+	fd.endpointsMu.Lock()
+	defer fd.endpointsMu.Unlock()
+	return fd.endpoints
+}
+
+func (fd *FileDiscoverer) name() string {
+	return fd.serviceName
+}
+
+func (fd *FileDiscoverer) stop() {
+	fd.stopping.stop()
+}
+
+func readEndpointsFile(path string) ([]*Endpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &addresses)
+	default:
+		err = json.Unmarshal(data, &addresses)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseEndpoints(addresses)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewDiscoverer_DefaultsToConsul(t *testing.T) {
+	service := &ProxiedService{ServiceName: "my-service", Datacenter: "dc1"}
+	discoverer, err := NewDiscoverer(service, &ConsulServerConfig{})
+
+	assertNil(t, err)
+	lookup, ok := discoverer.(*ConsulLookup)
+	assertEqual(t, true, ok, "ConsulLookup")
+	assertEqual(t, "dc1", lookup.datacenter, "datacenter")
+}
+
+func TestNewDiscoverer_Unknown(t *testing.T) {
+	service := &ProxiedService{ServiceName: "my-service", Discovery: "carrier-pigeon"}
+	_, err := NewDiscoverer(service, &ConsulServerConfig{})
+
+	assertNotNil(t, err)
+}
+
+func TestNewDiscoverer_UnknownAddressPolicy(t *testing.T) {
+	service := &ProxiedService{ServiceName: "my-service", AddressPolicy: "somewhere"}
+	_, err := NewDiscoverer(service, &ConsulServerConfig{})
+
+	assertNotNil(t, err)
+}
+
+func TestStaticDiscoverer(t *testing.T) {
+	service := &ProxiedService{
+		ServiceName: "my-service",
+		Discovery:   DiscoveryStatic,
+		Endpoints:   []string{"1.2.3.4:1234", "localhost:5678"},
+	}
+	discoverer, err := NewDiscoverer(service, &ConsulServerConfig{})
+	assertNil(t, err)
+
+	discoverer.start()
+	endpoints := discoverer.getEndpoints()
+	assertEqual(t, 2, len(endpoints), "len(endpoints)")
+	assertEqual(t, "1.2.3.4", endpoints[0].host, "endpoints[0].host")
+	assertEqual(t, 5678, endpoints[1].port, "endpoints[1].port")
+	assertEqual(t, "my-service", discoverer.name(), "name")
+}
+
+func TestStaticDiscoverer_InvalidEndpoint(t *testing.T) {
+	_, err := NewStaticDiscoverer("my-service", []string{"no-port-here"})
+	assertNotNil(t, err)
+}
+
+func TestFileDiscoverer_Json(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-endpoints")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "endpoints.json")
+	ioutil.WriteFile(path, []byte(`["1.2.3.4:1234"]`), 0644)
+
+	discoverer := NewFileDiscoverer("my-service", path)
+	discoverer.start()
+	assertEqual(t, "1.2.3.4:1234", discoverer.getEndpoints()[0].String(), "initial endpoints")
+
+	ioutil.WriteFile(path, []byte(`["5.6.7.8:5678", "9.9.9.9:9999"]`), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	discoverer.reload()
+
+	endpoints := discoverer.getEndpoints()
+	assertEqual(t, 2, len(endpoints), "len(endpoints)")
+	assertEqual(t, "5.6.7.8:5678", endpoints[0].String(), "updated endpoints")
+}
+
+func TestFileDiscoverer_Yaml(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-endpoints")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "endpoints.yaml")
+	ioutil.WriteFile(path, []byte("- 1.2.3.4:1234\n- 5.6.7.8:5678\n"), 0644)
+
+	discoverer := NewFileDiscoverer("my-service", path)
+	discoverer.start()
+
+	endpoints := discoverer.getEndpoints()
+	assertEqual(t, 2, len(endpoints), "len(endpoints)")
+	assertEqual(t, "5.6.7.8:5678", endpoints[1].String(), "endpoints[1]")
+}
+
+func TestFileDiscoverer_KeepsEndpointsOnInvalidUpdate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-endpoints")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "endpoints.json")
+	ioutil.WriteFile(path, []byte(`["1.2.3.4:1234"]`), 0644)
+
+	discoverer := NewFileDiscoverer("my-service", path)
+	discoverer.start()
+
+	ioutil.WriteFile(path, []byte(`not json`), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	discoverer.reload()
+
+	assertEqual(t, "1.2.3.4:1234", discoverer.getEndpoints()[0].String(), "endpoints")
+}
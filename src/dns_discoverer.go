@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+/**
+ * Discovers the backends of a service directly from consul's DNS interface using SRV queries,
+ * for environments where the consul HTTP API is not reachable.
+ */
+type DnsDiscoverer struct {
+	// the name of the service, used for logging
+	serviceName string
+
+	// the SRV name that is queried, e.g. my-service.service.dc1.consul
+	dnsName string
+
+	// the DNS server that is queried
+	dnsConfig *DnsClientConfig
+
+	// the current set of endpoints
+	// must be accessed under endpointsMu
+	endpoints   []*Endpoint
+	endpointsMu sync.Mutex
+
+	// the bounds on how often the SRV record is re-queried. The record TTL is
+	// used within these bounds, since consul defaults to a TTL of zero.
+	minRefresh time.Duration
+	maxRefresh time.Duration
+
+	querySrv func(string, *DnsClientConfig) ([]*SrvTarget, error)
+
+	stopping stopper
+}
+
+/**
+ * serviceName, datacenter - the consul service to discover
+ * dnsName - overrides the SRV name queried, which defaults to {service}.service.{datacenter}.consul
+ * consulServer - the DNS server settings used to make the query
+ */
+func NewDnsDiscoverer(serviceName string, datacenter string, dnsName string, consulServer *ConsulServerConfig) (*DnsDiscoverer, error) {
+	if dnsName == "" {
+		dnsName = consulServiceDnsName(serviceName, datacenter)
+	}
+
+	dnsConfig, err := dnsClientConfig(consulServer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DnsDiscoverer{
+		serviceName: serviceName,
+		dnsName:     dnsName,
+		dnsConfig:   dnsConfig,
+		minRefresh:  5 * time.Second,
+		maxRefresh:  5 * time.Minute,
+		querySrv:    querySrv,
+	}, nil
+}
+
+/**
+ * The name consul's DNS interface serves the SRV records of a service under
+ */
+func consulServiceDnsName(serviceName string, datacenter string) string {
+	if datacenter == "" {
+		return fmt.Sprintf("%s.service.consul", serviceName)
+	}
+	return fmt.Sprintf("%s.service.%s.consul", serviceName, datacenter)
+}
+
+/**
+ * Queries the SRV record until it succeeds, then re-queries it in the background
+ * once the TTL of the previous answer expires.
+ */
+func (dd *DnsDiscoverer) start() {
+	refresh, err := dd.refresh()
+	for err != nil {
+		if !dd.stopping.sleep(dd.minRefresh) {
+			return
+		}
+		refresh, err = dd.refresh()
+	}
+
+	go func() {
+		for dd.stopping.sleep(refresh) {
+			next, err := dd.refresh()
+			if err != nil {
+				refresh = dd.minRefresh
+			} else {
+				refresh = next
+			}
+		}
+	}()
+}
+
+/**
+ * Performs the SRV query, and updates the endpoints when it succeeds.
+ * Returns how long to wait before querying again.
+ */
+func (dd *DnsDiscoverer) refresh() (time.Duration, error) {
+	targets, err := dd.querySrv(dd.dnsName, dd.dnsConfig)
+	if err == nil && len(targets) == 0 {
+		err = fmt.Errorf("no SRV records found for %s", dd.dnsName)
+	}
+	if err != nil {
+		log.Printf("Error discovering service %s using DNS - %s", dd.serviceName, err)
+		return 0, err
+	}
+
+	endpoints := srvEndpoints(targets)
+	log.Printf("Discovered services %s using DNS", endpoints)
+
+	dd.endpointsMu.Lock()
+	dd.endpoints = endpoints
+	dd.endpointsMu.Unlock()
+
+	return dd.refreshInterval(targets), nil
+}
+
+/**
+ * The smallest TTL of the targets, within the refresh bounds
+ */
+func (dd *DnsDiscoverer) refreshInterval(targets []*SrvTarget) time.Duration {
+	refresh := dd.maxRefresh
+	for _, target := range targets {
+		if ttl := time.Duration(target.ttl) * time.Second; ttl < refresh {
+			refresh = ttl
+		}
+	}
+
+	if refresh < dd.minRefresh {
+		refresh = dd.minRefresh
+	}
+	return refresh
+}
+
+func (dd *DnsDiscoverer) getEndpoints() []*Endpoint {
+	dd.endpointsMu.Lock()
+	defer dd.endpointsMu.Unlock()
+	return dd.endpoints
+}
+
+func (dd *DnsDiscoverer) name() string {
+	return dd.serviceName
+}
+
+func (dd *DnsDiscoverer) stop() {
+	dd.stopping.stop()
+}
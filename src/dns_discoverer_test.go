@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConsulServiceDnsName(t *testing.T) {
+	assertEqual(t, "my-service.service.consul", consulServiceDnsName("my-service", ""), "no datacenter")
+	assertEqual(t, "my-service.service.dc1.consul", consulServiceDnsName("my-service", "dc1"), "datacenter")
+}
+
+func TestDnsDiscoverer_UsingMockDnsServer(t *testing.T) {
+	server := MockDnsServer{
+		answers: map[string][]string{
+			"my-service.service.dc1.consul.": {
+				"my-service.service.dc1.consul. 30 IN SRV 1 10 8080 node-a.node.dc1.consul.",
+				"my-service.service.dc1.consul. 30 IN SRV 1 20 8081 node-b.node.dc1.consul.",
+				"my-service.service.dc1.consul. 30 IN SRV 2 10 8082 node-c.node.dc1.consul.",
+			},
+		},
+		extras: map[string][]string{
+			"my-service.service.dc1.consul.": {
+				"node-b.node.dc1.consul. 20 IN A 10.0.0.2",
+				"node-a.node.dc1.consul. 10 IN A 10.0.0.1",
+				"node-a.node.dc1.consul. 10 IN AAAA ::1",
+			},
+		},
+	}
+
+	server.start()
+	defer server.stop()
+
+	config := &ConsulServerConfig{
+		DnsServer: "127.0.0.1",
+		DnsPort:   strconv.Itoa(server.port),
+	}
+
+	discoverer, err := NewDnsDiscoverer("my-service", "dc1", "", config)
+	assertNil(t, err)
+	refresh, err := discoverer.refresh()
+	assertNil(t, err)
+	assertEqual(t, 10*time.Second, refresh, "refresh")
+
+	endpoints := discoverer.getEndpoints()
+	assertEqual(t, 4, len(endpoints), "len(endpoints)")
+	assertEqual(t, "10.0.0.1", endpoints[0].host, "A record for node-a")
+	assertEqual(t, "::1", endpoints[1].host, "AAAA record for node-a")
+	assertEqual(t, uint16(10), endpoints[1].weight, "weight for node-a")
+	assertEqual(t, "10.0.0.2", endpoints[2].host, "A record for node-b")
+	assertEqual(t, 8081, endpoints[2].port, "port for node-b")
+	assertEqual(t, "node-c.node.dc1.consul", endpoints[3].host, "no additional record for node-c")
+	assertEqual(t, uint16(2), endpoints[3].priority, "priority for node-c")
+}
+
+func TestDnsDiscoverer_refreshInterval(t *testing.T) {
+	discoverer, _ := NewDnsDiscoverer("my-service", "", "", &ConsulServerConfig{})
+
+	assertEqual(t, 5*time.Second, discoverer.refreshInterval([]*SrvTarget{{ttl: 0}}), "min refresh")
+	assertEqual(t, 5*time.Minute, discoverer.refreshInterval([]*SrvTarget{{ttl: 3600}}), "max refresh")
+	assertEqual(t, 60*time.Second, discoverer.refreshInterval([]*SrvTarget{{ttl: 3600}, {ttl: 60}}), "smallest ttl")
+}
+
+func TestSelectEndpoint_LowestPriority(t *testing.T) {
+	endpoints := []*Endpoint{
+		{host: "low-priority", port: 1, priority: 2, weight: 100},
+		{host: "high-priority-a", port: 1, priority: 1, weight: 0},
+		{host: "high-priority-b", port: 1, priority: 1, weight: 1},
+	}
+
+	for i := 0; i < 20; i++ {
+		assertEqual(t, "high-priority-b", selectEndpoint(endpoints).host, "selected endpoint")
+	}
+}
+
+func TestSelectEndpoint_NoEndpoints(t *testing.T) {
+	if selectEndpoint(nil) != nil {
+		t.Fatal("Expected nil")
+	}
+}
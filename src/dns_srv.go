@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+/**
+ * This file contains the logic for resolving DNS SRV records
+ */
+
+/**
+ * Returned when a DNS server responds to a query with an error code,
+ * e.g. NXDOMAIN or SERVFAIL
+ */
+type DnsRcodeError struct {
+	// the name that was queried
+	Name  string
+	Rcode int
+}
+
+func (e *DnsRcodeError) Error() string {
+	return fmt.Sprintf("DNS query for %s failed with %s", e.Name, dns.RcodeToString[e.Rcode])
+}
+
+/**
+ * True if the queried name does not exist (NXDOMAIN)
+ */
+func (e *DnsRcodeError) NotFound() bool {
+	return e.Rcode == dns.RcodeNameError
+}
+
+/**
+ * True if the DNS server failed to process the query (SERVFAIL)
+ */
+func (e *DnsRcodeError) ServerFailure() bool {
+	return e.Rcode == dns.RcodeServerFailure
+}
+
+/**
+ * The DNS servers that are queried, and how they are queried
+ */
+type DnsClientConfig struct {
+	*dns.ClientConfig
+
+	// true when the servers are recursive resolvers, e.g. read from resolv.conf, rather
+	// than consul's own DNS interface, which does not need recursion
+	recursionDesired bool
+}
+
+/**
+ * A target returned by an SRV query, along with the addresses of the target
+ */
+type SrvTarget struct {
+	target   string
+	port     int
+	priority uint16
+	weight   uint16
+
+	// the A/AAAA addresses of the target
+	addresses []string
+
+	// the smallest TTL of the SRV record and its addresses
+	ttl uint32
+}
+
+/**
+ * Converts the targets into endpoints, one per address. Targets without
+ * any addresses use the target host name.
+ */
+func srvEndpoints(targets []*SrvTarget) []*Endpoint {
+	var endpoints []*Endpoint
+	for _, target := range targets {
+		hosts := target.addresses
+		if len(hosts) == 0 {
+			hosts = []string{strings.TrimSuffix(target.target, ".")}
+		}
+
+		for _, host := range hosts {
+			endpoints = append(endpoints, &Endpoint{
+				host:     host,
+				port:     target.port,
+				priority: target.priority,
+				weight:   target.weight,
+			})
+		}
+	}
+	return endpoints
+}
+
+/**
+ * The address of a DNS server, which may be given as a host, or as a host:port
+ * to override the port from the client config
+ */
+func dnsServerAddress(server string, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, port)
+}
+
+/**
+ * Sends the query to the servers specified in the client config over UDP, retrying
+ * over TCP if the response is truncated. Each server is tried in turn, up to the configured
+ * number of attempts, until one responds. Responses with an error code are returned
+ * as a DnsRcodeError, with SERVFAIL and REFUSED responses causing the next server to be tried.
+ */
+func exchange(query *dns.Msg, config *DnsClientConfig) (*dns.Msg, error) {
+	attempts := config.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	timeout := time.Duration(config.Timeout) * time.Second
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		for _, server := range config.Servers {
+			resp, err := exchangeWith(query, dnsServerAddress(server, config.Port), timeout)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+				lastErr = &DnsRcodeError{Name: query.Question[0].Name, Rcode: resp.Rcode}
+				continue
+			}
+
+			if resp.Rcode != dns.RcodeSuccess {
+				return nil, &DnsRcodeError{Name: query.Question[0].Name, Rcode: resp.Rcode}
+			}
+			return resp, nil
+		}
+	}
+	return nil, lastErr
+}
+
+func exchangeWith(query *dns.Msg, server string, timeout time.Duration) (*dns.Msg, error) {
+	client := &dns.Client{Net: "udp", Timeout: timeout}
+	resp, _, err := client.Exchange(query, server)
+	if err == nil && resp.Truncated {
+		client = &dns.Client{Net: "tcp", Timeout: timeout}
+		resp, _, err = client.Exchange(query, server)
+	}
+	return resp, err
+}
+
+/**
+ * Adds the A/AAAA records in the records to the addresses of the name they are for,
+ * tracking the smallest TTL of each name.
+ */
+func collectAddresses(records []dns.RR, addresses map[string][]string, ttls map[string]uint32) {
+	for _, record := range records {
+		var address string
+		switch rr := record.(type) {
+		case *dns.A:
+			address = rr.A.String()
+		case *dns.AAAA:
+			address = rr.AAAA.String()
+		default:
+			continue
+		}
+
+		name := strings.ToLower(record.Header().Name)
+		addresses[name] = append(addresses[name], address)
+		if ttl, ok := ttls[name]; !ok || record.Header().Ttl < ttl {
+			ttls[name] = record.Header().Ttl
+		}
+	}
+}
+
+/**
+ * Looks up the A and AAAA records of a SRV target that had no addresses in the
+ * additional section of the SRV response. Failures are ignored, leaving the target
+ * to be resolved when it is dialed.
+ */
+func resolveTarget(target string, config *DnsClientConfig, addresses map[string][]string, ttls map[string]uint32) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		query := new(dns.Msg)
+		query.SetQuestion(target, qtype)
+		query.RecursionDesired = config.recursionDesired
+
+		resp, err := exchange(query, config)
+		if err != nil {
+			continue
+		}
+		collectAddresses(resp.Answer, addresses, ttls)
+	}
+}
+
+/**
+ * Performs an SRV query for the specified domain name against the servers specified
+ * in the client config, qualifying the name with the configured search domains.
+ * Additional A/AAAA records are matched to the SRV targets by name, and targets without
+ * additional records are resolved with separate queries.
+ *
+ * Recursion is only requested from servers read from resolv.conf, as consul's DNS
+ * interface answers for its own domain.
+ */
+func querySrv(name string, config *DnsClientConfig) ([]*SrvTarget, error) {
+	var resp *dns.Msg
+	var err error
+	for _, candidate := range config.NameList(name) {
+		query := new(dns.Msg)
+		query.SetQuestion(candidate, dns.TypeSRV)
+		query.RecursionDesired = config.recursionDesired
+
+		resp, err = exchange(query, config)
+		if rcodeErr, ok := err.(*DnsRcodeError); ok && rcodeErr.NotFound() {
+			continue
+		}
+		if err != nil || len(resp.Answer) != 0 {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make(map[string][]string)
+	ttls := make(map[string]uint32)
+	collectAddresses(resp.Extra, addresses, ttls)
+
+	var targets []*SrvTarget
+	for _, record := range resp.Answer {
+		srv, ok := record.(*dns.SRV)
+		if !ok {
+			continue
+		}
+
+		name := strings.ToLower(srv.Target)
+		if ip := net.ParseIP(strings.TrimSuffix(name, ".")); ip != nil {
+			addresses[name] = []string{ip.String()}
+		} else if _, ok := addresses[name]; !ok {
+			resolveTarget(name, config, addresses, ttls)
+		}
+
+		ttl := srv.Hdr.Ttl
+		if addressTtl, ok := ttls[name]; ok && addressTtl < ttl {
+			ttl = addressTtl
+		}
+
+		targets = append(targets, &SrvTarget{
+			target:    srv.Target,
+			port:      int(srv.Port),
+			priority:  srv.Priority,
+			weight:    srv.Weight,
+			addresses: addresses[name],
+			ttl:       ttl,
+		})
+	}
+	return targets, nil
+}
+
+/**
+ * Looks up the specified domain name using an SRV DNS query to the server(s) specified
+ * in the client config.
+ *
+ * Returns all DNS answers in a host:port format
+ */
+func lookupSrv(address string, config *DnsClientConfig) ([]string, error) {
+	targets, err := querySrv(address, config)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []string{}
+	for _, endpoint := range srvEndpoints(targets) {
+		addrs = append(addrs, net.JoinHostPort(endpoint.host, strconv.Itoa(endpoint.port)))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func mockDnsClientConfig(server *MockDnsServer) *DnsClientConfig {
+	return &DnsClientConfig{ClientConfig: &dns.ClientConfig{
+		Servers: []string{"127.0.0.1"},
+		Port:    strconv.Itoa(server.port),
+	}}
+}
+
+func TestLookupSrv_MatchesAdditionalRecordsByName(t *testing.T) {
+	server := MockDnsServer{
+		answers: map[string][]string{
+			"consul.service.": {
+				"consul.service. 30 IN SRV 1 1 8500 node-a.",
+				"consul.service. 30 IN SRV 1 1 8501 node-b.",
+			},
+		},
+		extras: map[string][]string{
+			"consul.service.": {
+				"node-b. 30 IN AAAA 2001:db8::2",
+				"consul.service. 30 IN CNAME somewhere.else.",
+				"node-a. 30 IN A 10.0.0.1",
+			},
+		},
+	}
+	server.start()
+	defer server.stop()
+
+	results, err := lookupSrv("consul.service", mockDnsClientConfig(&server))
+
+	assertNil(t, err)
+	assertEqual(t, 2, len(results), "len(results)")
+	assertEqual(t, "10.0.0.1:8500", results[0], "A record")
+	assertEqual(t, "[2001:db8::2]:8501", results[1], "AAAA record")
+}
+
+func TestLookupSrv_ResolvesTargetsWithoutAdditionalRecords(t *testing.T) {
+	server := MockDnsServer{
+		answers: map[string][]string{
+			"consul.service.": {"consul.service. 30 IN SRV 1 1 8500 node-a."},
+			"node-a.":         {"node-a. 5 IN A 10.0.0.1"},
+		},
+	}
+	server.start()
+	defer server.stop()
+
+	targets, err := querySrv("consul.service", mockDnsClientConfig(&server))
+
+	assertNil(t, err)
+	assertEqual(t, 1, len(targets), "len(targets)")
+	assertEqual(t, "10.0.0.1", targets[0].addresses[0], "resolved address")
+	assertEqual(t, uint32(5), targets[0].ttl, "ttl")
+}
+
+func TestLookupSrv_RetriesTruncatedResponseOverTcp(t *testing.T) {
+	server := MockDnsServer{
+		truncate: true,
+		answers: map[string][]string{
+			"consul.service.": {"consul.service. 30 IN SRV 1 1 8500 10.0.0.1."},
+		},
+	}
+	server.start()
+	defer server.stop()
+
+	results, err := lookupSrv("consul.service", mockDnsClientConfig(&server))
+
+	assertNil(t, err)
+	assertEqual(t, 1, len(results), "len(results)")
+	assertEqual(t, "10.0.0.1:8500", results[0], "result")
+}
+
+func TestLookupSrv_TypedErrors(t *testing.T) {
+	server := MockDnsServer{
+		rcodes: map[string]int{
+			"missing.service.": dns.RcodeNameError,
+			"broken.service.":  dns.RcodeServerFailure,
+		},
+	}
+	server.start()
+	defer server.stop()
+
+	_, err := lookupSrv("missing.service", mockDnsClientConfig(&server))
+	rcodeErr, ok := err.(*DnsRcodeError)
+	assertEqual(t, true, ok, "DnsRcodeError")
+	assertEqual(t, true, rcodeErr.NotFound(), "NotFound")
+
+	_, err = lookupSrv("broken.service", mockDnsClientConfig(&server))
+	rcodeErr, ok = err.(*DnsRcodeError)
+	assertEqual(t, true, ok, "DnsRcodeError")
+	assertEqual(t, true, rcodeErr.ServerFailure(), "ServerFailure")
+}
+
+func TestDnsSrvLookup_NoRecords(t *testing.T) {
+	server := MockDnsServer{}
+	server.start()
+	defer server.stop()
+
+	_, err := dnsSrvLookup(mockDnsClientConfig(&server), "nothing.service")
+	assertNotNil(t, err)
+}
+
+func TestLookupSrv_FailsOverToNextServer(t *testing.T) {
+	server := MockDnsServer{
+		answers: map[string][]string{
+			"consul.service.": {"consul.service. 30 IN SRV 1 1 8500 10.0.0.1."},
+		},
+	}
+	server.start()
+	defer server.stop()
+
+	config := &DnsClientConfig{ClientConfig: &dns.ClientConfig{
+		Servers: []string{"127.0.0.1:" + strconv.Itoa(getFreePort()), "127.0.0.1"},
+		Port:    strconv.Itoa(server.port),
+		Timeout: 1,
+	}}
+	results, err := lookupSrv("consul.service", config)
+
+	assertNil(t, err)
+	assertEqual(t, "10.0.0.1:8500", results[0], "result")
+}
+
+func TestLookupSrv_SearchDomains(t *testing.T) {
+	server := MockDnsServer{
+		answers: map[string][]string{
+			"consul.service.dc1.consul.": {"consul.service.dc1.consul. 30 IN SRV 1 1 8500 10.0.0.1."},
+		},
+		rcodes: map[string]int{
+			"consul.service.": dns.RcodeNameError,
+		},
+	}
+	server.start()
+	defer server.stop()
+
+	config := mockDnsClientConfig(&server)
+	config.Search = []string{"dc1.consul"}
+	config.Ndots = 1
+	results, err := lookupSrv("consul.service", config)
+
+	assertNil(t, err)
+	assertEqual(t, "10.0.0.1:8500", results[0], "result")
+}
+
+func TestLookupSrv_RecursionDesired(t *testing.T) {
+	server := MockDnsServer{
+		answers: map[string][]string{
+			"consul.service.": {"consul.service. 30 IN SRV 1 1 8500 node-a."},
+			"node-a.":         {"node-a. 30 IN A 10.0.0.1"},
+		},
+	}
+	server.start()
+	defer server.stop()
+
+	config := mockDnsClientConfig(&server)
+	_, err := lookupSrv("consul.service", config)
+	assertNil(t, err)
+	assertEqual(t, false, server.queriedRecursively("consul.service."), "SRV query to consul")
+	assertEqual(t, false, server.queriedRecursively("node-a."), "A query to consul")
+
+	config.recursionDesired = true
+	_, err = lookupSrv("consul.service", config)
+	assertNil(t, err)
+	assertEqual(t, true, server.queriedRecursively("consul.service."), "SRV query to a resolver")
+	assertEqual(t, true, server.queriedRecursively("node-a."), "A query to a resolver")
+}
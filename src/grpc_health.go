@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/**
+ * This file contains a client for the gRPC health checking protocol, used to stop
+ * proxying to backends that report they are not serving.
+ *
+ * See https://github.com/grpc/grpc/blob/master/doc/health-checking.md
+ */
+
+// the gRPC status codes used by the proxy
+const (
+	grpcStatusOk          = 0
+	grpcStatusUnavailable = 14
+)
+
+// the SERVING value of HealthCheckResponse.ServingStatus
+const grpcHealthServing = 1
+
+/**
+ * Wraps a discoverer, hiding the endpoints that fail their gRPC health check.
+ * If every endpoint fails, all of them are returned rather than none, so that
+ * a broken health check does not take the whole service down.
+ */
+type GrpcHealthDiscoverer struct {
+	Discoverer
+
+	// the service name sent in the health check request
+	healthService string
+
+	// how often the endpoints are checked
+	interval time.Duration
+
+	// how long a single check may take
+	timeout time.Duration
+
+	// the endpoints, by host:port, that failed their last check
+	// must be accessed under unhealthyMu
+	unhealthy   map[string]bool
+	unhealthyMu sync.Mutex
+
+	// performs a single health check
+	check func(endpoint string) error
+
+	stopping stopper
+}
+
+/**
+ * discoverer - discovers the endpoints that are health checked
+ * transport - sends the health checks, which must be able to speak HTTP/2 to the backends
+ */
+func NewGrpcHealthDiscoverer(discoverer Discoverer, healthService string, interval time.Duration, transport http.RoundTripper) *GrpcHealthDiscoverer {
+	timeout := 5 * time.Second
+	if interval < timeout {
+		timeout = interval
+	}
+
+	hd := &GrpcHealthDiscoverer{
+		Discoverer:    discoverer,
+		healthService: healthService,
+		interval:      interval,
+		timeout:       timeout,
+		unhealthy:     make(map[string]bool),
+	}
+	hd.check = func(endpoint string) error {
+		return checkGrpcHealth(transport, endpoint, healthService, hd.timeout)
+	}
+	return hd
+}
+
+/**
+ * Starts the wrapped discoverer, checks the health of its endpoints, then keeps
+ * checking them in the background
+ */
+func (hd *GrpcHealthDiscoverer) start() {
+	hd.Discoverer.start()
+	hd.checkAll()
+
+	go func() {
+		for hd.stopping.sleep(hd.interval) {
+			hd.checkAll()
+		}
+	}()
+}
+
+/**
+ * Stops the health checks and the wrapped discoverer
+ */
+func (hd *GrpcHealthDiscoverer) stop() {
+	hd.stopping.stop()
+	hd.Discoverer.stop()
+}
+
+/**
+ * Checks every endpoint concurrently, recording which are unhealthy
+ */
+func (hd *GrpcHealthDiscoverer) checkAll() {
+	endpoints := hd.Discoverer.getEndpoints()
+
+	unhealthy := make(map[string]bool)
+	var unhealthyMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, endpoint := range endpoints {
+		address := endpoint.String()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := hd.check(address); err != nil {
+				unhealthyMu.Lock()
+				unhealthy[address] = true
+				unhealthyMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	hd.unhealthyMu.Lock()
+	for address := range unhealthy {
+		if !hd.unhealthy[address] {
+			log.Printf("Backend %s of service %s failed its gRPC health check", address, hd.name())
+		}
+	}
+	for address := range hd.unhealthy {
+		if !unhealthy[address] {
+			log.Printf("Backend %s of service %s passed its gRPC health check", address, hd.name())
+		}
+	}
+	hd.unhealthy = unhealthy
+	hd.unhealthyMu.Unlock()
+}
+
+/**
+ * The endpoints of the wrapped discoverer that passed their last health check
+ */
+func (hd *GrpcHealthDiscoverer) getEndpoints() []*Endpoint {
+	endpoints := hd.Discoverer.getEndpoints()
+
+	hd.unhealthyMu.Lock()
+	defer hd.unhealthyMu.Unlock()
+
+	var healthy []*Endpoint
+	for _, endpoint := range endpoints {
+		if !hd.unhealthy[endpoint.String()] {
+			healthy = append(healthy, endpoint)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return endpoints
+	}
+	return healthy
+}
+
+/**
+ * Calls grpc.health.v1.Health/Check on the endpoint, returning an error unless
+ * it reports that it is SERVING
+ */
+func checkGrpcHealth(transport http.RoundTripper, endpoint string, healthService string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	request, err := http.NewRequest("POST", "http://"+endpoint+"/grpc.health.v1.Health/Check",
+		bytes.NewReader(grpcFrame(healthCheckRequest(healthService))))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if status := grpcStatus(response); status != fmt.Sprint(grpcStatusOk) {
+		return fmt.Errorf("health check failed with gRPC status %s", status)
+	}
+
+	message, err := readGrpcFrame(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	servingStatus, err := healthCheckResponseStatus(message)
+	if err != nil {
+		return err
+	}
+	if servingStatus != grpcHealthServing {
+		return fmt.Errorf("health check returned serving status %d", servingStatus)
+	}
+	return nil
+}
+
+/**
+ * The grpc-status of the response, which is sent in the trailers, or in the
+ * headers of responses without a body
+ */
+func grpcStatus(response *http.Response) string {
+	if status := response.Trailer.Get("Grpc-Status"); status != "" {
+		return status
+	}
+	return response.Header.Get("Grpc-Status")
+}
+
+/**
+ * Encodes a grpc.health.v1.HealthCheckRequest, whose only field is the service name
+ */
+func healthCheckRequest(service string) []byte {
+	if service == "" {
+		return nil
+	}
+
+	var message bytes.Buffer
+	message.WriteByte(0x0A) // field 1, length delimited
+	message.Write(protoVarint(uint64(len(service))))
+	message.WriteString(service)
+	return message.Bytes()
+}
+
+/**
+ * Decodes the status field of a grpc.health.v1.HealthCheckResponse
+ */
+func healthCheckResponseStatus(message []byte) (uint64, error) {
+	reader := bytes.NewReader(message)
+
+	// UNKNOWN, the default when the field is not present
+	var status uint64
+	for reader.Len() > 0 {
+		key, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return 0, err
+		}
+
+		switch key & 0x7 {
+		case 0:
+			value, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return 0, err
+			}
+			if key>>3 == 1 {
+				status = value
+			}
+		case 2:
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := reader.Seek(int64(length), io.SeekCurrent); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("unexpected wire type %d in health check response", key&0x7)
+		}
+	}
+	return status, nil
+}
+
+func protoVarint(value uint64) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	return buffer[:binary.PutUvarint(buffer, value)]
+}
+
+/**
+ * Prefixes a message with the gRPC length-prefixed message header
+ */
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(message)))
+	copy(frame[5:], message)
+	return frame
+}
+
+/**
+ * Reads a single uncompressed length-prefixed gRPC message
+ */
+func readGrpcFrame(reader io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed gRPC messages are not supported")
+	}
+
+	message := make([]byte, binary.BigEndian.Uint32(header[1:5]))
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+/**
+ * Starts an h2c gRPC backend that responds to every RPC with its name, and to
+ * health checks with the given serving status
+ */
+func startGrpcBackend(name string, servingStatus uint64) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		ioutil.ReadAll(r.Body)
+
+		var message []byte
+		if r.URL.Path == "/grpc.health.v1.Health/Check" {
+			message = append([]byte{0x08}, protoVarint(servingStatus)...)
+		} else {
+			message = []byte(name)
+		}
+
+		w.Write(grpcFrame(message))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+/**
+ * An HTTP/2 client that connects without TLS
+ */
+func h2cTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network string, addr string, config *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+}
+
+/**
+ * Makes an RPC, returning the response message and gRPC status
+ */
+func callGrpc(t *testing.T, transport http.RoundTripper, address string) (string, string) {
+	request, err := http.NewRequest("POST", "http://"+address+"/test.Echo/Say", bytes.NewReader(grpcFrame(nil)))
+	assertNil(t, err)
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+
+	response, err := transport.RoundTrip(request)
+	assertNil(t, err)
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	assertNil(t, err)
+	if len(body) == 0 {
+		return "", grpcStatus(response)
+	}
+
+	message, err := readGrpcFrame(bytes.NewReader(body))
+	assertNil(t, err)
+	return string(message), grpcStatus(response)
+}
+
+func TestHealthCheckMessages(t *testing.T) {
+	assertEqual(t, 0, len(healthCheckRequest("")), "empty request")
+	assertEqual(t, "\x0a\x06orders", string(healthCheckRequest("orders")), "request with service")
+
+	status, err := healthCheckResponseStatus([]byte{0x08, 0x01})
+	assertNil(t, err)
+	assertEqual(t, uint64(1), status, "SERVING")
+
+	status, err = healthCheckResponseStatus(nil)
+	assertNil(t, err)
+	assertEqual(t, uint64(0), status, "UNKNOWN by default")
+
+	// an unknown length delimited field is skipped
+	status, err = healthCheckResponseStatus([]byte{0x12, 0x02, 'h', 'i', 0x08, 0x02})
+	assertNil(t, err)
+	assertEqual(t, uint64(2), status, "NOT_SERVING")
+}
+
+func TestCheckGrpcHealth(t *testing.T) {
+	serving := startGrpcBackend("serving", grpcHealthServing)
+	defer serving.Close()
+	notServing := startGrpcBackend("not-serving", 2)
+	defer notServing.Close()
+
+	assertNil(t, checkGrpcHealth(h2cTransport(), serving.Listener.Addr().String(), "", time.Second))
+	assertNotNil(t, checkGrpcHealth(h2cTransport(), notServing.Listener.Addr().String(), "", time.Second))
+	assertNotNil(t, checkGrpcHealth(h2cTransport(), "127.0.0.1:"+strconv.Itoa(getFreePort()), "", time.Second))
+}
+
+func TestGrpcHealthDiscoverer(t *testing.T) {
+	discoverer, err := NewStaticDiscoverer("orders", []string{"10.0.0.1:80", "10.0.0.2:80"})
+	assertNil(t, err)
+
+	failing := map[string]bool{"10.0.0.1:80": true}
+	hd := NewGrpcHealthDiscoverer(discoverer, "", time.Hour, nil)
+	hd.check = func(endpoint string) error {
+		if failing[endpoint] {
+			return errors.New("not serving")
+		}
+		return nil
+	}
+
+	hd.start()
+	assertEqual(t, "[10.0.0.2:80]", fmt.Sprint(hd.getEndpoints()), "unhealthy endpoint hidden")
+
+	failing["10.0.0.2:80"] = true
+	hd.checkAll()
+	assertEqual(t, 2, len(hd.getEndpoints()), "all endpoints returned when none are healthy")
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+/**
+ * Proxies HTTP requests, rather than TCP connections, so that each request can be
+ * routed to a service by its host, path or headers, and balanced across the backends
+ * of that service independently of the connection it arrived on.
+ *
+ * Connections to the backends are kept alive and pooled between requests.
+ *
+ * In 'http2' and 'grpc' mode clients may connect using HTTP/2 without TLS (h2c), and
+ * HTTP/2 is used to talk to the backends, so that each stream of a long lived HTTP/2
+ * connection, e.g. each RPC on a gRPC channel, is balanced independently.
+ */
+type HttpProxy struct {
+	// the bind interface, defaults to localhost
+	localIp string
+
+	// the port on local host to attach the proxy to
+	localPort int
+
+	// the unix socket to listen on instead of localIp/localPort, along with
+	// the file mode and ownership of the socket
+	localSocket string
+	socketMode  string
+	socketUser  string
+	socketGroup string
+
+	// the protocol proxied, 'http', 'http2' or 'grpc'
+	protocol string
+
+	// the routes to other services, checked in order
+	routes []*httpRoute
+
+	// handles looking up the backends of the service that requests
+	// not matching any route are proxied to
+	discoverer Discoverer
+
+	// pools the connections to the backends
+	transport http.RoundTripper
+
+	// how long an upgraded connection, e.g. a WebSocket, may go without any data
+	// being sent in either direction, and how long it may stay open. Zero for no limit
+	upgradeIdleTimeout time.Duration
+	upgradeMaxLifetime time.Duration
+
+	// how long a client may take to send the headers of a request, and the whole
+	// request, and how long a connection may wait for its next request
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	idleTimeout       time.Duration
+
+	listening proxyListener
+}
+
+/**
+ * Implemented by discoverers that choose the backends by the request, e.g. following
+ * a consul service-router
+ */
+type requestRouter interface {
+	// the discoverer of the backends the request is sent to, and the path it is sent with
+	routeRequest(request *http.Request) (Discoverer, string)
+}
+
+/**
+ * A route from the config, along with the discoverer of the service it routes to
+ */
+type httpRoute struct {
+	host       string
+	pathPrefix string
+	headers    map[string]string
+	discoverer Discoverer
+}
+
+/**
+ * Creates a new proxy that will listen on the local interface at port 'port', and
+ * proxy HTTP requests to the backends of the service or its routes.
+ *
+ * The proxy must be started once created
+ */
+func NewHttpProxy(service *ProxiedService, discoverer Discoverer, consulServer *ConsulServerConfig) (*HttpProxy, error) {
+	if service.GrpcHealthCheckIntervalSec > 0 && service.Protocol != ProtocolGrpc {
+		return nil, errors.New("gRPC health checks can only be used with the grpc protocol")
+	}
+	if service.GrpcHealthCheckIntervalSec > 0 && service.ConfigEntries {
+		return nil, errors.New("gRPC health checks cannot be combined with consul config entries")
+	}
+
+	transport := httpTransport(service.Protocol)
+
+	var routes []*httpRoute
+	for _, route := range service.HttpRoutes {
+		if route.ServiceName == "" {
+			return nil, errors.New("HTTP routes must specify a ServiceName")
+		}
+
+		routeDiscoverer, err := NewDiscoverer(routeService(service, route), consulServer)
+		if err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, &httpRoute{
+			host:       strings.ToLower(route.Host),
+			pathPrefix: route.PathPrefix,
+			headers:    route.Headers,
+			discoverer: routeDiscoverer,
+		})
+	}
+
+	if service.GrpcHealthCheckIntervalSec > 0 {
+		interval := time.Duration(service.GrpcHealthCheckIntervalSec) * time.Second
+		discoverer = NewGrpcHealthDiscoverer(discoverer, service.GrpcHealthService, interval, transport)
+		for _, route := range routes {
+			route.discoverer = NewGrpcHealthDiscoverer(route.discoverer, service.GrpcHealthService, interval, transport)
+		}
+	}
+
+	readHeaderTimeout := time.Duration(service.ReadHeaderTimeoutSec) * time.Second
+	if readHeaderTimeout <= 0 {
+		readHeaderTimeout = 10 * time.Second
+	}
+	idleTimeout := time.Duration(service.IdleTimeoutSec) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = 120 * time.Second
+	}
+
+	return &HttpProxy{
+		localIp:     service.LocalIP,
+		localPort:   service.LocalPort,
+		localSocket: service.LocalSocket,
+		socketMode:  service.SocketMode,
+		socketUser:  service.SocketUser,
+		socketGroup: service.SocketGroup,
+		protocol:    service.Protocol,
+		routes:      routes,
+		discoverer:  discoverer,
+		transport:   transport,
+
+		upgradeIdleTimeout: time.Duration(service.UpgradeIdleTimeoutSec) * time.Second,
+		upgradeMaxLifetime: time.Duration(service.UpgradeMaxLifetimeSec) * time.Second,
+		readHeaderTimeout:  readHeaderTimeout,
+		readTimeout:        time.Duration(service.ReadTimeoutSec) * time.Second,
+		idleTimeout:        idleTimeout,
+	}, nil
+}
+
+/**
+ * The transport used to send requests to the backends. HTTP/2 connections are
+ * made without TLS (h2c), and each is shared by many concurrent requests.
+ */
+func httpTransport(protocol string) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if protocol == ProtocolHttp2 || protocol == ProtocolGrpc {
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network string, addr string, config *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+			ReadIdleTimeout: 30 * time.Second,
+		}
+	}
+
+	return &http.Transport{
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        1024,
+		MaxIdleConnsPerHost: 64,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+/**
+ * True if the proxy speaks HTTP/2 to its backends
+ */
+func (proxy *HttpProxy) http2() bool {
+	return proxy.protocol == ProtocolHttp2 || proxy.protocol == ProtocolGrpc
+}
+
+/**
+ * The service a route proxies to, discovered in the same way as the proxy's own service
+ */
+func routeService(service *ProxiedService, route *HttpRoute) *ProxiedService {
+	routed := *service
+	routed.ServiceName = route.ServiceName
+	if route.Datacenter != "" {
+		routed.Datacenter = route.Datacenter
+	}
+	routed.Endpoints = route.Endpoints
+	routed.EndpointsFile = route.EndpointsFile
+	routed.DnsName = ""
+	routed.HttpRoutes = nil
+	return &routed
+}
+
+/**
+ * True if the request meets all of the conditions of the route
+ */
+func (route *httpRoute) matches(request *http.Request) bool {
+	if route.host != "" {
+		host := strings.ToLower(request.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if strings.HasPrefix(route.host, "*.") {
+			if !strings.HasSuffix(host, route.host[1:]) {
+				return false
+			}
+		} else if host != route.host {
+			return false
+		}
+	}
+
+	if !strings.HasPrefix(request.URL.Path, route.pathPrefix) {
+		return false
+	}
+
+	for name, value := range route.headers {
+		if request.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * The discoverer of the service the request is routed to, and the path it is sent with
+ */
+func (proxy *HttpProxy) route(request *http.Request) (Discoverer, string) {
+	for _, route := range proxy.routes {
+		if route.matches(request) {
+			return route.discoverer, request.URL.Path
+		}
+	}
+	if router, ok := proxy.discoverer.(requestRouter); ok {
+		return router.routeRequest(request)
+	}
+	return proxy.discoverer, request.URL.Path
+}
+
+/**
+ * Listens on the unix socket if one is configured, otherwise on the local TCP address
+ */
+func (proxy *HttpProxy) listen() (net.Listener, error) {
+	if proxy.localSocket != "" {
+		return listenUnixSocket(proxy.localSocket, proxy.socketMode, proxy.socketUser, proxy.socketGroup)
+	}
+	return net.Listen("tcp", net.JoinHostPort(proxy.localIp, strconv.Itoa(proxy.localPort)))
+}
+
+/**
+ * Starts up the proxy by discovering the backends of the service and its routes, then
+ * serving HTTP on the specified local port, or unix socket.
+ *
+ * Will loop indefinately as new requests are received
+ */
+func (proxy *HttpProxy) start() error {
+	proxy.discoverer.start()
+	for _, route := range proxy.routes {
+		route.discoverer.start()
+	}
+
+	listener, err := proxy.listen()
+	if err != nil {
+		return fmt.Errorf("unable to bind to the local interface - %s", err)
+	}
+
+	if !proxy.listening.set(listener) {
+		return nil
+	}
+
+	server := &http.Server{
+		Handler:           proxy,
+		ReadHeaderTimeout: proxy.readHeaderTimeout,
+		ReadTimeout:       proxy.readTimeout,
+		IdleTimeout:       proxy.idleTimeout,
+	}
+	if proxy.http2() {
+		// HTTP/2 connections take their timeouts from the server
+		server.Handler = h2c.NewHandler(proxy, &http2.Server{})
+	}
+
+	log.Println("Now listening on", listener.Addr(), "("+proxy.protocol+") for service", proxy.discoverer.name())
+	err = server.Serve(listener)
+	if proxy.listening.isStopped() {
+		log.Println("Stopped listening on", listener.Addr(), "for service", proxy.discoverer.name())
+		return nil
+	}
+	return err
+}
+
+/**
+ * Stops serving new connections, and stops discovering the backends of the service
+ * and its routes
+ */
+func (proxy *HttpProxy) stop() {
+	proxy.listening.stop()
+	proxy.discoverer.stop()
+	for _, route := range proxy.routes {
+		route.discoverer.stop()
+	}
+}
+
+/**
+ * Proxies a request to a backend of the service it is routed to. Upgrade requests
+ * are switched to a raw stream to the backend if the backend accepts them
+ */
+func (proxy *HttpProxy) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	discoverer, path := proxy.route(request)
+
+	endpoint := selectEndpoint(discoverer.getEndpoints())
+	if endpoint == nil {
+		log.Println("Unable to proxy request from", request.RemoteAddr, "-", errNoEndpoints(discoverer))
+		proxy.writeError(w, http.StatusServiceUnavailable, "no backends available for service "+discoverer.name())
+		return
+	}
+
+	if path != request.URL.Path {
+		request = request.Clone(request.Context())
+		request.URL.Path = path
+		request.URL.RawPath = ""
+	}
+
+	if isUpgradeRequest(request) {
+		proxy.serveUpgrade(w, request, endpoint)
+		return
+	}
+
+	reverseProxy := &httputil.ReverseProxy{
+		Transport: proxy.transport,
+		Director: func(outgoing *http.Request) {
+			outgoing.URL.Scheme = "http"
+			outgoing.URL.Host = endpoint.String()
+			setForwardedHeaders(outgoing, request)
+		},
+		ErrorHandler: func(w http.ResponseWriter, outgoing *http.Request, err error) {
+			log.Printf("Error proxying request for %s to %s - %s", request.URL.Path, endpoint, err)
+			proxy.writeError(w, http.StatusBadGateway, fmt.Sprintf("backend %s is unavailable", endpoint))
+		},
+	}
+	if proxy.http2() {
+		// stream responses, e.g. server streaming RPCs, as they arrive
+		reverseProxy.FlushInterval = -1
+	}
+	reverseProxy.ServeHTTP(w, request)
+}
+
+/**
+ * Responds with an error status. gRPC clients are sent the UNAVAILABLE gRPC status,
+ * in the trailers-only form, since they do not interpret HTTP status codes.
+ */
+func (proxy *HttpProxy) writeError(w http.ResponseWriter, status int, message string) {
+	if proxy.protocol == ProtocolGrpc {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", strconv.Itoa(grpcStatusUnavailable))
+		w.Header().Set("Grpc-Message", message)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+/**
+ * Adds the Forwarded (RFC 7239), X-Forwarded-Host and X-Forwarded-Proto headers
+ * describing the original request. X-Forwarded-For is added by the reverse proxy.
+ */
+func setForwardedHeaders(outgoing *http.Request, request *http.Request) {
+	proto := "http"
+	if request.TLS != nil {
+		proto = "https"
+	}
+
+	forwarded := "proto=" + proto
+	if request.Host != "" {
+		forwarded = "host=" + strconv.Quote(request.Host) + ";" + forwarded
+	}
+	if client, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		if strings.Contains(client, ":") {
+			client = strconv.Quote("[" + client + "]")
+		}
+		forwarded = "for=" + client + ";" + forwarded
+	}
+
+	if previous := strings.Join(request.Header["Forwarded"], ", "); previous != "" {
+		forwarded = previous + ", " + forwarded
+	}
+	outgoing.Header.Set("Forwarded", forwarded)
+
+	if outgoing.Header.Get("X-Forwarded-Host") == "" {
+		outgoing.Header.Set("X-Forwarded-Host", request.Host)
+	}
+	if outgoing.Header.Get("X-Forwarded-Proto") == "" {
+		outgoing.Header.Set("X-Forwarded-Proto", proto)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/**
+ * Starts an HTTP backend that responds with its name and the request path,
+ * counting the connections made to it
+ */
+func startHttpBackend(name string, connections *int32) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Forwarded", r.Header.Get("Forwarded"))
+		w.Header().Set("X-Seen-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+		fmt.Fprintf(w, "%s:%s", name, r.URL.Path)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(connections, 1)
+		}
+	}
+	server.Start()
+	return server
+}
+
+func get(t *testing.T, client *http.Client, url string, header http.Header) (*http.Response, string) {
+	request, err := http.NewRequest("GET", url, nil)
+	assertNil(t, err)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	response, err := client.Do(request)
+	assertNil(t, err)
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assertNil(t, err)
+	return response, string(body)
+}
+
+func TestHttpProxy_Routes(t *testing.T) {
+	var connections int32
+	web := startHttpBackend("web", &connections)
+	defer web.Close()
+	api := startHttpBackend("api", &connections)
+	defer api.Close()
+	admin := startHttpBackend("admin", &connections)
+	defer admin.Close()
+	canary := startHttpBackend("canary", &connections)
+	defer canary.Close()
+
+	proxyPort := getFreePort()
+	proxied := &ProxiedService{
+		ServiceName: "web",
+		LocalIP:     "127.0.0.1",
+		LocalPort:   proxyPort,
+		Protocol:    ProtocolHttp,
+		Discovery:   DiscoveryStatic,
+		HttpRoutes: []*HttpRoute{
+			{Headers: map[string]string{"X-Canary": "true"}, ServiceName: "canary", Endpoints: []string{canary.Listener.Addr().String()}},
+			{Host: "admin.example.com", ServiceName: "admin", Endpoints: []string{admin.Listener.Addr().String()}},
+			{PathPrefix: "/api/", ServiceName: "api", Endpoints: []string{api.Listener.Addr().String()}},
+		},
+	}
+
+	discoverer, err := NewStaticDiscoverer("web", []string{web.Listener.Addr().String()})
+	assertNil(t, err)
+	proxy, err := NewProxy(proxied, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	time.Sleep(200 * time.Millisecond)
+
+	base := "http://127.0.0.1:" + strconv.Itoa(proxyPort)
+	client := &http.Client{}
+
+	_, body := get(t, client, base+"/index.html", nil)
+	assertEqual(t, "web:/index.html", body, "default service")
+
+	_, body = get(t, client, base+"/api/orders", nil)
+	assertEqual(t, "api:/api/orders", body, "path prefix route")
+
+	request, _ := http.NewRequest("GET", base+"/users", nil)
+	request.Host = "Admin.Example.com:8080"
+	response, err := client.Do(request)
+	assertNil(t, err)
+	bodyBytes, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assertEqual(t, "admin:/users", string(bodyBytes), "host route")
+
+	response, body = get(t, client, base+"/api/orders", http.Header{"X-Canary": {"true"}})
+	assertEqual(t, "canary:/api/orders", body, "header route checked first")
+	assertEqual(t, "127.0.0.1", response.Header.Get("X-Seen-Forwarded-For"), "X-Forwarded-For")
+	assertEqual(t, `for=127.0.0.1;host="127.0.0.1:`+strconv.Itoa(proxyPort)+`";proto=http`,
+		response.Header.Get("X-Seen-Forwarded"), "Forwarded")
+
+	// requests are sent over pooled connections rather than one per request
+	for i := 0; i < 5; i++ {
+		get(t, client, base+"/index.html", nil)
+	}
+	assertEqual(t, int32(4), atomic.LoadInt32(&connections), "one connection per backend")
+}
+
+/**
+ * Each request is balanced across the backends, even when they arrive on the same connection
+ */
+func TestHttpProxy_PerRequestBalancing(t *testing.T) {
+	var connections int32
+	first := startHttpBackend("first", &connections)
+	defer first.Close()
+	second := startHttpBackend("second", &connections)
+	defer second.Close()
+
+	proxyPort := getFreePort()
+	discoverer, err := NewStaticDiscoverer("web", []string{first.Listener.Addr().String(), second.Listener.Addr().String()})
+	assertNil(t, err)
+	proxy, err := NewProxy(&ProxiedService{LocalIP: "127.0.0.1", LocalPort: proxyPort, Protocol: ProtocolHttp}, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	time.Sleep(200 * time.Millisecond)
+
+	client := &http.Client{}
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		_, body := get(t, client, "http://127.0.0.1:"+strconv.Itoa(proxyPort)+"/", nil)
+		seen[body] = true
+	}
+	assertEqual(t, 2, len(seen), "both backends used")
+}
+
+func TestHttpProxy_NoEndpoints(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	recorder := httptest.NewRecorder()
+
+	proxy := &HttpProxy{discoverer: &StaticDiscoverer{serviceName: "web"}}
+	proxy.ServeHTTP(recorder, request)
+	assertEqual(t, http.StatusServiceUnavailable, recorder.Code, "no backends")
+}
+
+func TestNewProxy_HttpRoutesRequireHttp(t *testing.T) {
+	discoverer, err := NewStaticDiscoverer("web", []string{"127.0.0.1:1"})
+	assertNil(t, err)
+
+	_, err = NewProxy(&ProxiedService{HttpRoutes: []*HttpRoute{{ServiceName: "api"}}}, discoverer, &ConsulServerConfig{})
+	assertNotNil(t, err)
+
+	_, err = NewProxy(&ProxiedService{Protocol: ProtocolHttp, HttpRoutes: []*HttpRoute{{}}}, discoverer, &ConsulServerConfig{})
+	assertNotNil(t, err)
+}
+
+/**
+ * Clients that are slow to send a request, or that keep a connection open without
+ * sending another, are disconnected
+ */
+func TestHttpProxy_Timeouts(t *testing.T) {
+	var connections int32
+	web := startHttpBackend("web", &connections)
+	defer web.Close()
+
+	proxyPort := getFreePort()
+	discoverer, err := NewStaticDiscoverer("web", []string{web.Listener.Addr().String()})
+	assertNil(t, err)
+	proxy, err := NewProxy(&ProxiedService{
+		ServiceName:          "web",
+		LocalIP:              "127.0.0.1",
+		LocalPort:            proxyPort,
+		Protocol:             ProtocolHttp,
+		ReadHeaderTimeoutSec: 1,
+		IdleTimeoutSec:       1,
+	}, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	defer proxy.stop()
+	time.Sleep(200 * time.Millisecond)
+
+	closed := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err := ioutil.ReadAll(conn)
+		return err == nil
+	}
+
+	// the headers of the request are never finished
+	slow, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(proxyPort))
+	assertNil(t, err)
+	defer slow.Close()
+	_, err = slow.Write([]byte("GET / HTTP/1.1\r\n"))
+	assertNil(t, err)
+	assertEqual(t, true, closed(slow), "slow client disconnected")
+
+	// a request is sent, then nothing else
+	idle, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(proxyPort))
+	assertNil(t, err)
+	defer idle.Close()
+	_, err = idle.Write([]byte("GET / HTTP/1.1\r\nHost: web\r\n\r\n"))
+	assertNil(t, err)
+	assertEqual(t, true, closed(idle), "idle client disconnected")
+}
+
+func TestNewProxy_ReadTimeoutsRequireHttp(t *testing.T) {
+	discoverer, err := NewStaticDiscoverer("web", []string{"127.0.0.1:1"})
+	assertNil(t, err)
+
+	_, err = NewProxy(&ProxiedService{ReadHeaderTimeoutSec: 5}, discoverer, &ConsulServerConfig{})
+	assertNotNil(t, err)
+
+	_, err = NewProxy(&ProxiedService{Protocol: ProtocolUdp, IdleTimeoutSec: 5}, discoverer, &ConsulServerConfig{})
+	assertNotNil(t, err)
+}
+
+/**
+ * Each RPC on a single HTTP/2 connection is balanced across the backends
+ */
+func TestHttpProxy_Grpc(t *testing.T) {
+	first := startGrpcBackend("first", grpcHealthServing)
+	defer first.Close()
+	second := startGrpcBackend("second", grpcHealthServing)
+	defer second.Close()
+
+	proxyPort := getFreePort()
+	discoverer, err := NewStaticDiscoverer("echo", []string{first.Listener.Addr().String(), second.Listener.Addr().String()})
+	assertNil(t, err)
+	proxy, err := NewProxy(&ProxiedService{LocalIP: "127.0.0.1", LocalPort: proxyPort, Protocol: ProtocolGrpc}, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	time.Sleep(200 * time.Millisecond)
+
+	transport := h2cTransport()
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		message, status := callGrpc(t, transport, "127.0.0.1:"+strconv.Itoa(proxyPort))
+		assertEqual(t, "0", status, "gRPC status")
+		seen[message] = true
+	}
+	assertEqual(t, 2, len(seen), "both backends used")
+}
+
+func TestHttpProxy_GrpcBackendUnavailable(t *testing.T) {
+	proxyPort := getFreePort()
+	discoverer, err := NewStaticDiscoverer("echo", []string{"127.0.0.1:" + strconv.Itoa(getFreePort())})
+	assertNil(t, err)
+	proxy, err := NewProxy(&ProxiedService{LocalIP: "127.0.0.1", LocalPort: proxyPort, Protocol: ProtocolGrpc}, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	time.Sleep(200 * time.Millisecond)
+
+	_, status := callGrpc(t, h2cTransport(), "127.0.0.1:"+strconv.Itoa(proxyPort))
+	assertEqual(t, strconv.Itoa(grpcStatusUnavailable), status, "UNAVAILABLE status")
+}
+
+func TestHttpProxy_GrpcHealthCheck(t *testing.T) {
+	healthy := startGrpcBackend("healthy", grpcHealthServing)
+	defer healthy.Close()
+	unhealthy := startGrpcBackend("unhealthy", 2)
+	defer unhealthy.Close()
+
+	proxyPort := getFreePort()
+	discoverer, err := NewStaticDiscoverer("echo", []string{healthy.Listener.Addr().String(), unhealthy.Listener.Addr().String()})
+	assertNil(t, err)
+	proxy, err := NewProxy(&ProxiedService{
+		LocalIP:                    "127.0.0.1",
+		LocalPort:                  proxyPort,
+		Protocol:                   ProtocolGrpc,
+		GrpcHealthCheckIntervalSec: 1,
+	}, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	time.Sleep(200 * time.Millisecond)
+
+	transport := h2cTransport()
+	for i := 0; i < 20; i++ {
+		message, _ := callGrpc(t, transport, "127.0.0.1:"+strconv.Itoa(proxyPort))
+		assertEqual(t, "healthy", message, "only healthy backend used")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * This file contains the handling of HTTP/1.1 Upgrade requests, e.g. WebSockets, which
+ * switch the connection to a raw bidirectional stream once the backend accepts them.
+ */
+
+/**
+ * True if the request asks to switch protocols, e.g. to a WebSocket
+ */
+func isUpgradeRequest(request *http.Request) bool {
+	if request.ProtoMajor != 1 || request.Header.Get("Upgrade") == "" {
+		return false
+	}
+
+	for _, value := range request.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/**
+ * Sends the upgrade request to the backend over a new connection. If the backend
+ * switches protocols, the client connection is taken over and data is copied in
+ * both directions until either side closes, the stream is idle for longer than the
+ * idle timeout, or the stream is open for longer than the max lifetime.
+ */
+func (proxy *HttpProxy) serveUpgrade(w http.ResponseWriter, request *http.Request, endpoint *Endpoint) {
+	backend, err := net.DialTimeout("tcp", endpoint.String(), 30*time.Second)
+	if err != nil {
+		log.Printf("Error proxying upgrade request for %s to %s - %s", request.URL.Path, endpoint, err)
+		proxy.writeError(w, http.StatusBadGateway, "backend "+endpoint.String()+" is unavailable")
+		return
+	}
+	defer backend.Close()
+
+	outgoing := request.Clone(request.Context())
+	outgoing.URL.Scheme = "http"
+	outgoing.URL.Host = endpoint.String()
+	setForwardedHeaders(outgoing, request)
+	if client, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		if previous := strings.Join(request.Header["X-Forwarded-For"], ", "); previous != "" {
+			client = previous + ", " + client
+		}
+		outgoing.Header.Set("X-Forwarded-For", client)
+	}
+
+	if err := outgoing.Write(backend); err != nil {
+		log.Printf("Error sending upgrade request for %s to %s - %s", request.URL.Path, endpoint, err)
+		proxy.writeError(w, http.StatusBadGateway, "backend "+endpoint.String()+" is unavailable")
+		return
+	}
+
+	backendReader := bufio.NewReader(backend)
+	response, err := http.ReadResponse(backendReader, outgoing)
+	if err != nil {
+		log.Printf("Error reading upgrade response for %s from %s - %s", request.URL.Path, endpoint, err)
+		proxy.writeError(w, http.StatusBadGateway, "backend "+endpoint.String()+" is unavailable")
+		return
+	}
+
+	// the backend refused to switch protocols, so its response is passed on as is
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		defer response.Body.Close()
+		for name, values := range response.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(response.StatusCode)
+		io.Copy(w, response.Body)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		proxy.writeError(w, http.StatusInternalServerError, "the connection cannot be upgraded")
+		return
+	}
+	client, clientBuffer, err := hijacker.Hijack()
+	if err != nil {
+		log.Println("Unable to upgrade connection from", request.RemoteAddr, "-", err)
+		return
+	}
+	defer client.Close()
+
+	// the read timeouts of the server apply to requests, not to the upgraded stream
+	client.SetDeadline(time.Time{})
+
+	if err := response.Write(client); err != nil {
+		return
+	}
+
+	log.Printf("Upgraded connection from %s to %s (%s)", request.RemoteAddr, endpoint, response.Header.Get("Upgrade"))
+	proxy.relayUpgraded(client, clientBuffer.Reader, backend, backendReader)
+	log.Printf("Upgraded connection from %s to %s was closed", request.RemoteAddr, endpoint)
+}
+
+/**
+ * Copies data in both directions between the client and backend of an upgraded
+ * connection, reading through the buffers that may already hold data from each.
+ * Blocks until both directions are done, or the stream times out.
+ */
+func (proxy *HttpProxy) relayUpgraded(client net.Conn, clientReader io.Reader, backend net.Conn, backendReader io.Reader) {
+	var lastActive int64
+	touch := func() { atomic.StoreInt64(&lastActive, time.Now().UnixNano()) }
+	touch()
+
+	done := make(chan struct{})
+	defer close(done)
+	go watchConnection(client, backend, proxy.upgradeIdleTimeout, proxy.upgradeMaxLifetime, &lastActive, done, "upgraded connection")
+
+	copied := make(chan struct{})
+	go func() {
+		copyData(backend, &activityReader{reader: clientReader, touch: touch})
+		closeWrite(backend)
+		close(copied)
+	}()
+	copyData(client, &activityReader{reader: backendReader, touch: touch})
+	closeWrite(client)
+	<-copied
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/**
+ * Starts a backend that accepts upgrades to the 'echo' protocol, echoing everything
+ * sent over the upgraded connection, and refuses other upgrades
+ */
+func startUpgradeBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "unsupported upgrade", http.StatusBadRequest)
+			return
+		}
+
+		conn, buffer, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n")
+		buffer.WriteString("X-Seen-Forwarded-For: " + r.Header.Get("X-Forwarded-For") + "\r\n\r\n")
+		buffer.Flush()
+		io.Copy(conn, buffer)
+	}))
+}
+
+/**
+ * Sends an upgrade request to the proxy, returning the connection and the response
+ */
+func upgrade(t *testing.T, proxyPort int, protocol string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(proxyPort))
+	assertNil(t, err)
+
+	_, err = conn.Write([]byte("GET /stream HTTP/1.1\r\nHost: dashboard\r\nConnection: keep-alive, Upgrade\r\nUpgrade: " + protocol + "\r\n\r\n"))
+	assertNil(t, err)
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	assertNil(t, err)
+	return conn, reader, response
+}
+
+func startUpgradeProxy(t *testing.T, backend *httptest.Server, service *ProxiedService) int {
+	proxyPort := getFreePort()
+	service.LocalIP = "127.0.0.1"
+	service.LocalPort = proxyPort
+	service.Protocol = ProtocolHttp
+
+	discoverer, err := NewStaticDiscoverer("dashboard", []string{backend.Listener.Addr().String()})
+	assertNil(t, err)
+	proxy, err := NewProxy(service, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	time.Sleep(200 * time.Millisecond)
+	return proxyPort
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	assertEqual(t, false, isUpgradeRequest(request), "plain request")
+
+	request.Header.Set("Upgrade", "websocket")
+	assertEqual(t, false, isUpgradeRequest(request), "no Connection: upgrade")
+
+	request.Header.Set("Connection", "keep-alive, Upgrade")
+	assertEqual(t, true, isUpgradeRequest(request), "upgrade request")
+}
+
+func TestHttpProxy_Upgrade(t *testing.T) {
+	backend := startUpgradeBackend()
+	defer backend.Close()
+	proxyPort := startUpgradeProxy(t, backend, &ProxiedService{})
+
+	conn, reader, response := upgrade(t, proxyPort, "echo")
+	defer conn.Close()
+	assertEqual(t, http.StatusSwitchingProtocols, response.StatusCode, "switched protocols")
+	assertEqual(t, "127.0.0.1", response.Header.Get("X-Seen-Forwarded-For"), "X-Forwarded-For")
+
+	for _, message := range []string{"ping", "pong"} {
+		_, err := conn.Write([]byte(message))
+		assertNil(t, err)
+
+		echoed := make([]byte, len(message))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = io.ReadFull(reader, echoed)
+		assertNil(t, err)
+		assertEqual(t, message, string(echoed), "echoed over upgraded connection")
+	}
+}
+
+func TestHttpProxy_UpgradeRefused(t *testing.T) {
+	backend := startUpgradeBackend()
+	defer backend.Close()
+	proxyPort := startUpgradeProxy(t, backend, &ProxiedService{})
+
+	conn, _, response := upgrade(t, proxyPort, "websocket")
+	defer conn.Close()
+	assertEqual(t, http.StatusBadRequest, response.StatusCode, "backend response passed on")
+}
+
+func TestHttpProxy_UpgradeIdleTimeout(t *testing.T) {
+	backend := startUpgradeBackend()
+	defer backend.Close()
+	proxyPort := startUpgradeProxy(t, backend, &ProxiedService{UpgradeIdleTimeoutSec: 1})
+
+	conn, reader, response := upgrade(t, proxyPort, "echo")
+	defer conn.Close()
+	assertEqual(t, http.StatusSwitchingProtocols, response.StatusCode, "switched protocols")
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err := reader.ReadByte()
+	assertEqual(t, io.EOF, err, "closed once idle")
+}
+
+func TestHttpProxy_UpgradeMaxLifetime(t *testing.T) {
+	backend := startUpgradeBackend()
+	defer backend.Close()
+	proxyPort := startUpgradeProxy(t, backend, &ProxiedService{UpgradeMaxLifetimeSec: 1})
+
+	conn, reader, _ := upgrade(t, proxyPort, "echo")
+	defer conn.Close()
+
+	// keep the stream active, so only the lifetime can close it
+	opened := time.Now()
+	var err error
+	for err == nil && time.Since(opened) < 3*time.Second {
+		conn.Write([]byte("x"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = reader.ReadByte()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assertEqual(t, io.EOF, err, "closed at max lifetime")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+/**
+ * This file contains the listening for, and accepting of, TCP connections
+ */
+
+// the longest time to wait before accepting, or reading, again after an error
+const maxAcceptDelay = time.Second
+
+/**
+ * Listens on the TCP address. With 'reusePort' the SO_REUSEPORT option is set, so that
+ * several listeners can bind the same address and the kernel balances new connections
+ * between them. A 'backlog' above 0 replaces the default length of the queue of
+ * connections waiting to be accepted.
+ */
+func listenTcp(address *net.TCPAddr, reusePort bool, backlog int) (net.Listener, error) {
+	config := net.ListenConfig{}
+	if reusePort {
+		config.Control = func(network string, address string, conn syscall.RawConn) error {
+			var err error
+			if controlErr := conn.Control(func(fd uintptr) { err = setReusePort(fd) }); controlErr != nil {
+				return controlErr
+			}
+			return err
+		}
+	}
+
+	listener, err := config.Listen(context.Background(), "tcp", address.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := setListenBacklog(listener, backlog); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+/**
+ * Changes the length of the queue of connections waiting to be accepted, if 'backlog'
+ * is above 0 and the platform supports it
+ */
+func setListenBacklog(listener net.Listener, backlog int) error {
+	if backlog <= 0 {
+		return nil
+	}
+	conn, ok := listener.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if controlErr := raw.Control(func(fd uintptr) { err = relisten(fd, backlog) }); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+/**
+ * The delay before retrying after an error, starting at 5ms and doubling from
+ * the 'previous' delay up to a second
+ */
+func nextRetryDelay(previous time.Duration) time.Duration {
+	if previous == 0 {
+		return 5 * time.Millisecond
+	}
+	if previous *= 2; previous > maxAcceptDelay {
+		return maxAcceptDelay
+	}
+	return previous
+}
+
+/**
+ * Accepts connections until the listener is closed, passing each to 'handle'. Temporary
+ * errors, e.g. running out of file descriptors, are retried after a delay that doubles
+ * up to a second, as net/http's server does. Returns nil once the proxy is stopped, or
+ * the error that stopped connections being accepted - in which case the proxy stops
+ * listening altogether, rather than keeping a port that no longer accepts connections.
+ */
+func acceptConnections(listener net.Listener, listening *proxyListener, handle func(net.Conn)) error {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if listening.isStopped() {
+				return nil
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				delay = nextRetryDelay(delay)
+				log.Printf("Error accepting a connection on %s, retrying in %s - %s", listener.Addr(), delay, err)
+				time.Sleep(delay)
+				continue
+			}
+			listening.stop()
+			return err
+		}
+
+		delay = 0
+		handle(conn)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// whether several listeners can share an address, each with its own acceptor
+const reusePortSupported = true
+
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
+
+/**
+ * Listens again on a listening socket, which on Linux changes the length of its backlog
+ */
+func relisten(fd uintptr, backlog int) error {
+	return unix.Listen(int(fd), backlog)
+}
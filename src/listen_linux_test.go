@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenTcp_ReusePort(t *testing.T) {
+	first, err := listenTcp(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, true, 0)
+	assertNil(t, err)
+	defer first.Close()
+
+	address := first.Addr().(*net.TCPAddr)
+	second, err := listenTcp(address, true, 0)
+	assertNil(t, err)
+	defer second.Close()
+
+	_, err = listenTcp(address, false, 0)
+	assertNotNil(t, err)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// only Linux balances connections between listeners sharing an address, so
+// elsewhere every acceptor shares a single listener
+const reusePortSupported = false
+
+func setReusePort(fd uintptr) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
+
+/**
+ * The backlog is left at the default of the platform
+ */
+func relisten(fd uintptr, backlog int) error {
+	return nil
+}
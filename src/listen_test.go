@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type temporaryError struct{}
+
+func (e temporaryError) Error() string   { return "too many open files" }
+func (e temporaryError) Timeout() bool   { return false }
+func (e temporaryError) Temporary() bool { return true }
+
+/**
+ * A listener returning each of its results from Accept in turn, then blocking until closed
+ */
+type stubListener struct {
+	results []interface{}
+	closed  chan struct{}
+	mu      sync.Mutex
+}
+
+func (l *stubListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.results) == 0 {
+		l.mu.Unlock()
+		<-l.closed
+		return nil, errors.New("use of closed network connection")
+	}
+	result := l.results[0]
+	l.results = l.results[1:]
+	l.mu.Unlock()
+
+	if err, ok := result.(error); ok {
+		return nil, err
+	}
+	return result.(net.Conn), nil
+}
+
+func (l *stubListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *stubListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9090}
+}
+
+func TestAcceptConnections_TemporaryErrors(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	listener := &stubListener{
+		results: []interface{}{temporaryError{}, temporaryError{}, server},
+		closed:  make(chan struct{}),
+	}
+	var listening proxyListener
+	listening.set(listener)
+
+	accepted := make(chan net.Conn, 1)
+	result := make(chan error)
+	go func() {
+		result <- acceptConnections(listener, &listening, func(conn net.Conn) {
+			accepted <- conn
+		})
+	}()
+
+	select {
+	case conn := <-accepted:
+		assertEqual(t, server, conn, "accepted after the temporary errors")
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not accepted after temporary errors")
+	}
+
+	listening.stop()
+	assertNil(t, <-result)
+}
+
+func TestAcceptConnections_PermanentError(t *testing.T) {
+	listener := &stubListener{
+		results: []interface{}{errors.New("invalid argument")},
+		closed:  make(chan struct{}),
+	}
+	other := &stubListener{closed: make(chan struct{})}
+	var listening proxyListener
+	listening.set(listener)
+	listening.set(other)
+
+	err := acceptConnections(listener, &listening, func(conn net.Conn) {})
+	assertEqual(t, "invalid argument", err.Error(), "permanent errors stop accepting")
+	assertEqual(t, true, listening.isStopped(), "the proxy stops listening")
+
+	select {
+	case <-other.closed:
+	default:
+		t.Fatal("the proxy's other listeners were left open")
+	}
+}
+
+func TestNextRetryDelay(t *testing.T) {
+	var delays []string
+	var delay time.Duration
+	for i := 0; i < 10; i++ {
+		delay = nextRetryDelay(delay)
+		delays = append(delays, delay.String())
+	}
+	assertEqual(t, "5ms,10ms,20ms,40ms,80ms,160ms,320ms,640ms,1s,1s", strings.Join(delays, ","), "delays double up to a second")
+}
+
+func TestListenTcp_Backlog(t *testing.T) {
+	listener, err := listenTcp(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, false, 16)
+	assertNil(t, err)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assertNil(t, err)
+	conn.Close()
+}
+
+/**
+ * Every acceptor proxies connections, whether it has its own listener or shares one
+ */
+func TestConsulProxy_Acceptors(t *testing.T) {
+	backend := startTcpEchoServer(t)
+	defer backend.Close()
+
+	discoverer, err := NewStaticDiscoverer("accepted-service", []string{backend.Addr().String()})
+	assertNil(t, err)
+
+	proxyPort := getFreePort()
+	proxy, err := NewProxy(&ProxiedService{
+		ServiceName:   "accepted-service",
+		LocalIP:       "127.0.0.1",
+		LocalPort:     proxyPort,
+		Acceptors:     4,
+		ListenBacklog: 512,
+	}, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+
+	stopped := make(chan struct{})
+	go func() {
+		proxy.start()
+		close(stopped)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	for i := 0; i < 20; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(proxyPort))
+		assertNil(t, err)
+		line, err := echo(t, conn, "ping")
+		assertNil(t, err)
+		assertEqual(t, "ping\n", line, "proxied")
+		conn.Close()
+	}
+
+	proxy.stop()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("acceptors did not stop")
+	}
+}
+
+/**
+ * A proxy stopped before it starts listening closes every listener it opened, so that
+ * none are left holding a share of the port
+ */
+func TestConsulProxy_AcceptorsStoppedBeforeListening(t *testing.T) {
+	discoverer, err := NewStaticDiscoverer("accepted-service", []string{"127.0.0.1:1"})
+	assertNil(t, err)
+
+	proxyPort := getFreePort()
+	proxy, err := NewProxy(&ProxiedService{
+		ServiceName: "accepted-service",
+		LocalIP:     "127.0.0.1",
+		LocalPort:   proxyPort,
+		Acceptors:   4,
+	}, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+
+	proxy.stop()
+	assertNil(t, proxy.start())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(proxyPort))
+	assertNil(t, err)
+	listener.Close()
+}
+
+func TestNewProxy_AcceptorsValidated(t *testing.T) {
+	discoverer, err := NewStaticDiscoverer("my-service", []string{"127.0.0.1:1"})
+	assertNil(t, err)
+
+	_, err = NewProxy(&ProxiedService{ServiceName: "my-service", ListenBacklog: -1}, discoverer, &ConsulServerConfig{})
+	assertNotNil(t, err)
+
+	_, err = NewProxy(&ProxiedService{ServiceName: "my-service", Protocol: ProtocolHttp, Acceptors: 2}, discoverer, &ConsulServerConfig{})
+	assertNotNil(t, err)
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"log"
-	"sync"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var (
@@ -16,19 +19,31 @@ func main() {
 	configuration := configuration()
 	log.Println("Effective Configuration", configuration)
 
-	var wg sync.WaitGroup
-
-	for _, proxy := range configuration.Proxies {
-		wg.Add(1)
-		lookup := NewConsulLookup(proxy.ServiceName, proxy.Datacenter, configuration.ConsulServer)
-		proxy := NewConsulProxy(proxy, lookup)
+	if configuration.StatusAddress != "" {
 		go func() {
-			defer wg.Done()
-			proxy.start()
+			log.Println("Serving status on", configuration.StatusAddress)
+			log.Println(http.ListenAndServe(configuration.StatusAddress, nil))
 		}()
 	}
 
+	manager := NewProxyManager()
+	apply := func(config *ConsulProxyConfig) error {
+		globalConnections.setLimit(config.MaxConnections)
+		return manager.apply(config)
+	}
+	if err := apply(configuration); err != nil {
+		log.Fatal(err)
+	}
+
+	if configuration.kvSource != nil {
+		go configuration.kvSource.watch(apply)
+	}
+
 	fmt.Printf("Version: %s, Build: %s\n", Version, Build)
 
-	wg.Wait()
+	// stop the proxies on shutdown, so that any registered with consul are deregistered
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	log.Println("Shutting down on", <-signals)
+	manager.stop()
 }
\ No newline at end of file
@@ -5,6 +5,7 @@ import (
 	"github.com/miekg/dns"
 	"fmt"
 	"strconv"
+	"sync"
 )
 
 type DnsRecord struct {
@@ -14,12 +15,38 @@ type DnsRecord struct {
 
 type MockDnsServer struct {
 	records map[string]*DnsRecord
+
+	// full resource records, in the zone file format, returned in the answer
+	// and additional sections of the response to a query for the name
+	answers map[string][]string
+	extras  map[string][]string
+
+	// the response code returned for a query for the name, defaults to success
+	rcodes  map[string]int
+
+	// when true, responses over UDP are truncated so the client must retry over TCP
+	truncate bool
+
 	port    int
 
-	server *dns.Server
+	// whether recursion was desired by the last query for each name
+	recursionDesired   map[string]bool
+	recursionDesiredMu sync.Mutex
+
+	server    *dns.Server
+	tcpServer *dns.Server
 }
 
 func (s *MockDnsServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	s.recursionDesiredMu.Lock()
+	if s.recursionDesired == nil {
+		s.recursionDesired = make(map[string]bool)
+	}
+	for _, q := range r.Question {
+		s.recursionDesired[q.Name] = r.RecursionDesired
+	}
+	s.recursionDesiredMu.Unlock()
+
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Compress = false
@@ -29,16 +56,33 @@ func (s *MockDnsServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 		s.writeAnswer(m)
 	}
 
+	if s.truncate && w.LocalAddr().Network() == "udp" {
+		m.Answer = nil
+		m.Extra = nil
+		m.Truncated = true
+	}
+
 	w.WriteMsg(m)
 }
 
 func (s *MockDnsServer) writeAnswer(m *dns.Msg) {
 	for _, q := range m.Question {
+		if rcode, ok := s.rcodes[q.Name]; ok {
+			m.Rcode = rcode
+			continue
+		}
+
+		m.Answer = append(m.Answer, parseRecords(s.answers[q.Name])...)
+		m.Extra = append(m.Extra, parseRecords(s.extras[q.Name])...)
+
 		switch q.Qtype {
 		case dns.TypeSRV:
 			log.Printf("Query for %s\n", q.Name)
 
 			record := s.records[q.Name]
+			if record == nil {
+				continue
+			}
 
 			log.Printf("Found record %v", record)
 			srv, err := dns.NewRR(fmt.Sprintf("%s 6 IN SRV 1 1 %v %v", q.Name, record.port, record.ip))
@@ -53,26 +97,63 @@ func (s *MockDnsServer) writeAnswer(m *dns.Msg) {
 	}
 }
 
+func parseRecords(records []string) []dns.RR {
+	var rrs []dns.RR
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			panic(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+/**
+ * Starts the server, blocking until it is ready to receive queries
+ */
 func (s *MockDnsServer) start() {
 	if s.port == 0 {
 		s.port = getFreePort()
 	}
 
 	// attach request handler func
-	dns.HandleFunc("service.", s.handleRequest)
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", s.handleRequest)
 
-	s.server = &dns.Server{Addr: ":" + strconv.Itoa(s.port), Net: "udp" }
+	s.server = &dns.Server{Addr: ":" + strconv.Itoa(s.port), Net: "udp", Handler: mux}
+	s.tcpServer = &dns.Server{Addr: ":" + strconv.Itoa(s.port), Net: "tcp", Handler: mux}
 	log.Printf("Starting at %d\n", s.port)
+	listenAndServe(s.server)
+	listenAndServe(s.tcpServer)
+}
+
+func listenAndServe(server *dns.Server) {
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
 	go func() {
-		err := s.server.ListenAndServe()
+		err := server.ListenAndServe()
 		if err != nil {
 			log.Fatalf("Failed to start server: %s\n ", err.Error())
 		}
 	}()
+	<-started
 }
 
 func (s *MockDnsServer) stop() {
 	if s.server != nil {
 		s.server.Shutdown()
 	}
+	if s.tcpServer != nil {
+		s.tcpServer.Shutdown()
+	}
+}
+
+/**
+ * Whether recursion was desired by the last query for the name
+ */
+func (s *MockDnsServer) queriedRecursively(name string) bool {
+	s.recursionDesiredMu.Lock()
+	defer s.recursionDesiredMu.Unlock()
+	return s.recursionDesired[name]
 }
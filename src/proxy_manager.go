@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+/**
+ * Runs the proxies described by the configuration. When the configuration changes
+ * the proxies whose settings changed are replaced, and the rest are left running.
+ */
+type ProxyManager struct {
+	// the running proxies, keyed by their settings
+	// must be accessed under proxiesMu
+	proxies   map[string]Proxy
+	proxiesMu sync.Mutex
+
+	// the local ports of the proxies, shared with the auto proxies so that the
+	// ports they assign do not collide with the others
+	ports *portReservations
+
+	// creates the proxies, replaced in tests
+	newProxy     func(service *ProxiedService, consulServer *ConsulServerConfig) (Proxy, error)
+	newSniProxy  func(listener *SniListener, consulServer *ConsulServerConfig) (Proxy, error)
+	newAutoProxy func(autoProxy *AutoProxy, consulServer *ConsulServerConfig) (Proxy, error)
+}
+
+func NewProxyManager() *ProxyManager {
+	ports := newPortReservations()
+	return &ProxyManager{
+		proxies: make(map[string]Proxy),
+		ports:   ports,
+		newProxy: func(service *ProxiedService, consulServer *ConsulServerConfig) (Proxy, error) {
+			discoverer, err := NewDiscoverer(service, consulServer)
+			if err != nil {
+				return nil, err
+			}
+			proxy, err := NewProxy(service, discoverer, consulServer)
+			if err != nil || service.Register == nil {
+				return proxy, err
+			}
+			return NewRegisteredProxy(proxy, discoverer, service)
+		},
+		newSniProxy: func(listener *SniListener, consulServer *ConsulServerConfig) (Proxy, error) {
+			return NewSniProxy(listener, consulServer)
+		},
+		newAutoProxy: func(autoProxy *AutoProxy, consulServer *ConsulServerConfig) (Proxy, error) {
+			autoProxier, err := NewAutoProxier(autoProxy, consulServer)
+			if err != nil {
+				return nil, err
+			}
+			autoProxier.reserved = ports
+			return autoProxier, nil
+		},
+	}
+}
+
+/**
+ * The key a proxy is tracked under, which changes whenever any of the settings
+ * it is created from change
+ */
+func proxyKey(kind string, settings interface{}, consulServer *ConsulServerConfig) string {
+	settingsJson, _ := json.Marshal(settings)
+	consulServerJson, _ := json.Marshal(consulServer)
+	return kind + string(settingsJson) + string(consulServerJson)
+}
+
+/**
+ * Starts the proxies in the configuration that are not already running, and stops
+ * the running proxies that are no longer in it. Proxies that cannot be created, or
+ * that are configured on the port of an earlier proxy, are skipped, and their errors
+ * returned once the others have been started.
+ */
+func (pm *ProxyManager) apply(config *ConsulProxyConfig) error {
+	pm.proxiesMu.Lock()
+	defer pm.proxiesMu.Unlock()
+
+	var errs []string
+	var bound []boundAddress
+	claim := func(address boundAddress) bool {
+		for _, other := range bound {
+			if other.overlaps(address) {
+				errs = append(errs, fmt.Sprintf("unable to proxy %s - port %d is already used by %s", address.description, address.port, other.description))
+				return false
+			}
+		}
+		bound = append(bound, address)
+		return true
+	}
+
+	create := make(map[string]func() (Proxy, error))
+	descriptions := make(map[string]string)
+	for _, service := range config.Proxies {
+		service := service
+		if service.LocalSocket == "" && service.LocalPort != 0 {
+			network := "tcp"
+			if service.Protocol == ProtocolUdp {
+				network = "udp"
+			}
+			if !claim(boundAddress{network, service.LocalIP, service.LocalPort, service.String()}) {
+				continue
+			}
+		}
+		key := proxyKey("proxy", service, config.ConsulServer)
+		create[key] = func() (Proxy, error) { return pm.newProxy(service, config.ConsulServer) }
+		descriptions[key] = service.String()
+	}
+	for _, listener := range config.SniListeners {
+		listener := listener
+		description := fmt.Sprintf("SNI listener on port %d", listener.LocalPort)
+		if !claim(boundAddress{"tcp", listener.LocalIP, listener.LocalPort, description}) {
+			continue
+		}
+		key := proxyKey("sni", listener, config.ConsulServer)
+		create[key] = func() (Proxy, error) { return pm.newSniProxy(listener, config.ConsulServer) }
+		descriptions[key] = description
+	}
+	for _, autoProxy := range config.AutoProxies {
+		autoProxy := autoProxy
+		key := proxyKey("auto", autoProxy, config.ConsulServer)
+		create[key] = func() (Proxy, error) { return pm.newAutoProxy(autoProxy, config.ConsulServer) }
+		descriptions[key] = fmt.Sprintf("auto proxy for services tagged '%s' or with meta '%s'", autoProxy.ServiceTag, autoProxy.ServiceMetaKey)
+	}
+
+	// stop the removed proxies first, so that their replacements can bind to the same port
+	for key, proxy := range pm.proxies {
+		if _, ok := create[key]; !ok {
+			proxy.stop()
+			delete(pm.proxies, key)
+		}
+	}
+
+	// the configured ports are reserved first, so that the auto proxies move any of
+	// their services using them to other ports
+	pm.ports.reserve(pm, func(reserved map[int]bool) []int {
+		var configured []int
+		for _, service := range config.Proxies {
+			if service.LocalSocket == "" && service.LocalPort != 0 {
+				configured = append(configured, service.LocalPort)
+			}
+		}
+		for _, listener := range config.SniListeners {
+			configured = append(configured, listener.LocalPort)
+		}
+		return configured
+	})
+
+	for key, newProxy := range create {
+		if _, ok := pm.proxies[key]; ok {
+			continue
+		}
+
+		log.Println("Starting proxy", descriptions[key])
+		proxy, err := newProxy()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("unable to proxy %s - %s", descriptions[key], err))
+			continue
+		}
+
+		pm.proxies[key] = proxy
+		go pm.run(key, proxy, descriptions[key])
+	}
+
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+/**
+ * The local address a proxy listens on. Proxies are not allowed to share one, as
+ * SO_REUSEPORT would let them both bind it and split the connections between them.
+ */
+type boundAddress struct {
+	network     string
+	ip          string
+	port        int
+	description string
+}
+
+/**
+ * Whether both addresses are the same port, either on the same ip or with one
+ * listening on all interfaces
+ */
+func (a boundAddress) overlaps(other boundAddress) bool {
+	if a.network != other.network || a.port != other.port {
+		return false
+	}
+	return a.ip == other.ip || net.ParseIP(a.ip).IsUnspecified() || net.ParseIP(other.ip).IsUnspecified()
+}
+
+/**
+ * Runs the proxy until it is stopped. A proxy that is unable to listen, e.g. because
+ * its port is in use, is stopped and dropped, leaving the other proxies running. It
+ * is started again the next time a configuration including it is applied.
+ */
+func (pm *ProxyManager) run(key string, proxy Proxy, description string) {
+	err := proxy.start()
+	if err == nil {
+		return
+	}
+	log.Printf("Unable to proxy %s - %s", description, err)
+
+	pm.proxiesMu.Lock()
+	defer pm.proxiesMu.Unlock()
+	if pm.proxies[key] == proxy {
+		proxy.stop()
+		delete(pm.proxies, key)
+	}
+}
+
+/**
+ * Stops every proxy, e.g. when shutting down
+ */
+func (pm *ProxyManager) stop() {
+	pm.proxiesMu.Lock()
+	defer pm.proxiesMu.Unlock()
+
+	for key, proxy := range pm.proxies {
+		proxy.stop()
+		delete(pm.proxies, key)
+	}
+}
+
+/**
+ * The number of running proxies
+ */
+func (pm *ProxyManager) count() int {
+	pm.proxiesMu.Lock()
+	defer pm.proxiesMu.Unlock()
+	return len(pm.proxies)
+}
+
+/**
+ * The local ports reserved by the proxies of a manager, so that the ports auto
+ * proxies assign do not collide with those of the other proxies
+ */
+type portReservations struct {
+	// the owner of each reserved port, must be accessed under mu
+	owners map[int]interface{}
+	mu     sync.Mutex
+}
+
+func newPortReservations() *portReservations {
+	return &portReservations{owners: make(map[int]interface{})}
+}
+
+/**
+ * Replaces the ports reserved by the owner with those returned by 'choose', which
+ * is given the ports reserved by the others
+ */
+func (pr *portReservations) reserve(owner interface{}, choose func(reserved map[int]bool) []int) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	reserved := make(map[int]bool)
+	for port, reservedBy := range pr.owners {
+		if reservedBy == owner {
+			delete(pr.owners, port)
+		} else {
+			reserved[port] = true
+		}
+	}
+	for _, port := range choose(reserved) {
+		pr.owners[port] = owner
+	}
+}
+
+/**
+ * Releases every port reserved by the owner
+ */
+func (pr *portReservations) release(owner interface{}) {
+	pr.reserve(owner, func(reserved map[int]bool) []int { return nil })
+}
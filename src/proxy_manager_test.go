@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeProxy struct {
+	name    string
+	started chan bool
+	stopped bool
+}
+
+func (p *fakeProxy) start() error {
+	p.started <- true
+	if p.name == "unbindable" {
+		return errors.New("address already in use")
+	}
+	return nil
+}
+
+func (p *fakeProxy) stop() {
+	p.stopped = true
+}
+
+func newFakeProxyManager() (*ProxyManager, map[string]*fakeProxy) {
+	created := make(map[string]*fakeProxy)
+	started := make(chan bool, 100)
+
+	pm := NewProxyManager()
+	pm.newProxy = func(service *ProxiedService, consulServer *ConsulServerConfig) (Proxy, error) {
+		if service.ServiceName == "broken" {
+			return nil, errors.New("broken")
+		}
+		proxy := &fakeProxy{name: service.ServiceName, started: started}
+		created[service.ServiceName] = proxy
+		return proxy, nil
+	}
+	pm.newSniProxy = func(listener *SniListener, consulServer *ConsulServerConfig) (Proxy, error) {
+		proxy := &fakeProxy{name: "sni", started: started}
+		created["sni"] = proxy
+		return proxy, nil
+	}
+	return pm, created
+}
+
+func TestProxyManager_apply(t *testing.T) {
+	pm, created := newFakeProxyManager()
+	consulServer := &ConsulServerConfig{Address: "consul:8500"}
+
+	err := pm.apply(&ConsulProxyConfig{
+		ConsulServer: consulServer,
+		Proxies: []*ProxiedService{
+			{ServiceName: "orders", LocalPort: 9090},
+			{ServiceName: "payments", LocalPort: 9091},
+		},
+		SniListeners: []*SniListener{{LocalPort: 8443}},
+	})
+	assertNil(t, err)
+	assertEqual(t, 3, pm.count(), "proxies started")
+
+	orders, payments, sni := created["orders"], created["payments"], created["sni"]
+
+	// payments is changed, and the SNI listener removed
+	err = pm.apply(&ConsulProxyConfig{
+		ConsulServer: consulServer,
+		Proxies: []*ProxiedService{
+			{ServiceName: "orders", LocalPort: 9090},
+			{ServiceName: "payments", LocalPort: 9092},
+		},
+	})
+	assertNil(t, err)
+	assertEqual(t, 2, pm.count(), "proxies running")
+	assertEqual(t, false, orders.stopped, "unchanged proxy left running")
+	assertEqual(t, orders, created["orders"], "unchanged proxy not recreated")
+	assertEqual(t, true, payments.stopped, "changed proxy stopped")
+	assertEqual(t, false, created["payments"] == payments, "changed proxy recreated")
+	assertEqual(t, true, sni.stopped, "removed listener stopped")
+
+	// a change to the consul server replaces every proxy
+	err = pm.apply(&ConsulProxyConfig{
+		ConsulServer: &ConsulServerConfig{Address: "other-consul:8500"},
+		Proxies:      []*ProxiedService{{ServiceName: "orders", LocalPort: 9090}},
+	})
+	assertNil(t, err)
+	assertEqual(t, true, orders.stopped, "proxy using the old consul server stopped")
+}
+
+func TestProxyManager_applyErrors(t *testing.T) {
+	pm, _ := newFakeProxyManager()
+
+	err := pm.apply(&ConsulProxyConfig{
+		ConsulServer: &ConsulServerConfig{},
+		Proxies: []*ProxiedService{
+			{ServiceName: "broken", LocalPort: 9090},
+			{ServiceName: "orders", LocalPort: 9091},
+		},
+	})
+	assertNotNil(t, err)
+	assertEqual(t, 1, pm.count(), "the other proxies are started")
+}
+
+func TestProxyManager_applyDuplicatePorts(t *testing.T) {
+	pm, created := newFakeProxyManager()
+
+	err := pm.apply(&ConsulProxyConfig{
+		ConsulServer: &ConsulServerConfig{},
+		Proxies: []*ProxiedService{
+			{ServiceName: "orders", LocalPort: 9090},
+			{ServiceName: "payments", LocalPort: 9090},
+			{ServiceName: "invoices", LocalIP: "0.0.0.0", LocalPort: 9090},
+			{ServiceName: "metrics", LocalIP: "10.0.0.1", LocalPort: 9091},
+			{ServiceName: "stats", LocalIP: "10.0.0.2", LocalPort: 9091},
+			{ServiceName: "dns", LocalPort: 9090, Protocol: ProtocolUdp},
+		},
+		SniListeners: []*SniListener{{LocalPort: 9090}},
+	})
+	assertNotNil(t, err)
+	assertEqual(t, "unable to proxy localhost:9090 -> Consul(payments in datacenter ) - port 9090 is already used by localhost:9090 -> Consul(orders in datacenter ), "+
+		"unable to proxy 0.0.0.0:9090 -> Consul(invoices in datacenter ) - port 9090 is already used by localhost:9090 -> Consul(orders in datacenter ), "+
+		"unable to proxy SNI listener on port 9090 - port 9090 is already used by localhost:9090 -> Consul(orders in datacenter )", err.Error(), "duplicate ports rejected")
+	assertEqual(t, 4, pm.count(), "the first proxy on each address is started")
+	assertEqual(t, true, created["payments"] == nil, "duplicate proxy not created")
+	assertEqual(t, true, created["sni"] == nil, "duplicate listener not created")
+}
+
+func TestProxyManager_startErrors(t *testing.T) {
+	pm, created := newFakeProxyManager()
+
+	err := pm.apply(&ConsulProxyConfig{
+		ConsulServer: &ConsulServerConfig{},
+		Proxies: []*ProxiedService{
+			{ServiceName: "unbindable", LocalPort: 9090},
+			{ServiceName: "orders", LocalPort: 9091},
+		},
+	})
+	assertNil(t, err)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pm.count() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertEqual(t, 1, pm.count(), "the proxy unable to listen is dropped")
+	unbindable := created["unbindable"]
+	assertEqual(t, true, unbindable.stopped, "the proxy unable to listen is stopped")
+	assertEqual(t, false, created["orders"].stopped, "the other proxies are left running")
+
+	// applying the configuration again retries the dropped proxy
+	err = pm.apply(&ConsulProxyConfig{
+		ConsulServer: &ConsulServerConfig{},
+		Proxies: []*ProxiedService{
+			{ServiceName: "unbindable", LocalPort: 9090},
+			{ServiceName: "orders", LocalPort: 9091},
+		},
+	})
+	assertNil(t, err)
+	assertEqual(t, false, created["unbindable"] == unbindable, "the dropped proxy is started again")
+}
+
+/**
+ * A proxy whose backends cannot be discovered yet, e.g. because its endpoints file is
+ * missing, neither holds up applying the configuration nor stopping the proxies
+ */
+func TestProxyManager_applyDiscoveryBlocked(t *testing.T) {
+	pm := NewProxyManager()
+
+	applied := make(chan error)
+	go func() {
+		applied <- pm.apply(&ConsulProxyConfig{
+			ConsulServer: &ConsulServerConfig{},
+			Proxies: []*ProxiedService{{
+				ServiceName:   "orders",
+				LocalIP:       "127.0.0.1",
+				LocalPort:     getFreePort(),
+				Discovery:     DiscoveryFile,
+				EndpointsFile: "/nonexistent/orders.json",
+			}},
+		})
+	}()
+
+	select {
+	case err := <-applied:
+		assertNil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("applying the configuration waited for discovery")
+	}
+	assertEqual(t, 1, pm.count(), "proxy running")
+
+	stopped := make(chan bool)
+	go func() {
+		pm.stop()
+		stopped <- true
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stopping the proxies waited for discovery")
+	}
+	assertEqual(t, 0, pm.count(), "proxy stopped")
+}
+
+func TestProxyManager_applyReservesPorts(t *testing.T) {
+	pm, _ := newFakeProxyManager()
+
+	err := pm.apply(&ConsulProxyConfig{
+		ConsulServer: &ConsulServerConfig{},
+		Proxies: []*ProxiedService{
+			{ServiceName: "orders", LocalPort: 9090},
+			{ServiceName: "payments", LocalSocket: "/tmp/payments.sock"},
+		},
+		SniListeners: []*SniListener{{LocalPort: 8443}},
+	})
+	assertNil(t, err)
+	assertEqual(t, 2, len(pm.ports.owners), "ports of the proxies and listeners reserved")
+	assertEqual(t, true, pm.ports.owners[9090] == pm, "proxy port reserved")
+	assertEqual(t, true, pm.ports.owners[8443] == pm, "listener port reserved")
+
+	err = pm.apply(&ConsulProxyConfig{
+		ConsulServer: &ConsulServerConfig{},
+		Proxies:      []*ProxiedService{{ServiceName: "orders", LocalPort: 9091}},
+	})
+	assertNil(t, err)
+	assertEqual(t, 1, len(pm.ports.owners), "ports of removed proxies released")
+	assertEqual(t, true, pm.ports.owners[9091] == pm, "changed port reserved")
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * This file contains the logic for writing and reading HAProxy PROXY protocol headers,
+ * which carry the address of the original client through a proxy.
+ *
+ * See http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+ */
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// the signature that starts every v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// how long a client has to send the PROXY protocol header once connected
+const proxyProtocolHeaderTimeout = 5 * time.Second
+
+/**
+ * Writes a PROXY protocol header of the given version, describing a connection
+ * from 'src' to 'dst'. Connections that are not over TCP, e.g. unix sockets,
+ * are described as UNKNOWN (v1) or LOCAL (v2).
+ */
+func writeProxyHeader(w io.Writer, version string, src net.Addr, dst net.Addr) error {
+	switch version {
+	case ProxyProtocolV1:
+		_, err := io.WriteString(w, proxyHeaderV1(src, dst))
+		return err
+	case ProxyProtocolV2:
+		_, err := w.Write(proxyHeaderV2(src, dst))
+		return err
+	default:
+		return fmt.Errorf("unknown PROXY protocol version '%s'", version)
+	}
+}
+
+/**
+ * The TCP addresses of the connection, or false if it is not between TCP
+ * addresses of the same family
+ */
+func tcpAddresses(src net.Addr, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	srcTcp, srcOk := src.(*net.TCPAddr)
+	dstTcp, dstOk := dst.(*net.TCPAddr)
+	if !srcOk || !dstOk {
+		return nil, nil, false
+	}
+
+	if (srcTcp.IP.To4() == nil) != (dstTcp.IP.To4() == nil) {
+		return nil, nil, false
+	}
+	return srcTcp, dstTcp, true
+}
+
+func proxyHeaderV1(src net.Addr, dst net.Addr) string {
+	srcTcp, dstTcp, ok := tcpAddresses(src, dst)
+	if !ok {
+		return "PROXY UNKNOWN\r\n"
+	}
+
+	family := "TCP6"
+	if srcTcp.IP.To4() != nil {
+		family = "TCP4"
+	}
+
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcTcp.IP, dstTcp.IP, srcTcp.Port, dstTcp.Port)
+}
+
+func proxyHeaderV2(src net.Addr, dst net.Addr) []byte {
+	var header bytes.Buffer
+	header.Write(proxyProtocolV2Signature)
+
+	srcTcp, dstTcp, ok := tcpAddresses(src, dst)
+	if !ok {
+		// version 2, LOCAL command, unspecified family and no addresses
+		header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return header.Bytes()
+	}
+
+	// version 2, PROXY command
+	header.WriteByte(0x21)
+
+	srcIp, dstIp := srcTcp.IP.To4(), dstTcp.IP.To4()
+	if srcIp != nil {
+		// TCP over IPv4
+		header.WriteByte(0x11)
+	} else {
+		// TCP over IPv6
+		header.WriteByte(0x21)
+		srcIp, dstIp = srcTcp.IP.To16(), dstTcp.IP.To16()
+	}
+
+	binary.Write(&header, binary.BigEndian, uint16(2*len(srcIp)+4))
+	header.Write(srcIp)
+	header.Write(dstIp)
+	binary.Write(&header, binary.BigEndian, uint16(srcTcp.Port))
+	binary.Write(&header, binary.BigEndian, uint16(dstTcp.Port))
+	return header.Bytes()
+}
+
+/**
+ * A connection whose addresses were read from a PROXY protocol header
+ */
+type proxyProtocolConn struct {
+	net.Conn
+
+	// buffers the data after the header
+	reader *bufio.Reader
+
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *proxyProtocolConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+/**
+ * Reads the v1 or v2 PROXY protocol header sent at the start of the connection.
+ * Returns a connection that reports the original client and destination addresses
+ * from the header as its remote and local addresses.
+ */
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	wrapped := &proxyProtocolConn{
+		Conn:   conn,
+		reader: reader,
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytes.Equal(signature, proxyProtocolV2Signature) {
+		return wrapped, readProxyHeaderV2(reader, wrapped)
+	}
+
+	prefix, err := reader.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix) == "PROXY " {
+		return wrapped, readProxyHeaderV1(reader, wrapped)
+	}
+
+	return nil, errors.New("the connection did not start with a PROXY protocol header")
+}
+
+func readProxyHeaderV1(reader *bufio.Reader, conn *proxyProtocolConn) error {
+	// the longest possible v1 header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("PROXY protocol v1 header is too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("invalid PROXY protocol v1 header '%s'", strings.TrimSpace(string(line)))
+	}
+
+	srcIp, dstIp := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIp == nil || dstIp == nil || srcErr != nil || dstErr != nil {
+		return fmt.Errorf("invalid PROXY protocol v1 header '%s'", strings.TrimSpace(string(line)))
+	}
+
+	conn.remote = &net.TCPAddr{IP: srcIp, Port: int(srcPort)}
+	conn.local = &net.TCPAddr{IP: dstIp, Port: int(dstPort)}
+	return nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader, conn *proxyProtocolConn) error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return err
+	}
+
+	// the LOCAL command is used for connections made by the proxy itself,
+	// e.g. health checks, so the real addresses are kept
+	command := header[12] & 0x0F
+	if command == 0x00 {
+		return nil
+	}
+	if command != 0x01 {
+		return fmt.Errorf("unsupported PROXY protocol command %d", command)
+	}
+
+	var ipLen int
+	switch header[13] >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		// unix sockets and unspecified families carry no usable address
+		return nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return errors.New("PROXY protocol v2 header is too short")
+	}
+
+	conn.remote = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	conn.local = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/**
+ * Writes the header followed by 'hello' over a pipe, and reads it back
+ */
+func roundTripProxyHeader(t *testing.T, version string, src net.Addr, dst net.Addr) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		writeProxyHeader(client, version, src, dst)
+		client.Write([]byte("hello"))
+		client.Close()
+	}()
+
+	conn, err := readProxyHeader(server)
+	assertNil(t, err)
+
+	data, err := ioutil.ReadAll(conn)
+	assertNil(t, err)
+	assertEqual(t, "hello", string(data), "data after header")
+	return conn
+}
+
+func TestProxyProtocol_V1(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+
+	assertEqual(t, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", proxyHeaderV1(src, dst), "header")
+
+	conn := roundTripProxyHeader(t, ProxyProtocolV1, src, dst)
+	assertEqual(t, "192.0.2.1:56324", conn.RemoteAddr().String(), "RemoteAddr")
+	assertEqual(t, "192.0.2.2:443", conn.LocalAddr().String(), "LocalAddr")
+}
+
+func TestProxyProtocol_V1_IPv6(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	assertEqual(t, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", proxyHeaderV1(src, dst), "header")
+
+	conn := roundTripProxyHeader(t, ProxyProtocolV1, src, dst)
+	assertEqual(t, "[2001:db8::1]:56324", conn.RemoteAddr().String(), "RemoteAddr")
+}
+
+func TestProxyProtocol_V1_Unknown(t *testing.T) {
+	src := &net.UnixAddr{Name: "@", Net: "unix"}
+	dst := &net.UnixAddr{Name: "/run/svc.sock", Net: "unix"}
+
+	assertEqual(t, "PROXY UNKNOWN\r\n", proxyHeaderV1(src, dst), "header")
+	roundTripProxyHeader(t, ProxyProtocolV1, src, dst)
+}
+
+func TestProxyProtocol_V2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+
+	header := proxyHeaderV2(src, dst)
+	assertEqual(t, 28, len(header), "header length")
+	assertEqual(t, byte(0x21), header[12], "version and command")
+	assertEqual(t, byte(0x11), header[13], "family")
+
+	conn := roundTripProxyHeader(t, ProxyProtocolV2, src, dst)
+	assertEqual(t, "192.0.2.1:56324", conn.RemoteAddr().String(), "RemoteAddr")
+	assertEqual(t, "192.0.2.2:443", conn.LocalAddr().String(), "LocalAddr")
+}
+
+func TestProxyProtocol_V2_IPv6(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	conn := roundTripProxyHeader(t, ProxyProtocolV2, src, dst)
+	assertEqual(t, "[2001:db8::1]:56324", conn.RemoteAddr().String(), "RemoteAddr")
+	assertEqual(t, "[2001:db8::2]:443", conn.LocalAddr().String(), "LocalAddr")
+}
+
+func TestProxyProtocol_V2_Local(t *testing.T) {
+	src := &net.UnixAddr{Name: "@", Net: "unix"}
+	dst := &net.UnixAddr{Name: "/run/svc.sock", Net: "unix"}
+
+	assertEqual(t, 16, len(proxyHeaderV2(src, dst)), "header length")
+	conn := roundTripProxyHeader(t, ProxyProtocolV2, src, dst)
+	assertEqual(t, "pipe", conn.RemoteAddr().Network(), "RemoteAddr is unchanged")
+}
+
+func TestProxyProtocol_MissingHeader(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\n"))
+		client.Close()
+	}()
+
+	_, err := readProxyHeader(server)
+	assertNotNil(t, err)
+}
+
+/**
+ * Sends a v1 header to the proxy, which accepts it and sends a v2 header
+ * carrying the same client address on to the backend
+ */
+func TestConsulProxy_ProxyProtocol(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assertNil(t, err)
+	defer backend.Close()
+
+	received := make(chan net.Addr, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		wrapped, err := readProxyHeader(conn)
+		if err != nil {
+			received <- nil
+			return
+		}
+		received <- wrapped.RemoteAddr()
+		bufio.NewReader(wrapped).ReadString('\n')
+		wrapped.Write([]byte("ok\n"))
+		wrapped.Close()
+	}()
+
+	proxyPort := getFreePort()
+	proxied := &ProxiedService{
+		ServiceName:         "my-test-service",
+		LocalIP:             "127.0.0.1",
+		LocalPort:           proxyPort,
+		SendProxyProtocol:   ProxyProtocolV2,
+		AcceptProxyProtocol: true,
+	}
+
+	discoverer, _ := NewStaticDiscoverer("my-test-service", []string{backend.Addr().String()})
+	proxy, err := NewProxy(proxied, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	time.Sleep(200 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(proxyPort)))
+	assertNil(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 40000 9999\r\nping\n"))
+
+	select {
+	case addr := <-received:
+		assertNotNil(t, addr)
+		assertEqual(t, "203.0.113.7:40000", addr.String(), "client address at backend")
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend did not receive a connection")
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	assertNil(t, err)
+	assertEqual(t, "ok\n", reply, "reply")
+}
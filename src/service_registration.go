@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Abstracts the invocation of the consul agent ReST API to register a service
+type ConsulServiceRegister func(
+	/* consulAddress */ string,
+	/* registration  */ *consul.AgentServiceRegistration) error
+
+// Abstracts the invocation of the consul agent ReST API to deregister a service
+type ConsulServiceDeregister func(
+	/* consulAddress */ string,
+	/* serviceId     */ string) error
+
+// Abstracts the invocation of the consul agent ReST API to set the status of a TTL check
+type ConsulTtlUpdate func(
+	/* consulAddress */ string,
+	/* checkId       */ string,
+	/* status        */ string,
+	/* output        */ string) error
+
+// the address of the local consul agent services are registered with by default
+const defaultAgentAddress = "127.0.0.1:8500"
+
+// the longest a request to the agent may take, so that a hung agent cannot hold up
+// stopping the proxy, and with it reloading the configuration or shutting down
+const agentRequestTimeout = 10 * time.Second
+
+/**
+ * Registers the listener of a proxy as a service with the local consul agent while
+ * the proxy is running, and deregisters it once the proxy is stopped. The agent is
+ * always the local one, rather than the consul server used for discovery, as services
+ * belong to the agent they are registered with.
+ *
+ * With a TTL check the check is kept passing while the proxy has backends to proxy
+ * to, and marked critical while it does not. If the agent forgets the service, e.g.
+ * because it was restarted, the service is registered again.
+ */
+type RegisteredProxy struct {
+	Proxy
+
+	// the backends of the proxy, checked before renewing the TTL
+	discoverer Discoverer
+
+	registration  *consul.AgentServiceRegistration
+	check         string
+	checkInterval time.Duration
+
+	// the address of the HTTP API of the agent
+	agentAddress string
+
+	register     ConsulServiceRegister
+	deregister   ConsulServiceDeregister
+	updateTtl    ConsulTtlUpdate
+
+	// held while the agent is updated, so that the service is not registered once stopped
+	registerMu sync.Mutex
+
+	stopping stopper
+}
+
+/**
+ * proxy - the proxy whose listener is registered
+ * discoverer - the discoverer of the backends of the proxy
+ */
+func NewRegisteredProxy(proxy Proxy, discoverer Discoverer, service *ProxiedService) (*RegisteredProxy, error) {
+	registration, err := agentServiceRegistration(service)
+	if err != nil {
+		proxy.stop()
+		return nil, err
+	}
+
+	checkInterval := 10 * time.Second
+	if service.Register.CheckIntervalSec > 0 {
+		checkInterval = time.Duration(service.Register.CheckIntervalSec) * time.Second
+	}
+
+	check := service.Register.Check
+	if check == "" {
+		check = CheckTtl
+	}
+
+	agentAddress := service.Register.AgentAddress
+	if agentAddress == "" {
+		agentAddress = defaultAgentAddress
+	}
+
+	if registration.Check != nil {
+		registration.Check.CheckID = "service:" + registration.ID
+		if service.Register.DeregisterCriticalAfterSec > 0 {
+			registration.Check.DeregisterCriticalServiceAfter = (time.Duration(service.Register.DeregisterCriticalAfterSec) * time.Second).String()
+		}
+
+		switch check {
+		case CheckTtl:
+			// renewed every interval, so a few renewals can be missed before it expires
+			registration.Check.TTL = (3 * checkInterval).String()
+			registration.Check.Status = consul.HealthCritical
+		case CheckTcp:
+			registration.Check.TCP = net.JoinHostPort(tcpCheckHost(service.LocalIP), strconv.Itoa(service.LocalPort))
+			registration.Check.Interval = checkInterval.String()
+		}
+	}
+
+	return &RegisteredProxy{
+		Proxy:         proxy,
+		discoverer:    discoverer,
+		registration:  registration,
+		check:         check,
+		checkInterval: checkInterval,
+		agentAddress:  agentAddress,
+		register:      consulServiceRegister,
+		deregister:    consulServiceDeregister,
+		updateTtl:     consulTtlUpdate,
+	}, nil
+}
+
+/**
+ * The registration of the listener of the service, without the details of its check
+ */
+func agentServiceRegistration(service *ProxiedService) (*consul.AgentServiceRegistration, error) {
+	config := service.Register
+	if service.LocalSocket != "" {
+		return nil, errors.New("proxies listening on unix sockets cannot be registered with consul")
+	}
+	if service.LocalPort == 0 {
+		return nil, errors.New("proxies listening on any free port cannot be registered with consul")
+	}
+
+	name := config.Name
+	if name == "" {
+		name = service.ServiceName + "-proxy"
+	}
+
+	id := config.ID
+	if id == "" {
+		id = name + "-" + strconv.Itoa(service.LocalPort)
+	}
+
+	address := config.Address
+	if address == "" && !isUnspecifiedAddress(service.LocalIP) {
+		address = service.LocalIP
+	}
+
+	registration := &consul.AgentServiceRegistration{
+		ID:      id,
+		Name:    name,
+		Tags:    config.Tags,
+		Meta:    config.Meta,
+		Port:    service.LocalPort,
+		Address: address,
+	}
+
+	switch config.Check {
+	case "", CheckTtl:
+		registration.Check = &consul.AgentServiceCheck{Name: "consul-proxy backends"}
+	case CheckTcp:
+		if service.Protocol == ProtocolUdp {
+			return nil, errors.New("TCP checks cannot be used with UDP proxies")
+		}
+		registration.Check = &consul.AgentServiceCheck{Name: "consul-proxy listener"}
+	case CheckNone:
+	default:
+		return nil, fmt.Errorf("unknown check '%s'", config.Check)
+	}
+	return registration, nil
+}
+
+/**
+ * True for the addresses that listen on every interface
+ */
+func isUnspecifiedAddress(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.IsUnspecified()
+}
+
+/**
+ * The host the agent connects to for a TCP check of a listener bound to the ip
+ */
+func tcpCheckHost(ip string) string {
+	if ip == "" || isUnspecifiedAddress(ip) {
+		return "localhost"
+	}
+	return ip
+}
+
+/**
+ * Registers the service, keeps its check up to date in the background, then starts the proxy
+ */
+func (rp *RegisteredProxy) start() error {
+	go rp.maintain()
+	return rp.Proxy.start()
+}
+
+/**
+ * Registers the service, retrying until it succeeds, then renews the TTL of its check
+ * each interval, registering it again whenever the renewal fails
+ */
+func (rp *RegisteredProxy) maintain() {
+	registered := false
+	for {
+		select {
+		case <-rp.stopping.done():
+			return
+		default:
+		}
+
+		if !rp.update(&registered) {
+			return
+		}
+
+		rp.stopping.sleep(rp.checkInterval)
+	}
+}
+
+/**
+ * Registers the service if it is not registered, and renews its TTL. Returns false,
+ * without updating the agent, if the proxy has been stopped
+ */
+func (rp *RegisteredProxy) update(registered *bool) bool {
+	rp.registerMu.Lock()
+	defer rp.registerMu.Unlock()
+
+	select {
+	case <-rp.stopping.done():
+		return false
+	default:
+	}
+
+	if !*registered {
+		*registered = rp.registerService()
+	}
+	if *registered && rp.check == CheckTtl {
+		*registered = rp.renewTtl()
+	}
+	return true
+}
+
+/**
+ * Registers the service with the agent, returning true if it succeeded
+ */
+func (rp *RegisteredProxy) registerService() bool {
+	if err := rp.register(rp.agentAddress, rp.registration); err != nil {
+		log.Printf("Unable to register service %s with the consul agent at %s - %s", rp.registration.ID, rp.agentAddress, err)
+		return false
+	}
+
+	log.Printf("Registered service %s with the consul agent at %s", rp.registration.ID, rp.agentAddress)
+	return true
+}
+
+/**
+ * Sets the status of the TTL check by whether the proxy has backends, returning false
+ * if the agent could not be updated
+ */
+func (rp *RegisteredProxy) renewTtl() bool {
+	status, output := consul.HealthPassing, "proxying to "+rp.discoverer.name()
+	if len(rp.discoverer.getEndpoints()) == 0 {
+		status, output = consul.HealthCritical, errNoEndpoints(rp.discoverer).Error()
+	}
+
+	if err := rp.updateTtl(rp.agentAddress, rp.registration.Check.CheckID, status, output); err != nil {
+		log.Printf("Unable to update the check of service %s, registering it again - %s", rp.registration.ID, err)
+		return false
+	}
+	return true
+}
+
+/**
+ * Deregisters the service, then stops the proxy
+ */
+func (rp *RegisteredProxy) stop() {
+	rp.stopping.stop()
+
+	rp.registerMu.Lock()
+	if err := rp.deregister(rp.agentAddress, rp.registration.ID); err != nil {
+		log.Printf("Unable to deregister service %s - %s", rp.registration.ID, err)
+	} else {
+		log.Printf("Deregistered service %s", rp.registration.ID)
+	}
+	rp.registerMu.Unlock()
+
+	rp.Proxy.stop()
+}
+
+func newAgentClient(consulAddress string) (*consul.Agent, error) {
+	config := consul.DefaultConfig()
+	config.Address = consulAddress
+	config.HttpClient = &http.Client{Transport: config.Transport, Timeout: agentRequestTimeout}
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return client.Agent(), nil
+}
+
+func consulServiceRegister(consulAddress string, registration *consul.AgentServiceRegistration) error {
+	agent, err := newAgentClient(consulAddress)
+	if err != nil {
+		return err
+	}
+	return agent.ServiceRegister(registration)
+}
+
+func consulServiceDeregister(consulAddress string, serviceId string) error {
+	agent, err := newAgentClient(consulAddress)
+	if err != nil {
+		return err
+	}
+	return agent.ServiceDeregister(serviceId)
+}
+
+func consulTtlUpdate(consulAddress string, checkId string, status string, output string) error {
+	agent, err := newAgentClient(consulAddress)
+	if err != nil {
+		return err
+	}
+	return agent.UpdateTTL(checkId, output, status)
+}
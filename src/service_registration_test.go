@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+/**
+ * Records the calls made to the consul agent
+ */
+type stubAgent struct {
+	registered   []*consul.AgentServiceRegistration
+	deregistered []string
+	statuses     []string
+	ttlErr       error
+
+	// the agent address of the last call
+	address string
+	mu           sync.Mutex
+}
+
+func (a *stubAgent) calls() (int, int, []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.registered), len(a.deregistered), append([]string(nil), a.statuses...)
+}
+
+func newTestRegisteredProxy(t *testing.T, service *ProxiedService, discoverer Discoverer) (*RegisteredProxy, *stubAgent) {
+	proxy := &fakeProxy{name: service.ServiceName, started: make(chan bool, 1)}
+	rp, err := NewRegisteredProxy(proxy, discoverer, service)
+	assertNil(t, err)
+
+	agent := &stubAgent{}
+	rp.checkInterval = 10 * time.Millisecond
+	rp.register = func(consulAddress string, registration *consul.AgentServiceRegistration) error {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		agent.registered = append(agent.registered, registration)
+		agent.address = consulAddress
+		return nil
+	}
+	rp.deregister = func(consulAddress string, serviceId string) error {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		agent.deregistered = append(agent.deregistered, serviceId)
+		agent.address = consulAddress
+		return nil
+	}
+	rp.updateTtl = func(consulAddress string, checkId string, status string, output string) error {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		if agent.ttlErr != nil {
+			err := agent.ttlErr
+			agent.ttlErr = nil
+			return err
+		}
+		agent.statuses = append(agent.statuses, status)
+		agent.address = consulAddress
+		return nil
+	}
+	return rp, agent
+}
+
+func TestAgentServiceRegistration(t *testing.T) {
+	service := &ProxiedService{
+		ServiceName: "orders",
+		LocalIP:     "0.0.0.0",
+		LocalPort:   9090,
+		Register:    &ServiceRegistration{Tags: []string{"sidecar"}},
+	}
+
+	registration, err := agentServiceRegistration(service)
+	assertNil(t, err)
+	assertEqual(t, "orders-proxy", registration.Name, "default name")
+	assertEqual(t, "orders-proxy-9090", registration.ID, "default id")
+	assertEqual(t, "", registration.Address, "node address used for a wildcard listener")
+	assertEqual(t, "sidecar", registration.Tags[0], "tags")
+	assertNotNil(t, registration.Check)
+
+	service.LocalIP = "10.0.0.1"
+	service.Register = &ServiceRegistration{Name: "orders-sidecar", Check: CheckNone}
+	registration, err = agentServiceRegistration(service)
+	assertNil(t, err)
+	assertEqual(t, "10.0.0.1", registration.Address, "listener address")
+	assertEqual(t, "orders-sidecar-9090", registration.ID, "id from name")
+	assertEqual(t, true, registration.Check == nil, "no check")
+
+	service.Protocol = ProtocolUdp
+	service.Register = &ServiceRegistration{Check: CheckTcp}
+	_, err = agentServiceRegistration(service)
+	assertNotNil(t, err)
+
+	service.Protocol = ""
+	service.Register = &ServiceRegistration{Check: "http"}
+	_, err = agentServiceRegistration(service)
+	assertNotNil(t, err)
+
+	service.LocalPort = 0
+	service.Register = &ServiceRegistration{}
+	_, err = agentServiceRegistration(service)
+	assertNotNil(t, err)
+}
+
+func TestNewRegisteredProxy_TcpCheck(t *testing.T) {
+	service := &ProxiedService{ServiceName: "orders", LocalPort: 9090, Register: &ServiceRegistration{Check: CheckTcp, CheckIntervalSec: 5}}
+	discoverer, _ := NewStaticDiscoverer("orders", []string{"10.0.0.1:80"})
+
+	rp, _ := newTestRegisteredProxy(t, service, discoverer)
+	assertEqual(t, "localhost:9090", rp.registration.Check.TCP, "check connects to the listener")
+	assertEqual(t, "5s", rp.registration.Check.Interval, "check interval")
+	assertEqual(t, "", rp.registration.Check.TTL, "no TTL")
+}
+
+func TestRegisteredProxy_Ttl(t *testing.T) {
+	service := &ProxiedService{ServiceName: "orders", LocalPort: 9090, Register: &ServiceRegistration{DeregisterCriticalAfterSec: 60}}
+	discoverer := &stubTargetDiscoverer{key: "orders", endpoints: []*Endpoint{{host: "10.0.0.1", port: 80}}}
+
+	rp, agent := newTestRegisteredProxy(t, service, discoverer)
+	assertEqual(t, "1m0s", rp.registration.Check.DeregisterCriticalServiceAfter, "deregister critical after")
+	assertEqual(t, "30s", rp.registration.Check.TTL, "TTL of several intervals")
+
+	go rp.start()
+	time.Sleep(50 * time.Millisecond)
+
+	registered, _, statuses := agent.calls()
+	assertEqual(t, 1, registered, "registered once")
+	assertEqual(t, consul.HealthPassing, statuses[len(statuses)-1], "passing with endpoints")
+
+	discoverer.mu.Lock()
+	discoverer.endpoints = nil
+	discoverer.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+
+	_, _, statuses = agent.calls()
+	assertEqual(t, consul.HealthCritical, statuses[len(statuses)-1], "critical without endpoints")
+
+	// the agent forgot the service
+	agent.mu.Lock()
+	agent.ttlErr = errors.New("CheckID does not have associated TTL")
+	agent.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+
+	registered, _, _ = agent.calls()
+	assertEqual(t, 2, registered, "registered again")
+
+	rp.stop()
+	registered, deregistered, _ := agent.calls()
+	assertEqual(t, 1, deregistered, "deregistered on stop")
+	assertEqual(t, "127.0.0.1:8500", agent.address, "registered with the local agent")
+	assertEqual(t, true, rp.Proxy.(*fakeProxy).stopped, "proxy stopped")
+
+	time.Sleep(50 * time.Millisecond)
+	registeredAfterStop, _, _ := agent.calls()
+	assertEqual(t, registered, registeredAfterStop, "not registered once stopped")
+}
+
+func TestNewRegisteredProxy_AgentAddress(t *testing.T) {
+	service := &ProxiedService{ServiceName: "orders", LocalPort: 9090, Register: &ServiceRegistration{AgentAddress: "10.0.0.5:8500"}}
+	discoverer, _ := NewStaticDiscoverer("orders", []string{"10.0.0.1:80"})
+
+	rp, agent := newTestRegisteredProxy(t, service, discoverer)
+	go rp.start()
+	time.Sleep(50 * time.Millisecond)
+	rp.stop()
+
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	assertEqual(t, "10.0.0.5:8500", agent.address, "registered with the configured agent")
+}
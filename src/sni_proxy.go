@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Proxies TLS connections for many services from a single listener. The server name
+ * (SNI) the client requests in its TLS ClientHello is mapped to a service, and the
+ * raw TLS stream is forwarded to that service's backends without being terminated.
+ */
+type SniProxy struct {
+	// the bind interface, defaults to localhost
+	localIp string
+
+	// the port on local host to attach the proxy to
+	localPort int
+
+	// matches server names, capturing the service name
+	hostPattern *regexp.Regexp
+
+	// server names mapped directly to service names, checked before the pattern
+	routes map[string]string
+
+	// the service used when the server name does not map to a service
+	defaultService string
+
+	// the services the host pattern may route to, nil for any service
+	allowed map[string]bool
+
+	// the services that are always discovered once requested, i.e. those configured
+	// by name. Other services are limited to maxServices, and stop being discovered
+	// once idle for longer than idleTimeout
+	configured  map[string]bool
+	maxServices int
+	idleTimeout time.Duration
+
+	// creates the discoverer for a service the first time it is requested
+	newDiscoverer func(serviceName string) (Discoverer, error)
+
+	// the discoverers of the services requested so far, keyed by service name
+	// must be accessed under discoverersMu
+	discoverers   map[string]*sniBackend
+	discoverersMu sync.Mutex
+
+	// how long a connection waits for the backends of a newly requested service
+	// to be discovered
+	discoveryTimeout time.Duration
+
+	listening proxyListener
+	stopping  stopper
+}
+
+/**
+ * The discoverer for a service, which is ready once it has been started
+ */
+type sniBackend struct {
+	discoverer Discoverer
+	ready      chan struct{}
+
+	// when the service was last requested, must be accessed under discoverersMu
+	lastUsed time.Time
+}
+
+// how long a client has to send its ClientHello once connected
+const clientHelloTimeout = 10 * time.Second
+
+// the services discovered at once for server names matched by the host pattern,
+// when they are not limited to a list of services
+const defaultMaxSniServices = 100
+
+/**
+ * Creates a new proxy that will listen on the local interface at port 'port', and
+ * route connections to services based on their SNI server name.
+ *
+ * The proxy must be started once created
+ */
+func NewSniProxy(listener *SniListener, consulServer *ConsulServerConfig) (*SniProxy, error) {
+	pattern := listener.HostPattern
+	if pattern == "" {
+		pattern = "{service}.*"
+	}
+
+	hostPattern, err := compileHostPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	configured := make(map[string]bool)
+	routes := make(map[string]string)
+	for host, service := range listener.Routes {
+		routes[strings.ToLower(host)] = service
+		configured[service] = true
+	}
+	if listener.DefaultService != "" {
+		configured[listener.DefaultService] = true
+	}
+
+	var allowed map[string]bool
+	if len(listener.Services) != 0 {
+		allowed = make(map[string]bool)
+		for _, service := range listener.Services {
+			allowed[service] = true
+			configured[service] = true
+		}
+	}
+
+	maxServices := listener.MaxServices
+	if maxServices <= 0 {
+		maxServices = defaultMaxSniServices
+	}
+
+	return &SniProxy{
+		localIp:          listener.LocalIP,
+		localPort:        listener.LocalPort,
+		hostPattern:      hostPattern,
+		routes:           routes,
+		defaultService:   listener.DefaultService,
+		allowed:          allowed,
+		configured:       configured,
+		maxServices:      maxServices,
+		idleTimeout:      10 * time.Minute,
+		discoverers:      make(map[string]*sniBackend),
+		discoveryTimeout: 10 * time.Second,
+		newDiscoverer: func(serviceName string) (Discoverer, error) {
+			return NewDiscoverer(&ProxiedService{
+				ServiceName:   serviceName,
+				Datacenter:    listener.Datacenter,
+				Discovery:     listener.Discovery,
+				AddressPolicy: listener.AddressPolicy,
+			}, consulServer)
+		},
+	}, nil
+}
+
+/**
+ * Compiles a host pattern such as '{service}.internal' into a regular expression.
+ * '{service}' matches a single label, which is the service name, and '*' matches
+ * any number of characters.
+ */
+func compileHostPattern(pattern string) (*regexp.Regexp, error) {
+	if strings.Count(pattern, "{service}") != 1 {
+		return nil, fmt.Errorf("host pattern '%s' must contain {service} exactly once", pattern)
+	}
+
+	expr := regexp.QuoteMeta(strings.ToLower(pattern))
+	expr = strings.Replace(expr, regexp.QuoteMeta("{service}"), "([^.]+)", 1)
+	expr = strings.Replace(expr, regexp.QuoteMeta("*"), ".*", -1)
+	return regexp.Compile("^" + expr + "$")
+}
+
+/**
+ * The service a server name is routed to, or empty if it is not routed
+ */
+func (proxy *SniProxy) serviceFor(serverName string) string {
+	serverName = strings.ToLower(serverName)
+
+	if service, ok := proxy.routes[serverName]; ok {
+		return service
+	}
+
+	if match := proxy.hostPattern.FindStringSubmatch(serverName); match != nil && (proxy.allowed == nil || proxy.allowed[match[1]]) {
+		return match[1]
+	}
+	return proxy.defaultService
+}
+
+/**
+ * The discoverer for the service, created and started the first time the service is requested.
+ * Waits up to the discovery timeout for its backends to be discovered.
+ */
+func (proxy *SniProxy) discoverer(serviceName string) (Discoverer, error) {
+	proxy.discoverersMu.Lock()
+	backend, ok := proxy.discoverers[serviceName]
+	if !ok {
+		if !proxy.configured[serviceName] && proxy.unconfiguredServices() >= proxy.maxServices {
+			proxy.discoverersMu.Unlock()
+			return nil, fmt.Errorf("unable to discover service %s, %d services are already being discovered", serviceName, proxy.maxServices)
+		}
+
+		discoverer, err := proxy.newDiscoverer(serviceName)
+		if err != nil {
+			proxy.discoverersMu.Unlock()
+			return nil, err
+		}
+
+		backend = &sniBackend{discoverer: discoverer, ready: make(chan struct{})}
+		proxy.discoverers[serviceName] = backend
+		go func() {
+			discoverer.start()
+			close(backend.ready)
+		}()
+	}
+	backend.lastUsed = time.Now()
+	proxy.discoverersMu.Unlock()
+
+	select {
+	case <-backend.ready:
+		return backend.discoverer, nil
+	case <-time.After(proxy.discoveryTimeout):
+		return nil, fmt.Errorf("timed out discovering service %s", serviceName)
+	}
+}
+
+/**
+ * The number of services being discovered that were not configured by name.
+ * Must be called under discoverersMu
+ */
+func (proxy *SniProxy) unconfiguredServices() int {
+	count := 0
+	for serviceName := range proxy.discoverers {
+		if !proxy.configured[serviceName] {
+			count++
+		}
+	}
+	return count
+}
+
+/**
+ * Stops discovering the services that were not configured by name once they have not
+ * been requested for longer than the idle timeout, until the proxy is stopped
+ */
+func (proxy *SniProxy) removeIdleServices() {
+	interval := proxy.idleTimeout / 4
+	for proxy.stopping.sleep(interval) {
+		proxy.discoverersMu.Lock()
+		for serviceName, backend := range proxy.discoverers {
+			if !proxy.configured[serviceName] && time.Since(backend.lastUsed) >= proxy.idleTimeout {
+				log.Printf("Stopped discovering service %s, which has not been requested for %s", serviceName, proxy.idleTimeout)
+				delete(proxy.discoverers, serviceName)
+				backend.discoverer.stop()
+			}
+		}
+		proxy.discoverersMu.Unlock()
+	}
+}
+
+/**
+ * Starts up the proxy by listening for TCP connections on the specified local port.
+ *
+ * Will loop indefinately as new connections are opened
+ */
+func (proxy *SniProxy) start() error {
+	local := net.JoinHostPort(proxy.localIp, strconv.Itoa(proxy.localPort))
+	listener, err := net.Listen("tcp", local)
+	if err != nil {
+		return fmt.Errorf("unable to bind to the local interface - %s", err)
+	}
+
+	if !proxy.listening.set(listener) {
+		return nil
+	}
+
+	log.Println("Now listening on", listener.Addr(), "for TLS connections routed by SNI")
+	go proxy.removeIdleServices()
+	err = acceptConnections(listener, &proxy.listening, func(conn net.Conn) {
+		go proxy.handle(conn)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to accept connections on %s - %s", listener.Addr(), err)
+	}
+	log.Println("Stopped listening on", listener.Addr(), "for TLS connections routed by SNI")
+	return nil
+}
+
+/**
+ * Stops listening for new connections, and stops discovering the services
+ * requested so far
+ */
+func (proxy *SniProxy) stop() {
+	proxy.listening.stop()
+	proxy.stopping.stop()
+
+	proxy.discoverersMu.Lock()
+	defer proxy.discoverersMu.Unlock()
+	for _, backend := range proxy.discoverers {
+		backend.discoverer.stop()
+	}
+}
+
+/**
+ * Reads the ClientHello of a newly accepted connection, then proxies it to
+ * a backend of the service its server name maps to
+ */
+func (proxy *SniProxy) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, hello, err := peekClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Println("Closing connection from", conn.RemoteAddr(), "- unable to read the TLS ClientHello -", err)
+		conn.Close()
+		return
+	}
+
+	serviceName := proxy.serviceFor(serverName)
+	if serviceName == "" {
+		log.Printf("Closing connection from %s - no service for server name '%s'", conn.RemoteAddr(), serverName)
+		conn.Close()
+		return
+	}
+
+	discoverer, err := proxy.discoverer(serviceName)
+	if err != nil {
+		log.Println("Closing connection from", conn.RemoteAddr(), "-", err)
+		conn.Close()
+		return
+	}
+
+	endpoint := selectEndpoint(discoverer.getEndpoints())
+	if endpoint == nil {
+		log.Println("Closing connection from", conn.RemoteAddr(), "-", errNoEndpoints(discoverer))
+		conn.Close()
+		return
+	}
+
+	log.Printf("Routing server name '%s' to service %s", serverName, serviceName)
+	proxyConnection(&prefixedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(hello), conn)}, endpoint.String(), "", connectionTimeouts{}, nil)
+}
+
+// returned once the ClientHello has been read, to abandon the handshake
+var errClientHelloRead = errors.New("ClientHello read")
+
+/**
+ * Reads the TLS ClientHello from the connection, returning the server name it requests
+ * along with the bytes that were read, so they can be replayed to the backend.
+ */
+func peekClientHello(conn net.Conn) (string, []byte, error) {
+	var read bytes.Buffer
+	var serverName string
+	var helloRead bool
+
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(conn, &read)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			helloRead = true
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+
+	if !helloRead {
+		return "", nil, err
+	}
+	return serverName, read.Bytes(), nil
+}
+
+/**
+ * A connection that can only be read from, used to parse the ClientHello
+ * without sending anything to the client
+ */
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.reader.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+/**
+ * A connection that replays data that has already been read from it
+ */
+type prefixedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *prefixedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCompileHostPattern(t *testing.T) {
+	pattern, err := compileHostPattern("{service}.internal")
+	assertNil(t, err)
+
+	assertEqual(t, "orders", pattern.FindStringSubmatch("orders.internal")[1], "match")
+	assertEqual(t, 0, len(pattern.FindStringSubmatch("orders.internal.example.com")), "no match")
+	assertEqual(t, 0, len(pattern.FindStringSubmatch("ordersxinternal")), "dot is literal")
+
+	pattern, err = compileHostPattern("{service}.*")
+	assertNil(t, err)
+	assertEqual(t, "orders", pattern.FindStringSubmatch("orders.internal.example.com")[1], "wildcard")
+
+	_, err = compileHostPattern("*.internal")
+	assertNotNil(t, err)
+}
+
+func TestSniProxy_serviceFor(t *testing.T) {
+	proxy, err := NewSniProxy(&SniListener{
+		HostPattern:    "{service}.internal",
+		Routes:         map[string]string{"Legacy.Example.com": "legacy-service"},
+		DefaultService: "fallback",
+	}, &ConsulServerConfig{})
+	assertNil(t, err)
+
+	assertEqual(t, "orders", proxy.serviceFor("ORDERS.internal"), "pattern")
+	assertEqual(t, "legacy-service", proxy.serviceFor("legacy.example.com"), "route")
+	assertEqual(t, "fallback", proxy.serviceFor("unknown.example.com"), "default")
+	assertEqual(t, "fallback", proxy.serviceFor(""), "no SNI")
+}
+
+/**
+ * Routes TLS connections for two server names to two different TLS backends
+ */
+func TestSniProxy(t *testing.T) {
+	backends := make(map[string]string)
+	for _, service := range []string{"orders", "payments"} {
+		name := service
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "Hello from %s", name)
+		}))
+		defer server.Close()
+		backends[service] = server.Listener.Addr().String()
+	}
+
+	proxyPort := getFreePort()
+	proxy, err := NewSniProxy(&SniListener{
+		LocalIP:     "127.0.0.1",
+		LocalPort:   proxyPort,
+		HostPattern: "{service}.internal",
+	}, &ConsulServerConfig{})
+	assertNil(t, err)
+
+	proxy.newDiscoverer = func(serviceName string) (Discoverer, error) {
+		return NewStaticDiscoverer(serviceName, []string{backends[serviceName]})
+	}
+	go proxy.start()
+	time.Sleep(200 * time.Millisecond)
+
+	proxyAddress := net.JoinHostPort("127.0.0.1", strconv.Itoa(proxyPort))
+	for _, service := range []string{"orders", "payments", "orders"} {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: service + ".internal"},
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("tcp", proxyAddress)
+				},
+			},
+		}
+
+		response, err := client.Get("https://" + service + ".internal/")
+		assertNil(t, err)
+
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assertNil(t, err)
+		assertEqual(t, "Hello from "+service, string(body), "routed response")
+	}
+
+	assertEqual(t, 2, len(proxy.discoverers), "one discoverer per service")
+}
+
+func TestSniProxy_NotTls(t *testing.T) {
+	proxyPort := getFreePort()
+	proxy, err := NewSniProxy(&SniListener{LocalIP: "127.0.0.1", LocalPort: proxyPort}, &ConsulServerConfig{})
+	assertNil(t, err)
+	go proxy.start()
+	time.Sleep(200 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(proxyPort)))
+	assertNil(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: orders.internal\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assertNotNil(t, err)
+}
+
+func TestSniProxy_serviceFor_Services(t *testing.T) {
+	proxy, err := NewSniProxy(&SniListener{
+		HostPattern: "{service}.internal",
+		Services:    []string{"orders"},
+	}, &ConsulServerConfig{})
+	assertNil(t, err)
+
+	assertEqual(t, "orders", proxy.serviceFor("orders.internal"), "listed service")
+	assertEqual(t, "", proxy.serviceFor("anything.internal"), "unlisted service")
+}
+
+/**
+ * Services requested by server names matching the pattern are limited, and stop being
+ * discovered once idle, while configured services are not
+ */
+func TestSniProxy_discoverer_Limits(t *testing.T) {
+	proxy, err := NewSniProxy(&SniListener{
+		Routes:      map[string]string{"legacy.example.com": "legacy"},
+		MaxServices: 1,
+	}, &ConsulServerConfig{})
+	assertNil(t, err)
+
+	stopped := make(map[string]*stubTargetDiscoverer)
+	proxy.newDiscoverer = func(serviceName string) (Discoverer, error) {
+		stopped[serviceName] = &stubTargetDiscoverer{key: serviceName}
+		return stopped[serviceName], nil
+	}
+	proxy.idleTimeout = 100 * time.Millisecond
+
+	_, err = proxy.discoverer("orders")
+	assertNil(t, err)
+	_, err = proxy.discoverer("payments")
+	assertNotNil(t, err)
+	_, err = proxy.discoverer("legacy")
+	assertNil(t, err)
+
+	go proxy.removeIdleServices()
+	defer proxy.stop()
+	time.Sleep(300 * time.Millisecond)
+
+	proxy.discoverersMu.Lock()
+	assertEqual(t, 1, len(proxy.discoverers), "idle service removed")
+	proxy.discoverersMu.Unlock()
+	stopped["orders"].mu.Lock()
+	assertEqual(t, true, stopped["orders"].stopped, "idle discoverer stopped")
+	stopped["orders"].mu.Unlock()
+
+	_, err = proxy.discoverer("payments")
+	assertNil(t, err)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+/**
+ * Splits traffic between several services, or tagged subsets of services, in proportion
+ * to their weights. The endpoints of every split are returned together, weighted so that
+ * selectEndpoint chooses each split in proportion to its weight, whatever the number of
+ * endpoints in each. Splits without any endpoints are left out, so their share of the
+ * traffic goes to the other splits.
+ *
+ * The weights can be overridden by a JSON object in the consul KV store, which is watched
+ * so that e.g. a canary can be ramped up without restarting the proxy. Splits missing from
+ * the object, or every split if the key is deleted, use their configured weights.
+ */
+type SplitDiscoverer struct {
+	// the name of the proxied service, used for logging
+	serviceName string
+
+	// the splits, in the order they were configured
+	splits []*split
+
+	// the weight of each split by name
+	// must be accessed under weightsMu
+	weights   map[string]int
+	weightsMu sync.Mutex
+
+	// the consul KV key the weights are read from, empty if they are not
+	weightsKey string
+
+	consulServer *ConsulServerConfig
+	dnsSrv       DnsSrvLookup
+	consulKv     ConsulKvLookup
+
+	// how long to wait before retrying a failed read of the weights
+	retryInterval time.Duration
+
+	stopping stopper
+}
+
+type split struct {
+	name       string
+	discoverer Discoverer
+
+	// the configured weight, used unless it is overridden in the KV store
+	weight int
+}
+
+// the total weight shared by the endpoints of all of the splits, which keeps the
+// weight of each endpoint within the uint16 range used for SRV weights
+const splitTotalWeight = 60000
+
+/**
+ * Creates a discoverer for each of the splits of the service, which are discovered
+ * in the same way as the service
+ */
+func NewSplitDiscoverer(service *ProxiedService, consulServer *ConsulServerConfig) (*SplitDiscoverer, error) {
+	sd := &SplitDiscoverer{
+		serviceName:   service.ServiceName,
+		weights:       make(map[string]int),
+		weightsKey:    service.SplitWeightsKey,
+		consulServer:  consulServer,
+		dnsSrv:        dnsSrvLookup,
+		consulKv:      consulKvLookup,
+		retryInterval: 10 * time.Second,
+	}
+
+	for _, s := range service.Splits {
+		if s.ServiceName == "" {
+			return nil, errors.New("splits must specify a ServiceName")
+		}
+		if s.Weight < 0 {
+			return nil, fmt.Errorf("split of service %s has a negative weight", s.ServiceName)
+		}
+
+		name := splitName(s)
+		if _, ok := sd.weights[name]; ok {
+			return nil, fmt.Errorf("there is more than one split named '%s'", name)
+		}
+
+		discoverer, err := NewDiscoverer(splitService(service, s), consulServer)
+		if err != nil {
+			return nil, err
+		}
+
+		sd.splits = append(sd.splits, &split{name: name, discoverer: discoverer, weight: s.Weight})
+		sd.weights[name] = s.Weight
+	}
+	return sd, nil
+}
+
+/**
+ * The name the weight of the split is given under
+ */
+func splitName(s *ServiceSplit) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	if s.ServiceTag != "" {
+		return s.ServiceTag + "." + s.ServiceName
+	}
+	return s.ServiceName
+}
+
+/**
+ * The service a split is sent to, discovered in the same way as the proxied service
+ */
+func splitService(service *ProxiedService, s *ServiceSplit) *ProxiedService {
+	split := *service
+	split.ServiceName = s.ServiceName
+	split.ServiceTag = s.ServiceTag
+	if s.Datacenter != "" {
+		split.Datacenter = s.Datacenter
+	}
+	split.Endpoints = s.Endpoints
+	split.EndpointsFile = s.EndpointsFile
+	split.DnsName = ""
+	split.Splits = nil
+	split.SplitWeightsKey = ""
+	return &split
+}
+
+/**
+ * Starts every split, and the watch of the weights in the KV store if there is one.
+ * Blocks until every split has started.
+ */
+func (sd *SplitDiscoverer) start() {
+	var wg sync.WaitGroup
+	for _, s := range sd.splits {
+		wg.Add(1)
+		go func(discoverer Discoverer) {
+			defer wg.Done()
+			discoverer.start()
+		}(s.discoverer)
+	}
+
+	if sd.weightsKey != "" {
+		index, err := sd.refreshWeights(0)
+		if err != nil {
+			log.Printf("Unable to read the split weights of service %s from %s, using the configured weights - %s", sd.serviceName, sd.weightsKey, err)
+		}
+		go sd.watchWeights(index)
+	}
+
+	wg.Wait()
+	log.Printf("Splitting service %s between %s", sd.serviceName, sd.weightsString())
+}
+
+/**
+ * Reads the weights from the KV store, once they change from the index
+ */
+func (sd *SplitDiscoverer) watchWeights(index uint64) {
+	for {
+		select {
+		case <-sd.stopping.done():
+			return
+		default:
+		}
+
+		next, err := sd.refreshWeights(index)
+		if err != nil {
+			log.Printf("Unable to read the split weights of service %s from %s - %s", sd.serviceName, sd.weightsKey, err)
+
+			// unless the weights were read but are invalid, in which case they are
+			// not read again until they change
+			if next == 0 {
+				sd.stopping.sleep(sd.retryInterval)
+				continue
+			}
+		}
+
+		// the index going backwards means the KV store was reset
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+/**
+ * Reads the weights from the KV store, blocking until they change if 'waitIndex' is non-zero.
+ * Splits without a weight in the KV store revert to their configured weights. Returns the
+ * index of the key.
+ */
+func (sd *SplitDiscoverer) refreshWeights(waitIndex uint64) (uint64, error) {
+	server, err := findConsulServer(sd.consulServer, sd.dnsSrv)
+	if err != nil {
+		return 0, err
+	}
+
+	value, index, err := sd.consulKv(server, sd.weightsKey, waitIndex)
+	if err != nil {
+		return 0, err
+	}
+
+	// a deleted key leaves no weights, so every split reverts to its configured weight
+	var weights map[string]int
+	if value != nil {
+		if err := json.Unmarshal(value, &weights); err != nil {
+			return index, fmt.Errorf("invalid split weights %s - %s", value, err)
+		}
+	}
+
+	sd.weightsMu.Lock()
+	for name := range weights {
+		if _, ok := sd.weights[name]; !ok {
+			log.Printf("Ignoring the weight of unknown split '%s' of service %s", name, sd.serviceName)
+		}
+	}
+
+	changed := false
+	for _, s := range sd.splits {
+		weight := s.weight
+		if override, ok := weights[s.name]; ok && override < 0 {
+			log.Printf("Ignoring the negative weight of split '%s' of service %s", s.name, sd.serviceName)
+		} else if ok {
+			weight = override
+		}
+
+		if weight != sd.weights[s.name] {
+			sd.weights[s.name] = weight
+			changed = true
+		}
+	}
+	sd.weightsMu.Unlock()
+
+	if changed {
+		log.Printf("Splitting service %s between %s", sd.serviceName, sd.weightsString())
+	}
+	return index, nil
+}
+
+func (sd *SplitDiscoverer) weightsString() string {
+	sd.weightsMu.Lock()
+	defer sd.weightsMu.Unlock()
+
+	var description string
+	for i, s := range sd.splits {
+		if i > 0 {
+			description += ", "
+		}
+		description += fmt.Sprintf("%s (weight %d)", s.name, sd.weights[s.name])
+	}
+	return description
+}
+
+/**
+ * The endpoints of every split with a weight, weighted so that each split is
+ * chosen in proportion to its weight
+ */
+func (sd *SplitDiscoverer) getEndpoints() []*Endpoint {
+	sd.weightsMu.Lock()
+	var splitWeights []int
+	for _, s := range sd.splits {
+		splitWeights = append(splitWeights, sd.weights[s.name])
+	}
+	sd.weightsMu.Unlock()
+
+	var splitEndpoints [][]*Endpoint
+	for _, s := range sd.splits {
+		splitEndpoints = append(splitEndpoints, s.discoverer.getEndpoints())
+	}
+	return weightEndpoints(splitWeights, splitEndpoints)
+}
+
+/**
+ * Combines the endpoints of several splits, weighting each endpoint so that selectEndpoint
+ * chooses each split in proportion to its weight. Splits without a weight or without any
+ * endpoints are left out.
+ *
+ * Within a split, only the endpoints with the lowest SRV priority are used, and they share
+ * the weight of the split in proportion to their SRV weights, as selectEndpoint would
+ * choose between them. Endpoints with a zero SRV weight are given a small share when
+ * others have weights, as described by RFC 2782.
+ */
+func weightEndpoints(weights []int, splitEndpoints [][]*Endpoint) []*Endpoint {
+	lowest := make([][]*Endpoint, len(splitEndpoints))
+	for i, endpoints := range splitEndpoints {
+		lowest[i] = lowestPriority(endpoints)
+	}
+	splitEndpoints = lowest
+
+	totalWeight := 0
+	for i, endpoints := range splitEndpoints {
+		if weights[i] > 0 && len(endpoints) != 0 {
+			totalWeight += weights[i]
+		}
+	}
+
+	var weighted []*Endpoint
+	for i, endpoints := range splitEndpoints {
+		if weights[i] <= 0 || len(endpoints) == 0 {
+			continue
+		}
+
+		srvWeight := 0
+		for _, endpoint := range endpoints {
+			srvWeight += int(endpoint.weight)
+		}
+
+		for _, endpoint := range endpoints {
+			var weight int
+			if srvWeight == 0 {
+				weight = splitTotalWeight * weights[i] / (totalWeight * len(endpoints))
+			} else {
+				weight = splitTotalWeight * weights[i] / totalWeight * int(endpoint.weight) / srvWeight
+			}
+			if weight < 1 {
+				weight = 1
+			}
+
+			weighted = append(weighted, &Endpoint{
+				host:   endpoint.host,
+				port:   endpoint.port,
+				weight: uint16(weight),
+			})
+		}
+	}
+	return weighted
+}
+
+/**
+ * The endpoints with the lowest SRV priority
+ */
+func lowestPriority(endpoints []*Endpoint) []*Endpoint {
+	var lowest []*Endpoint
+	for _, endpoint := range endpoints {
+		if len(lowest) == 0 || endpoint.priority < lowest[0].priority {
+			lowest = []*Endpoint{endpoint}
+		} else if endpoint.priority == lowest[0].priority {
+			lowest = append(lowest, endpoint)
+		}
+	}
+	return lowest
+}
+
+func (sd *SplitDiscoverer) name() string {
+	return sd.serviceName
+}
+
+/**
+ * Stops every split, and the watch of the weights
+ */
+func (sd *SplitDiscoverer) stop() {
+	sd.stopping.stop()
+	for _, s := range sd.splits {
+		s.discoverer.stop()
+	}
+}
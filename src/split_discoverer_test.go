@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+)
+
+/**
+ * The fraction of the endpoints chosen by selectEndpoint that are in the set
+ */
+func selectedFraction(endpoints []*Endpoint, in map[string]bool) float64 {
+	selected := 0
+	for i := 0; i < 10000; i++ {
+		if in[selectEndpoint(endpoints).String()] {
+			selected++
+		}
+	}
+	return float64(selected) / 10000
+}
+
+func newTestSplitDiscoverer(t *testing.T, splitWeightsKey string) *SplitDiscoverer {
+	discoverer, err := NewDiscoverer(&ProxiedService{
+		ServiceName: "orders",
+		Discovery:   DiscoveryStatic,
+		Splits: []*ServiceSplit{
+			{ServiceName: "orders", Weight: 95, Endpoints: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}},
+			{ServiceName: "orders", ServiceTag: "canary", Weight: 5, Endpoints: []string{"10.0.1.1:80"}},
+		},
+		SplitWeightsKey: splitWeightsKey,
+	}, &ConsulServerConfig{Address: "consul:8500"})
+	assertNil(t, err)
+	return discoverer.(*SplitDiscoverer)
+}
+
+func TestSplitDiscoverer(t *testing.T) {
+	sd := newTestSplitDiscoverer(t, "")
+	sd.start()
+
+	endpoints := sd.getEndpoints()
+	assertEqual(t, 4, len(endpoints), "endpoints of every split")
+
+	canary := selectedFraction(endpoints, map[string]bool{"10.0.1.1:80": true})
+	if canary < 0.03 || canary > 0.07 {
+		t.Errorf("Expected about 5%% of connections to go to the canary, got %.1f%%", canary*100)
+	}
+}
+
+func TestSplitDiscoverer_EmptySplit(t *testing.T) {
+	sd := newTestSplitDiscoverer(t, "")
+	sd.splits[0].discoverer = &StaticDiscoverer{serviceName: "orders"}
+
+	endpoints := sd.getEndpoints()
+	assertEqual(t, 1, len(endpoints), "split without endpoints is left out")
+	assertEqual(t, "10.0.1.1:80", endpoints[0].String(), "remaining split")
+}
+
+func TestSplitDiscoverer_WeightsFromKv(t *testing.T) {
+	sd := newTestSplitDiscoverer(t, "weights/orders")
+
+	updates := make(chan []byte)
+	sd.consulKv = func(consulAddress string, key string, waitIndex uint64) ([]byte, uint64, error) {
+		assertEqual(t, "consul:8500", consulAddress, "consul address")
+		assertEqual(t, "weights/orders", key, "weights key")
+		if waitIndex == 0 {
+			return []byte(`{"orders": 0, "canary.orders": 100}`), 1, nil
+		}
+		return <-updates, waitIndex + 1, nil
+	}
+	sd.start()
+
+	endpoints := sd.getEndpoints()
+	assertEqual(t, 1, len(endpoints), "only the canary has a weight")
+	assertEqual(t, "10.0.1.1:80", endpoints[0].String(), "canary endpoint")
+
+	updates <- []byte(`{"orders": 50, "canary.orders": 50}`)
+	updates <- []byte(`{"orders": 50, "canary.orders": 50}`)
+	endpoints = sd.getEndpoints()
+	canary := selectedFraction(endpoints, map[string]bool{"10.0.1.1:80": true})
+	if canary < 0.45 || canary > 0.55 {
+		t.Errorf("Expected about 50%% of connections to go to the canary, got %.1f%%", canary*100)
+	}
+
+	// a split removed from the weights reverts to its configured weight
+	updates <- []byte(`{"canary.orders": 50}`)
+	updates <- []byte(`{"canary.orders": 50}`)
+	assertEqual(t, "orders (weight 95), canary.orders (weight 50)", sd.weightsString(), "weights")
+
+	// as does every split once the key is deleted
+	updates <- nil
+	updates <- nil
+	assertEqual(t, "orders (weight 95), canary.orders (weight 5)", sd.weightsString(), "weights")
+}
+
+func TestWeightEndpoints_SrvPriorityAndWeight(t *testing.T) {
+	endpoints := weightEndpoints([]int{50, 50}, [][]*Endpoint{
+		{
+			{host: "10.0.0.1", port: 80, priority: 1, weight: 30},
+			{host: "10.0.0.2", port: 80, priority: 1, weight: 10},
+			{host: "10.0.0.3", port: 80, priority: 2, weight: 100},
+		},
+		{
+			{host: "10.0.1.1", port: 80},
+			{host: "10.0.1.2", port: 80},
+		},
+	})
+	assertEqual(t, 4, len(endpoints), "only the endpoints with the lowest priority of each split")
+
+	weights := make(map[string]uint16)
+	for _, endpoint := range endpoints {
+		assertEqual(t, uint16(0), endpoint.priority, "splits combined at one priority")
+		weights[endpoint.host] = endpoint.weight
+	}
+	assertEqual(t, uint16(22500), weights["10.0.0.1"], "share of the split by SRV weight")
+	assertEqual(t, uint16(7500), weights["10.0.0.2"], "share of the split by SRV weight")
+	assertEqual(t, uint16(15000), weights["10.0.1.1"], "equal share without SRV weights")
+	assertEqual(t, uint16(15000), weights["10.0.1.2"], "equal share without SRV weights")
+}
+
+func TestNewSplitDiscoverer_DuplicateNames(t *testing.T) {
+	_, err := NewDiscoverer(&ProxiedService{
+		Discovery: DiscoveryStatic,
+		Splits: []*ServiceSplit{
+			{ServiceName: "orders", Weight: 1, Endpoints: []string{"10.0.0.1:80"}},
+			{ServiceName: "orders", Weight: 1, Endpoints: []string{"10.0.0.2:80"}},
+		},
+	}, &ConsulServerConfig{})
+	assertNotNil(t, err)
+}
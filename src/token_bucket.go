@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+ * A token bucket, refilled at a steady rate up to its burst size, limiting how
+ * often something can happen
+ */
+type tokenBucket struct {
+	// the tokens added each second, and the most the bucket holds
+	rate  float64
+	burst float64
+
+	// must be accessed under mu
+	tokens float64
+	last   time.Time
+
+	mu sync.Mutex
+}
+
+/**
+ * A bucket that is full at 'now'. A burst of less than 1 defaults to the rate, or 1 if lower
+ */
+func newTokenBucket(rate float64, burst float64, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// must be called under mu
+func (tb *tokenBucket) refill(now time.Time) {
+	if now.After(tb.last) {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+	}
+}
+
+/**
+ * Takes a token if one is available, returning false if the bucket is empty
+ */
+func (tb *tokenBucket) take(now time.Time) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(now)
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+/**
+ * True if the bucket has been left long enough to be full again
+ */
+func (tb *tokenBucket) full(now time.Time) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(now)
+	return tb.tokens >= tb.burst
+}
+
+/**
+ * Takes 'n' tokens, even if the bucket does not hold them yet, returning how long
+ * to wait for the tokens that were missing to be added
+ */
+func (tb *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(now)
+	tb.tokens -= n
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_take(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(10, 2, now)
+
+	assertEqual(t, true, bucket.take(now), "first token of the burst")
+	assertEqual(t, true, bucket.take(now), "second token of the burst")
+	assertEqual(t, false, bucket.take(now), "burst used up")
+
+	now = now.Add(100 * time.Millisecond)
+	assertEqual(t, true, bucket.take(now), "token refilled after 1/rate seconds")
+	assertEqual(t, false, bucket.take(now), "only one token refilled")
+
+	now = now.Add(time.Hour)
+	assertEqual(t, true, bucket.full(now), "refilled")
+	assertEqual(t, 2.0, bucket.tokens, "refilled up to the burst")
+}
+
+func TestTokenBucket_DefaultBurst(t *testing.T) {
+	assertEqual(t, 5.0, newTokenBucket(5, 0, time.Now()).burst, "burst defaults to the rate")
+	assertEqual(t, 1.0, newTokenBucket(0.5, 0, time.Now()).burst, "burst is at least 1")
+}
+
+func TestTokenBucket_reserve(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(1000, 0, now)
+
+	assertEqual(t, time.Duration(0), bucket.reserve(1000, now), "burst available")
+	assertEqual(t, 500*time.Millisecond, bucket.reserve(500, now), "wait for the missing tokens")
+	assertEqual(t, time.Second, bucket.reserve(500, now), "reservations queue up")
+	assertEqual(t, time.Duration(0), bucket.reserve(0, now.Add(time.Second)), "refilled")
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Relays UDP datagrams to a backend that is dynamically updated based on
+ * the discovered endpoints.
+ *
+ * Each client address is mapped to a session with its own socket to the backend
+ * chosen when the first datagram from that client arrives, so replies from the
+ * backend can be relayed to the right client. Sessions are closed once no datagrams
+ * have been exchanged for the idle timeout.
+ */
+type UdpProxy struct {
+	// the bind interface, defaults to localhost
+	localIp string
+
+	// the port on local host to attach the proxy to
+	localPort int
+
+	// handles looking up the currently active set of backend
+	// associated with this proxy instance
+	discoverer Discoverer
+
+	// how long a session may go without any datagrams before it is closed
+	idleTimeout time.Duration
+
+	// the most sessions open at once
+	maxSessions int
+
+	// the active sessions keyed by client address
+	// must be accessed under sessionsMu
+	sessions   map[string]*udpSession
+	sessionsMu sync.Mutex
+
+	listening proxyListener
+}
+
+/**
+ * The flow between a single client and its backend
+ */
+type udpSession struct {
+	client  *net.UDPAddr
+	backend *net.UDPConn
+
+	// when a datagram was last relayed in either direction, in unix nanos
+	lastActive int64
+}
+
+func (session *udpSession) touch() {
+	atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+}
+
+func (session *udpSession) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&session.lastActive)))
+}
+
+/**
+ * Creates a new proxy that will listen for UDP datagrams on the local interface at
+ * port 'port' and relay them to the backends of the service.
+ *
+ * The proxy must be started once created
+ */
+func NewUdpProxy(service *ProxiedService, discoverer Discoverer) *UdpProxy {
+	idleTimeout := time.Duration(service.UdpIdleTimeoutSec) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = 60 * time.Second
+	}
+	maxSessions := service.MaxUdpSessions
+	if maxSessions <= 0 {
+		maxSessions = 1000
+	}
+
+	return &UdpProxy{
+		localIp:     service.LocalIP,
+		localPort:   service.LocalPort,
+		discoverer:  discoverer,
+		idleTimeout: idleTimeout,
+		maxSessions: maxSessions,
+		sessions:    make(map[string]*udpSession),
+	}
+}
+
+/**
+ * Resolves the local UDP address that the proxy will bind to
+ */
+func (proxy *UdpProxy) local() (*net.UDPAddr, error) {
+	var local = net.JoinHostPort(proxy.localIp, strconv.Itoa(proxy.localPort))
+	return net.ResolveUDPAddr("udp", local)
+}
+
+/**
+ * Starts up the proxy by discovering the backends of the service, then listening for
+ * UDP datagrams on the specified local port.
+ *
+ * Will loop indefinately as datagrams are received
+ */
+func (proxy *UdpProxy) start() error {
+	proxy.discoverer.start()
+
+	localAddress, err := proxy.local()
+	if err != nil {
+		return fmt.Errorf("unable to resolve the local interface - %s", err)
+	}
+
+	listener, err := net.ListenUDP("udp", localAddress)
+	if err != nil {
+		return fmt.Errorf("unable to bind to the local interface - %s", err)
+	}
+
+	if !proxy.listening.set(listener) {
+		return nil
+	}
+
+	log.Println("Now listening on", localAddress, "(udp) for service", proxy.discoverer.name())
+
+	buffer := make([]byte, 64*1024)
+	var delay time.Duration
+	for {
+		n, client, err := listener.ReadFromUDP(buffer)
+		if err != nil {
+			if proxy.listening.isStopped() {
+				log.Println("Stopped listening on", localAddress, "for service", proxy.discoverer.name())
+				return nil
+			}
+			delay = nextRetryDelay(delay)
+			log.Printf("Error reading from %s, retrying in %s - %s", localAddress, delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		session, err := proxy.session(listener, client)
+		if err != nil {
+			log.Println("Dropping datagram from", client, "-", err)
+			continue
+		}
+
+		session.touch()
+		if _, err := session.backend.Write(buffer[:n]); err != nil {
+			log.Println("Error relaying datagram from", client, "to", session.backend.RemoteAddr(), "-", err)
+		}
+	}
+}
+
+/**
+ * Stops receiving datagrams. Sessions that are already open are closed once idle,
+ * since their replies can no longer be relayed
+ */
+func (proxy *UdpProxy) stop() {
+	proxy.listening.stop()
+	proxy.discoverer.stop()
+}
+
+/**
+ * Finds the session for the client, creating one to a newly chosen backend if
+ * the client does not have an active session and there are fewer than the most
+ * sessions allowed.
+ *
+ * Sessions are only created by the loop receiving datagrams, so the lock is not held
+ * while the backend is resolved, which may need a DNS lookup, and dialed.
+ */
+func (proxy *UdpProxy) session(listener *net.UDPConn, client *net.UDPAddr) (*udpSession, error) {
+	proxy.sessionsMu.Lock()
+	session, ok := proxy.sessions[client.String()]
+	count := len(proxy.sessions)
+	proxy.sessionsMu.Unlock()
+
+	if ok {
+		return session, nil
+	}
+	if count >= proxy.maxSessions {
+		return nil, fmt.Errorf("already relaying the most sessions (%d)", proxy.maxSessions)
+	}
+
+	endpoint := selectEndpoint(proxy.discoverer.getEndpoints())
+	if endpoint == nil {
+		return nil, errNoEndpoints(proxy.discoverer)
+	}
+
+	remote, err := resolveUdpEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("UdpProxy is relaying %s to %s", client, remote)
+
+	session = &udpSession{
+		client:  client,
+		backend: backend,
+	}
+	session.touch()
+
+	proxy.sessionsMu.Lock()
+	proxy.sessions[client.String()] = session
+	proxy.sessionsMu.Unlock()
+
+	go proxy.relayReplies(listener, session)
+	return session, nil
+}
+
+/**
+ * The UDP address of the endpoint, only looking up its host if it is not an ip
+ */
+func resolveUdpEndpoint(endpoint *Endpoint) (*net.UDPAddr, error) {
+	if ip := net.ParseIP(endpoint.host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: endpoint.port}, nil
+	}
+	return net.ResolveUDPAddr("udp", endpoint.String())
+}
+
+/**
+ * Relays datagrams from the backend to the client, until the session is idle
+ * for longer than the idle timeout.
+ */
+func (proxy *UdpProxy) relayReplies(listener *net.UDPConn, session *udpSession) {
+	defer proxy.closeSession(session)
+
+	buffer := make([]byte, 64*1024)
+	for {
+		session.backend.SetReadDeadline(time.Now().Add(proxy.idleTimeout - session.idleFor()))
+		n, err := session.backend.Read(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				// another datagram may have been relayed since the deadline was set
+				if session.idleFor() < proxy.idleTimeout {
+					continue
+				}
+			} else {
+				log.Println("Error reading from", session.backend.RemoteAddr(), "-", err)
+			}
+			return
+		}
+
+		session.touch()
+		if _, err := listener.WriteToUDP(buffer[:n], session.client); err != nil {
+			log.Println("Error relaying datagram to", session.client, "-", err)
+		}
+	}
+}
+
+func (proxy *UdpProxy) closeSession(session *udpSession) {
+	proxy.sessionsMu.Lock()
+	delete(proxy.sessions, session.client.String())
+	proxy.sessionsMu.Unlock()
+
+	session.backend.Close()
+	log.Printf("Closed UDP session from %s to %s", session.client, session.backend.RemoteAddr())
+}
+
+/**
+ * The number of active sessions
+ */
+func (proxy *UdpProxy) sessionCount() int {
+	proxy.sessionsMu.Lock()
+	defer proxy.sessionsMu.Unlock()
+	return len(proxy.sessions)
+}
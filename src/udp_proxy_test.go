@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+/**
+ * Starts a UDP server that echoes each datagram back, prefixed with 'echo:'
+ */
+func startUdpEchoServer(t *testing.T) *net.UDPConn {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assertNil(t, err)
+
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, client, err := server.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			server.WriteToUDP(append([]byte("echo:"), buffer[:n]...), client)
+		}
+	}()
+	return server
+}
+
+func TestUdpProxy(t *testing.T) {
+	backend := startUdpEchoServer(t)
+	defer backend.Close()
+
+	proxyPort := getFreePort()
+	proxied := &ProxiedService{
+		ServiceName:       "my-udp-service",
+		LocalIP:           "127.0.0.1",
+		LocalPort:         proxyPort,
+		Protocol:          ProtocolUdp,
+		UdpIdleTimeoutSec: 1,
+	}
+
+	discoverer, err := NewStaticDiscoverer("my-udp-service", []string{backend.LocalAddr().String()})
+	assertNil(t, err)
+
+	proxy, err := NewProxy(proxied, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	udpProxy := proxy.(*UdpProxy)
+	go udpProxy.start()
+	time.Sleep(200 * time.Millisecond)
+
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: proxyPort})
+	assertNil(t, err)
+	defer client.Close()
+
+	buffer := make([]byte, 1024)
+	for _, message := range []string{"hello", "world"} {
+		_, err = client.Write([]byte(message))
+		assertNil(t, err)
+
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := client.Read(buffer)
+		assertNil(t, err)
+		assertEqual(t, "echo:"+message, string(buffer[:n]), "relayed reply")
+	}
+
+	assertEqual(t, 1, udpProxy.sessionCount(), "one session per client")
+
+	time.Sleep(1500 * time.Millisecond)
+	assertEqual(t, 0, udpProxy.sessionCount(), "idle session closed")
+}
+
+func TestUdpProxy_MaxSessions(t *testing.T) {
+	backend := startUdpEchoServer(t)
+	defer backend.Close()
+
+	proxyPort := getFreePort()
+	proxied := &ProxiedService{
+		ServiceName:    "my-udp-service",
+		LocalIP:        "127.0.0.1",
+		LocalPort:      proxyPort,
+		Protocol:       ProtocolUdp,
+		MaxUdpSessions: 1,
+	}
+
+	discoverer, err := NewStaticDiscoverer("my-udp-service", []string{backend.LocalAddr().String()})
+	assertNil(t, err)
+
+	proxy, err := NewProxy(proxied, discoverer, &ConsulServerConfig{})
+	assertNil(t, err)
+	udpProxy := proxy.(*UdpProxy)
+	go udpProxy.start()
+	defer udpProxy.stop()
+	time.Sleep(200 * time.Millisecond)
+
+	buffer := make([]byte, 1024)
+	first, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: proxyPort})
+	assertNil(t, err)
+	defer first.Close()
+
+	_, err = first.Write([]byte("hello"))
+	assertNil(t, err)
+	first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := first.Read(buffer)
+	assertNil(t, err)
+	assertEqual(t, "echo:hello", string(buffer[:n]), "relayed reply")
+
+	second, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: proxyPort})
+	assertNil(t, err)
+	defer second.Close()
+
+	_, err = second.Write([]byte("hello"))
+	assertNil(t, err)
+	second.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, err = second.Read(buffer)
+	assertNotNil(t, err)
+	assertEqual(t, 1, udpProxy.sessionCount(), "datagrams from new clients dropped")
+}
+
+func TestUdpProxy_start_UnresolvableAddress(t *testing.T) {
+	discoverer, err := NewStaticDiscoverer("my-udp-service", []string{"127.0.0.1:1"})
+	assertNil(t, err)
+	proxy := NewUdpProxy(&ProxiedService{LocalIP: "127.0.0.1", LocalPort: 70000, Protocol: ProtocolUdp}, discoverer)
+
+	assertNotNil(t, proxy.start())
+	proxy.stop()
+}
+
+func TestResolveUdpEndpoint(t *testing.T) {
+	remote, err := resolveUdpEndpoint(&Endpoint{host: "10.0.0.1", port: 53})
+	assertNil(t, err)
+	assertEqual(t, "10.0.0.1:53", remote.String(), "ip used as is")
+
+	remote, err = resolveUdpEndpoint(&Endpoint{host: "::1", port: 53})
+	assertNil(t, err)
+	assertEqual(t, "[::1]:53", remote.String(), "ipv6 used as is")
+
+	remote, err = resolveUdpEndpoint(&Endpoint{host: "localhost", port: 53})
+	assertNil(t, err)
+	assertEqual(t, 53, remote.Port, "host looked up")
+}
+
+func TestNewProxy_UnknownProtocol(t *testing.T) {
+	discoverer, _ := NewStaticDiscoverer("my-service", []string{"127.0.0.1:1234"})
+	_, err := NewProxy(&ProxiedService{Protocol: "sctp"}, discoverer, &ConsulServerConfig{})
+
+	assertNotNil(t, err)
+}
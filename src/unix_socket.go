@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+/**
+ * This file contains the logic for listening on unix domain sockets
+ */
+
+/**
+ * Listens on the unix socket at the path, replacing any stale socket left behind
+ * by a previous process, then applies the file mode and ownership.
+ *
+ * mode - the octal file mode of the socket e.g. '0660', or empty to use the umask
+ * owner, group - the user and group (names or ids) that should own the socket, or empty
+ *                to leave them unchanged
+ */
+func listenUnixSocket(path string, mode string, owner string, group string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applySocketPermissions(path, mode, owner, group); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+/**
+ * Removes the socket at the path if nothing is listening on it. Fails if the path
+ * exists but is not a socket, or another process is listening on it.
+ */
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+
+	return os.Remove(path)
+}
+
+func applySocketPermissions(path string, mode string, owner string, group string) error {
+	if mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socket mode '%s'", mode)
+		}
+		if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+			return err
+		}
+	}
+
+	if owner == "" && group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if owner != "" {
+		id, err := lookupId(owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return err
+		}
+		uid = id
+	}
+
+	if group != "" {
+		id, err := lookupId(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return err
+		}
+		gid = id
+	}
+
+	return os.Chown(path, uid, gid)
+}
+
+/**
+ * Resolves a user or group given either as a numeric id, or a name
+ */
+func lookupId(nameOrId string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrId); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(nameOrId)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
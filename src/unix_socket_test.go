@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixSocket_ReplacesStaleSocket(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-socket")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "svc.sock")
+
+	// leave a socket file behind with nothing listening on it
+	stale, err := net.Listen("unix", path)
+	assertNil(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnixSocket(path, "0600", "", "")
+	assertNil(t, err)
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	assertNil(t, err)
+	assertEqual(t, os.FileMode(0600), info.Mode().Perm(), "socket mode")
+}
+
+func TestListenUnixSocket_InUse(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-socket")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "svc.sock")
+
+	active, err := net.Listen("unix", path)
+	assertNil(t, err)
+	defer active.Close()
+
+	_, err = listenUnixSocket(path, "", "", "")
+	assertNotNil(t, err)
+}
+
+func TestListenUnixSocket_NotASocket(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-socket")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "svc.sock")
+	ioutil.WriteFile(path, []byte("not a socket"), 0644)
+
+	_, err := listenUnixSocket(path, "", "", "")
+	assertNotNil(t, err)
+}
+
+func TestListenUnixSocket_Ownership(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "consul-proxy-socket")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "svc.sock")
+
+	listener, err := listenUnixSocket(path, "", "", "")
+	assertNil(t, err)
+	listener.Close()
+
+	listener, err = listenUnixSocket(path, "0660", "no-such-user-for-consul-proxy", "")
+	assertNotNil(t, err)
+}